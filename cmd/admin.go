@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const (
+	defaultAdminRoutesPath  = "/admin/routes"
+	defaultAdminRefreshPath = "/admin/refresh-providers"
+)
+
+// AdminConfig enables the admin endpoints. They are always protected by
+// the admin block's own OIDC settings.
+type AdminConfig struct {
+	Enabled    bool   `yaml:"enabled" json:"enabled"`
+	RoutesPath string `yaml:"routes_path" json:"routes_path"`
+	// RefreshPath accepts a POST that empties the provider cache, so the
+	// next request re-runs discovery (default /admin/refresh-providers).
+	RefreshPath string `yaml:"refresh_path" json:"refresh_path"`
+	OIDC        OIDC   `yaml:"oidc" json:"oidc"`
+}
+
+// Validate requires OIDC settings whenever the admin endpoints are enabled.
+func (a AdminConfig) Validate() error {
+	if !a.Enabled {
+		return nil
+	}
+	var errs []error
+	if len(a.OIDC.issuerList()) == 0 && a.OIDC.Introspection.Endpoint == "" {
+		errs = append(errs, errors.New("admin.oidc.issuer is required when admin is enabled"))
+	}
+	if a.OIDC.ClientID == "" {
+		errs = append(errs, errors.New("admin.oidc.client_id is required when admin is enabled"))
+	}
+	for _, err := range a.OIDC.validate() {
+		errs = append(errs, errors.New("admin.oidc."+err.Error()))
+	}
+	return errors.Join(errs...)
+}
+
+func (a AdminConfig) routesPath() string {
+	if a.RoutesPath != "" {
+		return a.RoutesPath
+	}
+	return defaultAdminRoutesPath
+}
+
+func (a AdminConfig) refreshPath() string {
+	if a.RefreshPath != "" {
+		return a.RefreshPath
+	}
+	return defaultAdminRefreshPath
+}
+
+// routeInfo is the sanitized view of an endpoint served by the admin routes
+// endpoint. It deliberately has no field for the client secret.
+type routeInfo struct {
+	Path          string      `json:"path"`
+	Methods       []string    `json:"methods"`
+	Handler       HandlerType `json:"handler"`
+	Issuers       []string    `json:"issuers,omitempty"`
+	OIDCEnforced  bool        `json:"oidc_enforced"`
+	Introspection bool        `json:"introspection,omitempty"`
+}
+
+func newRouteInfo(endpoint Endpoint) routeInfo {
+	return routeInfo{
+		Path:          endpoint.Path,
+		Methods:       endpoint.methodList(),
+		Handler:       endpoint.Handler,
+		Issuers:       endpoint.OIDC.issuerList(),
+		OIDCEnforced:  endpoint.requiresOIDC(),
+		Introspection: endpoint.OIDC.Introspection.Endpoint != "",
+	}
+}
+
+// registerAdminRoutes adds the authenticated admin endpoints to rt.
+func (s *Server) registerAdminRoutes(rt *routes) {
+	if !s.admin.Enabled {
+		return
+	}
+	auth := newOIDCMiddleware(s.admin.OIDC, s.metrics)
+
+	path := s.admin.routesPath()
+	rt.handle(s.prefixBuiltins, path, auth.wrap(http.HandlerFunc(s.handleAdminRoutes)), http.MethodGet)
+	rt.handle(s.prefixBuiltins, s.admin.refreshPath(), auth.wrap(http.HandlerFunc(handleRefreshProviders)), http.MethodPost)
+}
+
+// handleRefreshProviders empties the provider cache and lists the issuers
+// that were evicted.
+func handleRefreshProviders(w http.ResponseWriter, r *http.Request) {
+	evicted := providers.reset()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"evicted": evicted})
+}
+
+func (s *Server) handleAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	endpoints := s.routes.endpoints
+	s.mu.RUnlock()
+
+	infos := make([]routeInfo, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		infos = append(infos, newRouteInfo(endpoint))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
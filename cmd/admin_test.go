@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestAdminRoutesRedactsSecrets(t *testing.T) {
+	admin := oidctest.NewProvider(t)
+	config := Config{
+		Admin: AdminConfig{Enabled: true, OIDC: OIDC{Issuer: admin.Issuer(), ClientID: admin.ClientID}},
+		Endpoints: []Endpoint{
+			{
+				Path:    "/hello",
+				Methods: []string{http.MethodGet, http.MethodPost},
+				Handler: HandlerHello,
+				OIDC:    OIDC{Issuer: "https://idp.example.com", ClientID: "app", ClientSecret: "super-secret-value"},
+			},
+			{Path: "/status", Method: http.MethodGet, Handler: HandlerStatic},
+		},
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, defaultAdminRoutesPath, nil)
+	req.Header.Set("Authorization", "Bearer "+admin.SignToken(map[string]interface{}{"sub": "operator"}))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "super-secret-value") || strings.Contains(rec.Body.String(), "client_secret") {
+		t.Fatalf("route table leaks the client secret: %s", rec.Body)
+	}
+
+	var routes []routeInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil {
+		t.Fatal(err)
+	}
+	want := []routeInfo{
+		{Path: "/hello", Methods: []string{"GET", "POST"}, Handler: HandlerHello, Issuers: []string{"https://idp.example.com"}, OIDCEnforced: true},
+		{Path: "/status", Methods: []string{"GET"}, Handler: HandlerStatic},
+	}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("routes = %+v, want %+v", routes, want)
+	}
+}
+
+func TestAdminRoutesRequireAuth(t *testing.T) {
+	admin, other := oidctest.NewProvider(t), oidctest.NewProvider(t)
+	config := Config{Admin: AdminConfig{Enabled: true, RoutesPath: "/ops/routes", OIDC: OIDC{Issuer: admin.Issuer(), ClientID: admin.ClientID}}}
+	s := newTestServer(t, config)
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "token from another issuer", token: other.SignToken(map[string]interface{}{"sub": "x"}), wantStatus: http.StatusUnauthorized},
+		{name: "admin token", token: admin.SignToken(map[string]interface{}{"sub": "operator"}), wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/ops/routes", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestAdminRefreshProviders(t *testing.T) {
+	admin, p := oidctest.NewProvider(t), oidctest.NewProvider(t)
+	config := Config{
+		Admin:     AdminConfig{Enabled: true, OIDC: OIDC{Issuer: admin.Issuer(), ClientID: admin.ClientID}},
+		Endpoints: []Endpoint{{Path: "/hello", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}}},
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	userToken := p.SignToken(map[string]interface{}{"sub": "alice"})
+	adminToken := admin.SignToken(map[string]interface{}{"sub": "operator"})
+	hello := func() {
+		t.Helper()
+		if rec := serve(http.MethodGet, "/hello", userToken); rec.Code != http.StatusOK {
+			t.Fatalf("GET /hello = %d: %s", rec.Code, rec.Body)
+		}
+	}
+
+	hello()
+	hello()
+	if got := p.DiscoveryCalls(); got != 1 {
+		t.Fatalf("discovery ran %d times before the refresh, want 1", got)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		token      string
+		wantStatus int
+	}{
+		{name: "no token", method: http.MethodPost, wantStatus: http.StatusUnauthorized},
+		{name: "user token", method: http.MethodPost, token: userToken, wantStatus: http.StatusUnauthorized},
+		{name: "GET", method: http.MethodGet, token: adminToken, wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if rec := serve(tt.method, defaultAdminRefreshPath, tt.token); rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+	}
+	hello()
+	if got := p.DiscoveryCalls(); got != 1 {
+		t.Fatalf("a refused refresh evicted the provider: discovery ran %d times", got)
+	}
+
+	rec := serve(http.MethodPost, defaultAdminRefreshPath, adminToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh = %d: %s", rec.Code, rec.Body)
+	}
+	var summary struct {
+		Evicted []string `json:"evicted"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, issuer := range []string{admin.Issuer(), p.Issuer()} {
+		if !slices.Contains(summary.Evicted, issuer) {
+			t.Errorf("evicted %v, want it to include %s", summary.Evicted, issuer)
+		}
+	}
+	hello()
+	if got := p.DiscoveryCalls(); got != 2 {
+		t.Errorf("discovery ran %d times after the refresh, want 2", got)
+	}
+
+	// Refreshes racing requests leave every request verified.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			serve(http.MethodPost, defaultAdminRefreshPath, adminToken)
+		}()
+		go func() {
+			defer wg.Done()
+			if rec := serve(http.MethodGet, "/hello", userToken); rec.Code != http.StatusOK {
+				t.Errorf("GET /hello during refresh = %d: %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+}
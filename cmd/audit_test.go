@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// setAuditor installs an audit log writing to w for the rest of the test.
+func setAuditor(t *testing.T, w *bytes.Buffer) {
+	t.Helper()
+	auditor = newAuditLog(w)
+	t.Cleanup(func() { auditor = nil })
+}
+
+func TestAuditLog(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	var logs bytes.Buffer
+	setAuditor(t, &logs)
+
+	items := Endpoint{Path: "/items/{id}", Method: http.MethodGet, Handler: HandlerStatic, Response: StaticResponse{Body: "item"}, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, RequiredScopes: []string{"items:read"}}}
+	feed := Endpoint{Path: "/feed", Method: http.MethodGet, Handler: HandlerStatic, Response: StaticResponse{Body: "feed"}, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, Optional: true}}
+	config := Config{TrustedProxies: []string{"192.0.2.1"}, Endpoints: []Endpoint{items, feed}}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := p.SignToken(map[string]interface{}{"sub": "alice", "scope": "items:read"})
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+		want       auditEntry
+	}{
+		{
+			name:       "allow",
+			path:       "/items/42",
+			token:      allowed,
+			wantStatus: http.StatusOK,
+			want:       auditEntry{Subject: "alice", Issuer: p.Issuer(), Endpoint: "/items/{id}", Method: http.MethodGet, Decision: auditAllow},
+		},
+		{
+			name:       "no token",
+			path:       "/items/42",
+			wantStatus: http.StatusUnauthorized,
+			want:       auditEntry{Subject: "anonymous", Endpoint: "/items/{id}", Method: http.MethodGet, Decision: auditDeny, Reason: "Authorization header missing"},
+		},
+		{
+			name:       "expired",
+			path:       "/items/42",
+			token:      p.SignToken(map[string]interface{}{"sub": "alice", "scope": "items:read", "exp": 1}),
+			wantStatus: http.StatusUnauthorized,
+			want:       auditEntry{Subject: "anonymous", Endpoint: "/items/{id}", Method: http.MethodGet, Decision: auditDeny, Reason: "Failed to verify token: " + p.Issuer() + ": oidc: token is expired"},
+		},
+		{
+			name:       "missing scope",
+			path:       "/items/42",
+			token:      p.SignToken(map[string]interface{}{"sub": "bob"}),
+			wantStatus: http.StatusForbidden,
+			want:       auditEntry{Subject: "bob", Issuer: p.Issuer(), Endpoint: "/items/{id}", Method: http.MethodGet, Decision: auditDeny, Reason: "Missing required scopes: items:read"},
+		},
+		{
+			name:       "optional without a token",
+			path:       "/feed",
+			wantStatus: http.StatusOK,
+			want:       auditEntry{Subject: "anonymous", Endpoint: "/feed", Method: http.MethodGet, Decision: auditAllow},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			req.Header.Set("X-Request-ID", "req-"+strings.ReplaceAll(tt.name, " ", "-"))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.srv.Handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			line := logs.String()
+			if strings.Count(line, "\n") != 1 {
+				t.Fatalf("audit log = %q, want one line", line)
+			}
+			if tt.token != "" && strings.Contains(line, tt.token) {
+				t.Errorf("audit entry contains the raw token: %s", line)
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatalf("audit entry %q: %v", line, err)
+			}
+			var got auditEntry
+			if err := json.Unmarshal([]byte(line), &got); err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(got.Time); d < 0 || d > time.Minute || got.Time.Location() != time.UTC {
+				t.Errorf("time = %v, want now in UTC", got.Time)
+			}
+			want := tt.want
+			want.Time = got.Time
+			want.RequestID = req.Header.Get("X-Request-ID")
+			want.ClientIP = "203.0.113.7"
+			// Verification errors end with details such as the expiry time.
+			if want.Reason != "" && strings.HasPrefix(got.Reason, want.Reason) {
+				want.Reason = got.Reason
+			}
+			if got != want {
+				t.Errorf("entry = %+v\nwant    %+v", got, want)
+			}
+			// Only the documented fields are written.
+			var keys []string
+			for k := range fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			wantKeys := []string{"client_ip", "decision", "endpoint", "method", "request_id", "subject", "time"}
+			if want.Issuer != "" {
+				wantKeys = append(wantKeys, "issuer")
+			}
+			if want.Reason != "" {
+				wantKeys = append(wantKeys, "reason")
+			}
+			sort.Strings(wantKeys)
+			if !reflect.DeepEqual(keys, wantKeys) {
+				t.Errorf("fields = %v, want %v", keys, wantKeys)
+			}
+		})
+	}
+}
+
+func TestOpenAuditLog(t *testing.T) {
+	t.Cleanup(func() { auditor = nil })
+	p := oidctest.NewProvider(t)
+	oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+	h := OIDCMiddleware(oidcConfig)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"decision":"allow","subject":"earlier"}`+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := openAuditLog(AuditConfig{Enabled: true, Output: path}); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{p.SignToken(map[string]interface{}{"sub": "alice"}), "not-a-jwt"} {
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var decisions []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		decisions = append(decisions, entry.Subject+" "+entry.Decision)
+	}
+	// The file is appended to, not truncated.
+	if want := []string{"earlier allow", "alice allow", "anonymous deny"}; !reflect.DeepEqual(decisions, want) {
+		t.Errorf("audit file = %v, want %v", decisions, want)
+	}
+
+	if err := openAuditLog(AuditConfig{}); err != nil || auditor != nil {
+		t.Errorf("disabled audit log: auditor = %v, err = %v", auditor, err)
+	}
+	err = (AuditConfig{Enabled: true, Output: filepath.Join(t.TempDir(), "missing", "audit.log")}).Validate()
+	if err == nil || !strings.HasPrefix(err.Error(), "audit.output: ") {
+		t.Errorf("output in a missing directory: error = %v", err)
+	}
+}
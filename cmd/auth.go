@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/mux"
+)
+
+type contextKey int
+
+const (
+	tokenContextKey contextKey = iota
+	claimsContextKey
+	identityContextKey
+	requestInfoContextKey
+)
+
+// TokenFromContext returns the ID token verified by OIDCMiddleware, or nil if
+// the request was not authenticated or the token was introspected rather
+// than verified locally.
+func TokenFromContext(ctx context.Context) *oidc.IDToken {
+	idToken, _ := ctx.Value(tokenContextKey).(*oidc.IDToken)
+	return idToken
+}
+
+// ClaimsFromContext returns the claims of the token accepted by
+// OIDCMiddleware, or nil if the request was not authenticated.
+func ClaimsFromContext(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(claimsContextKey).(map[string]interface{})
+	return claims
+}
+
+// IdentityFromContext returns the caller identity resolved by
+// OIDCMiddleware from the endpoint's identity claim, or "" if the request was
+// not authenticated.
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityContextKey).(string)
+	return identity
+}
+
+// RequestIDFromContext returns the request's X-Request-ID, or "" if it had
+// none or didn't pass through requestInfoMiddleware.
+func RequestIDFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.requestID
+	}
+	return ""
+}
+
+// ClientIPFromContext returns the client address resolved from trusted
+// proxies' X-Forwarded-For, or "" if the request didn't pass through
+// requestInfoMiddleware.
+func ClientIPFromContext(ctx context.Context) string {
+	if info := requestInfoFromContext(ctx); info != nil {
+		return info.clientIP
+	}
+	return ""
+}
+
+// requestInfo is placed in the context by requestInfoMiddleware so that
+// inner middleware can report details back to the log line. It is guarded by a
+// mutex because http.TimeoutHandler runs handlers on another goroutine.
+type requestInfo struct {
+	// clientIP and requestID are set before the request is dispatched and
+	// never change.
+	clientIP  string
+	requestID string
+
+	mu       sync.Mutex
+	identity string
+}
+
+func (i *requestInfo) setIdentity(identity string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.identity = identity
+}
+
+func (i *requestInfo) getIdentity() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.identity
+}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey).(*requestInfo)
+	return info
+}
+
+// OIDCMiddleware verifies the bearer token on each request against
+// oidcConfig and makes the verified token available via TokenFromContext.
+// Requests without a valid token are rejected with 401.
+func OIDCMiddleware(oidcConfig OIDC) mux.MiddlewareFunc {
+	return newOIDCMiddleware(oidcConfig, nil).wrap
+}
+
+// oidcMiddleware is the implementation behind OIDCMiddleware, carrying the
+// server-level dependencies that the exported constructor leaves unset.
+type oidcMiddleware struct {
+	config  OIDC
+	metrics *metrics
+	tokens  *tokenCache
+	// authHeaders adds the X-Auth-* debugging headers to responses.
+	authHeaders bool
+	// anonymous, when set, serves requests without a valid token.
+	anonymous http.Handler
+}
+
+func newOIDCMiddleware(oidcConfig OIDC, m *metrics) *oidcMiddleware {
+	mw := &oidcMiddleware{config: oidcConfig, metrics: m}
+	if oidcConfig.TokenCacheSize > 0 {
+		mw.tokens = newTokenCache(oidcConfig.TokenCacheSize)
+	}
+	return mw
+}
+
+// authenticate accepts rawToken either by introspecting it, when an
+// introspection endpoint is configured, or by verifying it locally. The
+// returned ID token is nil for introspected tokens.
+func (m *oidcMiddleware) authenticate(ctx context.Context, rawToken string) (*oidc.IDToken, map[string]interface{}, error) {
+	if m.config.Introspection.Endpoint != "" {
+		claims, err := introspector.introspect(ctx, m.config, rawToken)
+		return nil, claims, err
+	}
+
+	if m.tokens != nil {
+		if idToken, claims, ok := m.tokens.get(rawToken, time.Now()); ok {
+			return idToken, claims, nil
+		}
+	}
+
+	idToken, err := providers.verify(ctx, m.config, rawToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims, err := tokenClaims(idToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.tokens != nil {
+		m.tokens.add(rawToken, idToken, claims)
+	}
+	return idToken, claims, nil
+}
+
+func (m *oidcMiddleware) wrap(next http.Handler) http.Handler {
+	oidcConfig := m.config
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		var idToken *oidc.IDToken
+		claims, ok := sessions.Load().claims(r, oidcConfig)
+		if !ok {
+			idToken, claims, ok = m.authenticateRequest(w, r, next)
+			if !ok {
+				return
+			}
+		}
+		claims = mapClaims(claims, oidcConfig.ClaimMappings)
+
+		if len(oidcConfig.RequiredScopes) > 0 {
+			granted := tokenScopes(claims)
+			if missing := missingScopes(oidcConfig.RequiredScopes, granted); len(missing) > 0 {
+				description := "Missing required scopes: " + strings.Join(missing, " ")
+				w.Header().Set("WWW-Authenticate", bearerChallenge("insufficient_scope", description))
+				m.deny(w, r, claims, http.StatusForbidden, description)
+				return
+			}
+		}
+
+		if name := checkRequiredClaims(oidcConfig.RequiredClaims, claims); name != "" {
+			m.deny(w, r, claims, http.StatusForbidden, "Required claim not satisfied: "+name)
+			return
+		}
+
+		if !oidcConfig.Authz.allows(claims) {
+			m.deny(w, r, claims, http.StatusForbidden, "Not authorized for this endpoint")
+			return
+		}
+
+		forwardClaims(w, claims, oidcConfig.ForwardClaims)
+		if m.authHeaders {
+			w.Header().Set("X-Auth-Subject", claimString(claims["sub"]))
+			w.Header().Set("X-Auth-Issuer", claimString(claims["iss"]))
+		}
+
+		identity := identityFromClaims(claims, oidcConfig.IdentityClaim)
+		if info := requestInfoFromContext(ctx); info != nil {
+			info.setIdentity(identity)
+		}
+
+		auditor.record(r, claims, auditAllow, "")
+		if idToken != nil {
+			ctx = context.WithValue(ctx, tokenContextKey, idToken)
+		}
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+		ctx = context.WithValue(ctx, identityContextKey, identity)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticateRequest verifies the request's token. If it fails, the
+// rejection (or, on optional endpoints, the anonymous request) has already
+// been handled and ok is false.
+func (m *oidcMiddleware) authenticateRequest(w http.ResponseWriter, r *http.Request, next http.Handler) (idToken *oidc.IDToken, claims map[string]interface{}, ok bool) {
+	oidcConfig := m.config
+	rawToken, err := extractToken(r, oidcConfig.TokenSource)
+	if err != nil {
+		m.debugError(w, err)
+		m.unauthorized(w, r, next, "invalid_request", err.Error())
+		return nil, nil, false
+	}
+
+	verifyCtx, cancel := context.WithTimeout(r.Context(), oidcConfig.verifyTimeout())
+	start := time.Now()
+	idToken, claims, err = m.authenticate(verifyCtx, rawToken)
+	elapsed := time.Since(start)
+	m.metrics.observeVerification(err, elapsed)
+	timedOut := errors.Is(verifyCtx.Err(), context.DeadlineExceeded)
+	cancel()
+	if err != nil {
+		slog.Debug("token verification failed", "path", r.URL.Path, "duration", elapsed, "error", err)
+		m.debugError(w, err)
+		if status, message := verificationFailure(err, timedOut); status != 0 {
+			m.deny(w, r, nil, status, message)
+			return nil, nil, false
+		}
+		m.unauthorized(w, r, next, "invalid_token", "Failed to verify token: "+err.Error())
+		return nil, nil, false
+	}
+
+	if err := checkAudience(oidcConfig, claims); err != nil {
+		m.debugError(w, err)
+		m.unauthorized(w, r, next, "invalid_token", "Failed to verify token: "+err.Error())
+		return nil, nil, false
+	}
+
+	if err := checkNonce(r, oidcConfig, claims); err != nil {
+		m.debugError(w, err)
+		m.unauthorized(w, r, next, "invalid_token", "Failed to verify token: "+err.Error())
+		return nil, nil, false
+	}
+
+	if oidcConfig.FetchUserInfo {
+		ctx, cancel := context.WithTimeout(r.Context(), oidcConfig.verifyTimeout())
+		merged, err := userInfos.merge(ctx, oidcConfig, rawToken, claims)
+		cancel()
+		if err != nil {
+			slog.Error("fetching user info failed", "path", r.URL.Path, "error", err)
+			m.debugError(w, err)
+			m.deny(w, r, claims, http.StatusBadGateway, "Failed to fetch user info")
+			return nil, nil, false
+		}
+		claims = merged
+	}
+	if m.authHeaders {
+		w.Header().Set("X-Auth-Verify-Duration", elapsed.String())
+	}
+	slog.Debug("token verified", "path", r.URL.Path, "duration", elapsed, "issuer", claimString(claims["iss"]), "subject", claimString(claims["sub"]))
+	return idToken, claims, true
+}
+
+// verificationFailure returns the status and message for a token that
+// couldn't be checked because something upstream failed, or 0 if the token
+// itself was rejected.
+func verificationFailure(err error, timedOut bool) (int, string) {
+	var de *discoveryError
+	var ke *keySetError
+	var ie *introspectionError
+	switch {
+	case timedOut:
+		return http.StatusGatewayTimeout, "Timed out contacting the OIDC provider"
+	case errors.As(err, &de):
+		return http.StatusServiceUnavailable, "OIDC provider discovery failed"
+	case errors.As(err, &ke):
+		return http.StatusServiceUnavailable, "OIDC provider signing keys unavailable"
+	case errors.As(err, &ie):
+		return http.StatusBadGateway, "Failed to introspect token"
+	}
+	return 0, ""
+}
+
+// deny audits the rejection of r and writes the error response. The
+// message is also the X-Auth-Error, unless a verification error has
+// already set a more specific one.
+func (m *oidcMiddleware) deny(w http.ResponseWriter, r *http.Request, claims map[string]interface{}, status int, message string) {
+	auditor.record(r, claims, auditDeny, message)
+	if w.Header().Get("X-Auth-Error") == "" {
+		m.debugError(w, errors.New(message))
+	}
+	writeError(w, status, message)
+}
+
+// debugError reports why authentication failed in X-Auth-Error when auth
+// headers are enabled. Verification errors describe the token but never
+// include it.
+func (m *oidcMiddleware) debugError(w http.ResponseWriter, err error) {
+	if m.authHeaders {
+		w.Header().Set("X-Auth-Error", bearerDescription(err.Error()))
+	}
+}
+
+// unauthorized rejects a request that has no usable token, hands it to the
+// anonymous handler if there is one, or, on optional endpoints, lets it
+// through anonymously.
+func (m *oidcMiddleware) unauthorized(w http.ResponseWriter, r *http.Request, next http.Handler, code, description string) {
+	if m.anonymous != nil {
+		auditor.record(r, nil, auditAllow, "")
+		m.anonymous.ServeHTTP(w, r)
+		return
+	}
+	if m.config.Optional {
+		auditor.record(r, nil, auditAllow, "")
+		next.ServeHTTP(w, r)
+		return
+	}
+	auditor.record(r, nil, auditDeny, description)
+	writeBearerError(w, http.StatusUnauthorized, code, description)
+}
+
+// writeBearerError writes an error response with an RFC 6750
+// WWW-Authenticate challenge carrying code and description.
+func writeBearerError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("WWW-Authenticate", bearerChallenge(code, description))
+	writeError(w, status, description)
+}
+
+// bearerChallenge returns the WWW-Authenticate value for an RFC 6750 error.
+func bearerChallenge(code, description string) string {
+	return fmt.Sprintf(`Bearer error=%q, error_description=%q`, code, bearerDescription(description))
+}
+
+// bearerDescription drops characters RFC 6750 doesn't allow in
+// error_description, so the challenge stays a valid quoted string.
+func bearerDescription(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' || r == '\\' || r < 0x20 || r > 0x7e {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// parseTokenSource splits a token_source value into its kind ("header",
+// "cookie" or "query") and, for cookies and query parameters, the name.
+func parseTokenSource(source string) (kind, name string, err error) {
+	if source == "" || source == "header" {
+		return "header", "", nil
+	}
+	kind, name, _ = strings.Cut(source, ":")
+	if (kind != "cookie" && kind != "query") || name == "" {
+		return "", "", fmt.Errorf("unsupported token source %q (expected header, cookie:<name> or query:<param>)", source)
+	}
+	return kind, name, nil
+}
+
+// extractToken reads the raw token from the location named by source. The
+// header source expects a bearer token; cookie and query sources hold the
+// raw token value.
+func extractToken(r *http.Request, source string) (string, error) {
+	kind, name, err := parseTokenSource(source)
+	if err != nil {
+		return "", err
+	}
+
+	switch kind {
+	case "cookie":
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", fmt.Errorf("token cookie %q missing", name)
+		}
+		return cookie.Value, nil
+	case "query":
+		token := r.URL.Query().Get(name)
+		if token == "" {
+			return "", fmt.Errorf("token query parameter %q missing", name)
+		}
+		return token, nil
+	default:
+		return extractBearerToken(r.Header.Get("Authorization"))
+	}
+}
+
+// extractBearerToken returns the token from an "Authorization: Bearer <token>"
+// header value. The scheme is matched case-insensitively.
+func extractBearerToken(authHeader string) (string, error) {
+	authHeader = strings.TrimSpace(authHeader)
+	if authHeader == "" {
+		return "", errors.New("Authorization header missing")
+	}
+
+	scheme, token, found := strings.Cut(authHeader, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errors.New("Authorization header must use the Bearer scheme")
+	}
+
+	token = strings.TrimSpace(token)
+	if !found || token == "" {
+		return "", errors.New("Authorization header is missing the bearer token")
+	}
+	return token, nil
+}
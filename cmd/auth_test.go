@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestExtractBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr string
+	}{
+		{name: "valid", header: "Bearer abc.def.ghi", want: "abc.def.ghi"},
+		{name: "lowercase scheme", header: "bearer abc", want: "abc"},
+		{name: "extra spaces", header: "  Bearer    abc  ", want: "abc"},
+		{name: "empty", header: "", wantErr: "Authorization header missing"},
+		{name: "whitespace only", header: "   ", wantErr: "Authorization header missing"},
+		{name: "wrong scheme", header: "Basic dXNlcjpwYXNz", wantErr: "must use the Bearer scheme"},
+		{name: "scheme only", header: "Bearer", wantErr: "missing the bearer token"},
+		{name: "scheme and spaces", header: "Bearer    ", wantErr: "missing the bearer token"},
+		{name: "short", header: "Bea", wantErr: "must use the Bearer scheme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractBearerToken(tt.header)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extractBearerToken(%q) error = %v, want %q", tt.header, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractBearerToken(%q): %v", tt.header, err)
+			}
+			if got != tt.want {
+				t.Errorf("extractBearerToken(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMalformedHeaderRejectedWithReason(t *testing.T) {
+	h := OIDCMiddleware(OIDC{Issuer: "https://idp.invalid", ClientID: "client"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called for a request without a valid token")
+	}))
+	for _, header := range []string{"", "Basic dXNlcjpwYXNz", "Bearer"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%q: status = %d, want 401", header, rec.Code)
+		}
+		if _, err := extractBearerToken(header); !strings.Contains(rec.Body.String(), err.Error()) {
+			t.Errorf("%q: body %q does not give the reason %q", header, rec.Body.String(), err)
+		}
+	}
+}
+
+func TestVerifyTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stop:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(stop)
+
+	p := oidctest.NewProvider(t)
+	token := p.SignToken(map[string]interface{}{"sub": "alice", "iss": slow.URL})
+	h := OIDCMiddleware(OIDC{Issuer: slow.URL, ClientID: p.ClientID, VerifyTimeout: "100ms"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called without a verified token")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(rec, req)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("request took %v, want it bounded by verify_timeout", elapsed)
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "Timed out contacting the OIDC provider") {
+		t.Errorf("body %q does not explain the timeout", rec.Body)
+	}
+}
+
+func TestInvalidTokenIsNotTimeout(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, VerifyTimeout: "100ms"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401 for an expired token: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	token := p.SignToken(map[string]interface{}{"sub": "alice"})
+	withHeader := func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	withCookie := func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "id_token", Value: token}) }
+	withQuery := func(r *http.Request) { r.URL.RawQuery = "access_token=" + token }
+
+	tests := []struct {
+		name       string
+		source     string
+		setup      func(*http.Request)
+		wantStatus int
+		wantReason string
+	}{
+		{name: "default header", setup: withHeader, wantStatus: http.StatusOK},
+		{name: "header", source: "header", setup: withHeader, wantStatus: http.StatusOK},
+		{name: "header missing", source: "header", setup: withCookie, wantStatus: http.StatusUnauthorized, wantReason: "Authorization header missing"},
+		{name: "cookie", source: "cookie:id_token", setup: withCookie, wantStatus: http.StatusOK},
+		{name: "cookie missing", source: "cookie:id_token", setup: withHeader, wantStatus: http.StatusUnauthorized, wantReason: `token cookie "id_token" missing`},
+		{name: "query", source: "query:access_token", setup: withQuery, wantStatus: http.StatusOK},
+		{name: "query missing", source: "query:access_token", setup: withCookie, wantStatus: http.StatusUnauthorized, wantReason: `token query parameter "access_token" missing`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, TokenSource: tt.source})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.setup(req)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantReason != "" && !strings.Contains(rec.Body.String(), tt.wantReason) {
+				t.Errorf("body %q does not contain %q", rec.Body, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestParseTokenSource(t *testing.T) {
+	for _, source := range []string{"cookie", "cookie:", "query:", "body:token", "Header"} {
+		if _, _, err := parseTokenSource(source); err == nil {
+			t.Errorf("parseTokenSource(%q) accepted an invalid source", source)
+		}
+	}
+}
+
+func TestWWWAuthenticate(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, RequiredScopes: []string{"admin"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		want       string
+	}{
+		{name: "missing header", wantStatus: http.StatusUnauthorized, want: `Bearer error="invalid_request", error_description="Authorization header missing"`},
+		{name: "malformed header", header: "Basic dXNlcjpwYXNz", wantStatus: http.StatusUnauthorized, want: `Bearer error="invalid_request", error_description="Authorization header must use the Bearer scheme"`},
+		{name: "failed verification", header: "Bearer not.a.jwt", wantStatus: http.StatusUnauthorized, want: `Bearer error="invalid_token", error_description="Failed to verify token: `},
+		{name: "insufficient scope", header: "Bearer " + p.SignToken(map[string]interface{}{"sub": "alice", "scope": "read"}), wantStatus: http.StatusForbidden, want: `Bearer error="insufficient_scope", error_description="Missing required scopes: admin"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("WWW-Authenticate = %q, want prefix %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerDescription(t *testing.T) {
+	if got := bearerDescription("bad \"quote\" \\ and\nnewline é"); got != "bad quote  andnewline " {
+		t.Errorf("bearerDescription = %q", got)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	p, other := oidctest.NewProvider(t), oidctest.NewProvider(t)
+	h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, Optional: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if TokenFromContext(r.Context()) == nil {
+			io.WriteString(w, "anonymous")
+			return
+		}
+		io.WriteString(w, "hello "+IdentityFromContext(r.Context()))
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "anonymous", want: "anonymous"},
+		{name: "valid token", header: "Bearer " + p.SignToken(map[string]interface{}{"sub": "alice", "email": "alice@example.com"}), want: "hello alice@example.com"},
+		{name: "invalid token still allowed", header: "Bearer " + other.SignToken(map[string]interface{}{"sub": "mallory", "iss": p.Issuer()}), want: "anonymous"},
+		{name: "malformed header still allowed", header: "Basic dXNlcjpwYXNz", want: "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if rec.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthDebugHeaders(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	valid := p.SignToken(map[string]interface{}{"sub": "alice"})
+	expired := p.SignToken(map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()})
+	tests := []struct {
+		name        string
+		enabled     bool
+		token       string
+		scopes      []string
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "success",
+			enabled:     true,
+			token:       valid,
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"X-Auth-Subject": "alice", "X-Auth-Issuer": p.Issuer(), "X-Auth-Error": ""},
+		},
+		{
+			name:        "failure",
+			enabled:     true,
+			token:       expired,
+			wantStatus:  http.StatusUnauthorized,
+			wantHeaders: map[string]string{"X-Auth-Subject": "", "X-Auth-Error": "token is expired", "X-Auth-Verify-Duration": ""},
+		},
+		{
+			name:        "malformed header",
+			enabled:     true,
+			wantStatus:  http.StatusUnauthorized,
+			wantHeaders: map[string]string{"X-Auth-Error": "missing"},
+		},
+		{
+			name:        "missing scope",
+			enabled:     true,
+			token:       valid,
+			scopes:      []string{"admin"},
+			wantStatus:  http.StatusForbidden,
+			wantHeaders: map[string]string{"X-Auth-Error": "Missing required scopes: admin", "WWW-Authenticate": `error="insufficient_scope"`},
+		},
+		{
+			name:        "disabled on success",
+			token:       valid,
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"X-Auth-Subject": "", "X-Auth-Issuer": "", "X-Auth-Verify-Duration": ""},
+		},
+		{
+			name:        "disabled on failure",
+			token:       expired,
+			wantStatus:  http.StatusUnauthorized,
+			wantHeaders: map[string]string{"X-Auth-Error": "", "X-Auth-Verify-Duration": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				Debug:     DebugConfig{AuthHeaders: tt.enabled},
+				Endpoints: []Endpoint{{Path: "/me", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, RequiredScopes: tt.scopes}}},
+			}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/me", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			for name, want := range tt.wantHeaders {
+				got := rec.Header().Get(name)
+				if (want == "" && got != "") || !strings.Contains(got, want) {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.enabled && tt.wantStatus == http.StatusOK {
+				if _, err := time.ParseDuration(rec.Header().Get("X-Auth-Verify-Duration")); err != nil {
+					t.Errorf("X-Auth-Verify-Duration: %v", err)
+				}
+			}
+			for name, values := range rec.Header() {
+				for _, v := range values {
+					if tt.token != "" && strings.Contains(v, tt.token[strings.LastIndex(tt.token, ".")+1:]) {
+						t.Errorf("header %s leaks the token", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestContextGetters(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.1"})
+	oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, IdentityClaim: "email"}
+	token := p.SignToken(map[string]interface{}{"sub": "u1", "email": "alice@example.com"})
+
+	type values struct {
+		subject, claimSub, identity, requestID, clientIP string
+	}
+	tests := []struct {
+		name  string
+		chain func(http.Handler) http.Handler
+		want  values
+	}{
+		{
+			name: "full chain",
+			chain: func(h http.Handler) http.Handler {
+				return requestInfoMiddleware(proxies, OIDCMiddleware(oidcConfig)(h))
+			},
+			want: values{subject: "u1", claimSub: "u1", identity: "alice@example.com", requestID: "req-42", clientIP: "203.0.113.9"},
+		},
+		{
+			name: "request info only",
+			chain: func(h http.Handler) http.Handler {
+				return requestInfoMiddleware(proxies, h)
+			},
+			want: values{requestID: "req-42", clientIP: "203.0.113.9"},
+		},
+		{
+			name:  "bare handler",
+			chain: func(h http.Handler) http.Handler { return h },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got values
+			var ctx context.Context
+			h := tt.chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx = r.Context()
+				if token := TokenFromContext(ctx); token != nil {
+					got.subject = token.Subject
+				}
+				if claims := ClaimsFromContext(ctx); claims != nil {
+					got.claimSub, _ = claims["sub"].(string)
+				}
+				got.identity = IdentityFromContext(ctx)
+				got.requestID = RequestIDFromContext(ctx)
+				got.clientIP = ClientIPFromContext(ctx)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:1"
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			req.Header.Set("X-Request-ID", "req-42")
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			// handleHello greets from the context alone, without verifying
+			// the header again.
+			if tt.want.subject == "" {
+				return
+			}
+			hello, err := newHelloHandler(Endpoint{Path: "/hello", OIDC: oidcConfig})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec = httptest.NewRecorder()
+			hello.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hello", nil).WithContext(ctx))
+			if got := rec.Body.String(); got != "Hello, alice@example.com!" {
+				t.Errorf("handleHello from context = %d %q", rec.Code, got)
+			}
+		})
+	}
+}
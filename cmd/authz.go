@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// AuthzConfig restricts an endpoint to particular users. A token is allowed
+// if it matches any entry in any list; when every list is empty there is no
+// restriction.
+type AuthzConfig struct {
+	AllowedEmails   []string `yaml:"allowed_emails" json:"allowed_emails"`
+	AllowedDomains  []string `yaml:"allowed_domains" json:"allowed_domains"`
+	AllowedSubjects []string `yaml:"allowed_subjects" json:"allowed_subjects"`
+}
+
+// restricted reports whether any allowlist is set.
+func (a AuthzConfig) restricted() bool {
+	return len(a.AllowedEmails) > 0 || len(a.AllowedDomains) > 0 || len(a.AllowedSubjects) > 0
+}
+
+// allows reports whether the token's email, email domain or subject is on
+// one of the allowlists. Emails and domains are compared case-insensitively.
+func (a AuthzConfig) allows(claims map[string]interface{}) bool {
+	if !a.restricted() {
+		return true
+	}
+
+	email, _ := claims["email"].(string)
+	if email != "" {
+		for _, allowed := range a.AllowedEmails {
+			if strings.EqualFold(email, allowed) {
+				return true
+			}
+		}
+		if at := strings.LastIndex(email, "@"); at >= 0 {
+			domain := email[at+1:]
+			for _, allowed := range a.AllowedDomains {
+				if strings.EqualFold(domain, strings.TrimPrefix(allowed, "@")) {
+					return true
+				}
+			}
+		}
+	}
+
+	if sub, _ := claims["sub"].(string); sub != "" {
+		for _, allowed := range a.AllowedSubjects {
+			if sub == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkRequiredClaims returns the name of the first required claim the token
+// lacks or carries with a different value, or "" if all match. The order
+// of a map is random, so names are checked in sorted order.
+func checkRequiredClaims(required map[string]interface{}, claims map[string]interface{}) string {
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !claimMatches(claims[name], required[name]) {
+			return name
+		}
+	}
+	return ""
+}
+
+// claimMatches compares a claim with a configured value regardless of
+// whether either side is a string, number or boolean, so that a YAML value
+// of 42 matches a JSON claim of 42.0 or "42". Array claims match if any
+// element does.
+func claimMatches(actual, expected interface{}) bool {
+	if actual == nil {
+		return false
+	}
+	if values, ok := actual.([]interface{}); ok {
+		for _, v := range values {
+			if claimMatches(v, expected) {
+				return true
+			}
+		}
+		return false
+	}
+	return claimString(actual) == claimString(normalizeNumber(expected))
+}
+
+// normalizeNumber converts the integer types a config decoder produces to
+// float64, the type encoding/json uses for claims.
+func normalizeNumber(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	}
+	return v
+}
+
+// tokenScopes returns the scopes granted to a token, read from the
+// space-delimited "scope" claim or, failing that, the "scp" claim, which
+// some providers emit as an array.
+func tokenScopes(claims map[string]interface{}) []string {
+	if scope, ok := claims["scope"].(string); ok && scope != "" {
+		return strings.Fields(scope)
+	}
+
+	switch scp := claims["scp"].(type) {
+	case string:
+		return strings.Fields(scp)
+	case []interface{}:
+		scopes := make([]string, 0, len(scp))
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+		return scopes
+	}
+	return nil
+}
+
+// missingScopes returns the entries of required that are not in granted.
+func missingScopes(required, granted []string) []string {
+	have := make(map[string]bool, len(granted))
+	for _, s := range granted {
+		have[s] = true
+	}
+
+	var missing []string
+	for _, s := range required {
+		if !have[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// parseAudiences returns the token's "aud" claim, which may be a single
+// string or an array of strings. A missing claim yields no audiences; any
+// other encoding is an error rather than being silently ignored.
+func parseAudiences(claims map[string]interface{}) ([]string, error) {
+	switch aud := claims["aud"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{aud}, nil
+	case []string:
+		return aud, nil
+	case []interface{}:
+		auds := make([]string, 0, len(aud))
+		for _, a := range aud {
+			str, ok := a.(string)
+			if !ok {
+				return nil, fmt.Errorf("malformed aud claim: element of type %T", a)
+			}
+			auds = append(auds, str)
+		}
+		return auds, nil
+	default:
+		return nil, fmt.Errorf("malformed aud claim: unexpected type %T", aud)
+	}
+}
+
+// checkAudience enforces the audiences list, if any: the token must carry at
+// least one of Audiences or Audience.
+func checkAudience(oidcConfig OIDC, claims map[string]interface{}) error {
+	if len(oidcConfig.Audiences) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool, len(oidcConfig.Audiences)+1)
+	for _, aud := range oidcConfig.Audiences {
+		allowed[aud] = true
+	}
+	if oidcConfig.Audience != "" {
+		allowed[oidcConfig.Audience] = true
+	}
+
+	auds, err := parseAudiences(claims)
+	if err != nil {
+		return err
+	}
+	for _, aud := range auds {
+		if allowed[aud] {
+			return nil
+		}
+	}
+	return fmt.Errorf("token audience %q does not match any expected audience", auds)
+}
+
+// checkNonce enforces the configured nonce, if any, against the token's
+// "nonce" claim.
+func checkNonce(r *http.Request, oidcConfig OIDC, claims map[string]interface{}) error {
+	expected := oidcConfig.Nonce
+	if oidcConfig.NonceCookie != "" {
+		cookie, err := r.Cookie(oidcConfig.NonceCookie)
+		if err != nil || cookie.Value == "" {
+			return errors.New("expected nonce cookie missing")
+		}
+		expected = cookie.Value
+	}
+	if expected == "" {
+		return nil
+	}
+
+	nonce, _ := claims["nonce"].(string)
+	if nonce == "" {
+		return errors.New("token nonce missing")
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(expected)) != 1 {
+		return errors.New("token nonce mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestRequiredScopes(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	h := OIDCMiddleware(OIDC{
+		Issuer:         p.Issuer(),
+		ClientID:       p.ClientID,
+		RequiredScopes: []string{"read", "write"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name        string
+		claims      map[string]interface{}
+		wantStatus  int
+		wantMissing string
+	}{
+		{name: "all scopes", claims: map[string]interface{}{"scope": "openid read write"}, wantStatus: http.StatusOK},
+		{name: "some scopes", claims: map[string]interface{}{"scope": "openid read"}, wantStatus: http.StatusForbidden, wantMissing: "write"},
+		{name: "no scopes", claims: map[string]interface{}{}, wantStatus: http.StatusForbidden, wantMissing: "read write"},
+		{name: "scp array", claims: map[string]interface{}{"scp": []string{"write", "read"}}, wantStatus: http.StatusOK},
+		{name: "scp array missing one", claims: map[string]interface{}{"scp": []string{"read"}}, wantStatus: http.StatusForbidden, wantMissing: "write"},
+		{name: "scp string", claims: map[string]interface{}{"scp": "read write"}, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["sub"] = "alice"
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(tt.claims))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantMissing == "" {
+				return
+			}
+			if want := "Missing required scopes: " + tt.wantMissing; !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("body %q does not contain %q", rec.Body, want)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); !strings.Contains(got, `error="insufficient_scope"`) {
+				t.Errorf("WWW-Authenticate = %q, want insufficient_scope", got)
+			}
+		})
+	}
+}
+
+func TestNonce(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	tests := []struct {
+		name       string
+		cfg        OIDC
+		tokenNonce string
+		cookie     string
+		wantStatus int
+		wantReason string
+	}{
+		{name: "matching", cfg: OIDC{Nonce: "n-0S6"}, tokenNonce: "n-0S6", wantStatus: http.StatusOK},
+		{name: "missing", cfg: OIDC{Nonce: "n-0S6"}, wantStatus: http.StatusUnauthorized, wantReason: "token nonce missing"},
+		{name: "mismatched", cfg: OIDC{Nonce: "n-0S6"}, tokenNonce: "other", wantStatus: http.StatusUnauthorized, wantReason: "token nonce mismatch"},
+		{name: "not configured", tokenNonce: "anything", wantStatus: http.StatusOK},
+		{name: "cookie matching", cfg: OIDC{NonceCookie: "nonce"}, tokenNonce: "from-cookie", cookie: "from-cookie", wantStatus: http.StatusOK},
+		{name: "cookie mismatched", cfg: OIDC{NonceCookie: "nonce"}, tokenNonce: "from-token", cookie: "from-cookie", wantStatus: http.StatusUnauthorized, wantReason: "token nonce mismatch"},
+		{name: "cookie absent", cfg: OIDC{NonceCookie: "nonce"}, tokenNonce: "from-token", wantStatus: http.StatusUnauthorized, wantReason: "expected nonce cookie missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Issuer, cfg.ClientID = p.Issuer(), p.ClientID
+			h := OIDCMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			claims := map[string]interface{}{"sub": "alice"}
+			if tt.tokenNonce != "" {
+				claims["nonce"] = tt.tokenNonce
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(claims))
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "nonce", Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantReason != "" && !strings.Contains(rec.Body.String(), tt.wantReason) {
+				t.Errorf("body %q does not contain %q", rec.Body, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestAuthzAllowlist(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	restricted := AuthzConfig{
+		AllowedEmails:   []string{"Alice@Example.com"},
+		AllowedDomains:  []string{"@partner.example"},
+		AllowedSubjects: []string{"service-account-7"},
+	}
+	tests := []struct {
+		name       string
+		authz      AuthzConfig
+		claims     map[string]interface{}
+		wantStatus int
+	}{
+		{name: "allowed email", authz: restricted, claims: map[string]interface{}{"sub": "u1", "email": "alice@example.COM"}, wantStatus: http.StatusOK},
+		{name: "allowed domain", authz: restricted, claims: map[string]interface{}{"sub": "u2", "email": "bob@Partner.Example"}, wantStatus: http.StatusOK},
+		{name: "allowed subject", authz: restricted, claims: map[string]interface{}{"sub": "service-account-7"}, wantStatus: http.StatusOK},
+		{name: "disallowed user", authz: restricted, claims: map[string]interface{}{"sub": "u3", "email": "mallory@example.com"}, wantStatus: http.StatusForbidden},
+		{name: "subdomain not allowed", authz: restricted, claims: map[string]interface{}{"sub": "u4", "email": "eve@evil.partner.example"}, wantStatus: http.StatusForbidden},
+		{name: "subject is case-sensitive", authz: restricted, claims: map[string]interface{}{"sub": "Service-Account-7"}, wantStatus: http.StatusForbidden},
+		{name: "no restriction", claims: map[string]interface{}{"sub": "anyone"}, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, Authz: tt.authz})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(tt.claims))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestMultipleAudiences(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	cfg := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, Audiences: []string{"web-app", "mobile-app"}}
+	h := OIDCMiddleware(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		aud        interface{}
+		wantStatus int
+	}{
+		{name: "string first audience", aud: "web-app", wantStatus: http.StatusOK},
+		{name: "string second audience", aud: "mobile-app", wantStatus: http.StatusOK},
+		{name: "array containing one", aud: []string{"other", "mobile-app"}, wantStatus: http.StatusOK},
+		{name: "string not listed", aud: "cli-app", wantStatus: http.StatusUnauthorized},
+		{name: "array with none listed", aud: []string{"cli-app", "other"}, wantStatus: http.StatusUnauthorized},
+		{name: "client id alone is not enough", aud: p.ClientID, wantStatus: http.StatusUnauthorized},
+		{name: "malformed aud", aud: 42, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "alice", "aud": tt.aud}))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestParseAudiences(t *testing.T) {
+	tests := []struct {
+		aud     interface{}
+		want    []string
+		wantErr bool
+	}{
+		{aud: nil},
+		{aud: "a", want: []string{"a"}},
+		{aud: []string{"a", "b"}, want: []string{"a", "b"}},
+		{aud: []interface{}{"a", "b"}, want: []string{"a", "b"}},
+		{aud: []interface{}{}, want: []string{}},
+		{aud: []interface{}{"a", 1}, wantErr: true},
+		{aud: 42.0, wantErr: true},
+		{aud: true, wantErr: true},
+		{aud: map[string]interface{}{"a": "b"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAudiences(map[string]interface{}{"aud": tt.aud})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAudiences(%v) error = %v, wantErr %v", tt.aud, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseAudiences(%v) = %v, want %v", tt.aud, got, tt.want)
+		}
+	}
+}
+
+// TestAudienceEncodings checks aud as IdPs encode it, decoded from a minted
+// token's payload the way the claims map is.
+func TestAudienceEncodings(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	cfg := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, Audiences: []string{"web-app"}}
+	tests := []struct {
+		name    string
+		aud     interface{}
+		wantErr string
+	}{
+		{name: "string", aud: "web-app"},
+		{name: "array", aud: []string{"other", "web-app"}},
+		{name: "string not listed", aud: "other", wantErr: "does not match any expected audience"},
+		{name: "empty array", aud: []string{}, wantErr: "does not match any expected audience"},
+		{name: "number", aud: 42, wantErr: "malformed aud claim: unexpected type float64"},
+		{name: "array with a number", aud: []interface{}{"web-app", 42}, wantErr: "malformed aud claim: element of type float64"},
+		{name: "object", aud: map[string]string{"id": "web-app"}, wantErr: "malformed aud claim: unexpected type map[string]interface {}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := p.SignToken(map[string]interface{}{"sub": "alice", "aud": tt.aud})
+			payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims map[string]interface{}
+			if err := json.Unmarshal(payload, &claims); err != nil {
+				t.Fatal(err)
+			}
+			err = checkAudience(cfg, claims)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkAudience: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkAudience error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRequiredClaims(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	// Values as the YAML decoder produces them: 42 arrives as an int.
+	required := map[string]interface{}{"tenant": "acme", "level": 42, "verified": true}
+	h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, RequiredClaims: required})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		claims     map[string]interface{}
+		wantStatus int
+		wantClaim  string
+	}{
+		{name: "all match", claims: map[string]interface{}{"tenant": "acme", "level": 42, "verified": true}, wantStatus: http.StatusOK},
+		{name: "number as string", claims: map[string]interface{}{"tenant": "acme", "level": "42", "verified": true}, wantStatus: http.StatusOK},
+		{name: "boolean as string", claims: map[string]interface{}{"tenant": "acme", "level": 42, "verified": "true"}, wantStatus: http.StatusOK},
+		{name: "array containing the value", claims: map[string]interface{}{"tenant": []string{"other", "acme"}, "level": 42, "verified": true}, wantStatus: http.StatusOK},
+		{name: "string mismatch", claims: map[string]interface{}{"tenant": "globex", "level": 42, "verified": true}, wantStatus: http.StatusForbidden, wantClaim: "tenant"},
+		{name: "number mismatch", claims: map[string]interface{}{"tenant": "acme", "level": 41, "verified": true}, wantStatus: http.StatusForbidden, wantClaim: "level"},
+		{name: "boolean mismatch", claims: map[string]interface{}{"tenant": "acme", "level": 42, "verified": false}, wantStatus: http.StatusForbidden, wantClaim: "verified"},
+		{name: "missing", claims: map[string]interface{}{"tenant": "acme", "level": 42}, wantStatus: http.StatusForbidden, wantClaim: "verified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["sub"] = "alice"
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(tt.claims))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if want := "Required claim not satisfied: " + tt.wantClaim; tt.wantClaim != "" && !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("body %q does not name claim %s", rec.Body, tt.wantClaim)
+			}
+		})
+	}
+}
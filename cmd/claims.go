@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// tokenClaims returns every claim in the token as a generic map.
+func tokenClaims(idToken *oidc.IDToken) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// lookupClaim returns the claim at path. A claim whose name is path itself
+// wins; otherwise path is split on dots and followed through nested
+// objects, so "realm_access.roles" finds {"realm_access": {"roles": ...}}.
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	if v, ok := claims[path]; ok {
+		return v, true
+	}
+	var v interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// mapClaims returns claims with mappings applied. Sources are always read
+// from the original claims, so the result doesn't depend on map order, and
+// claims itself is left untouched since it may be shared with a cache.
+func mapClaims(claims map[string]interface{}, mappings map[string]string) map[string]interface{} {
+	if len(mappings) == 0 {
+		return claims
+	}
+	mapped := make(map[string]interface{}, len(claims)+len(mappings))
+	for name, v := range claims {
+		mapped[name] = v
+	}
+	for to, from := range mappings {
+		if v, ok := lookupClaim(claims, from); ok {
+			mapped[to] = v
+		}
+	}
+	return mapped
+}
+
+const defaultIdentityClaim = "email"
+
+// identityFromClaims returns the value of claim, falling back to "sub" when
+// the token doesn't carry it.
+func identityFromClaims(claims map[string]interface{}, claim string) string {
+	if claim == "" {
+		claim = defaultIdentityClaim
+	}
+	if id := claimString(claims[claim]); id != "" {
+		return id
+	}
+	return claimString(claims["sub"])
+}
+
+var defaultGreetingClaims = []string{"email", "preferred_username", "sub"}
+
+// firstClaim returns the value of the first of names the token carries, or
+// "" if it carries none of them.
+func firstClaim(claims map[string]interface{}, names []string) string {
+	for _, name := range names {
+		if v := claimString(claims[name]); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// claimString renders a claim value for use in a header: strings as-is,
+// numbers and booleans in their JSON form, arrays joined with commas and
+// objects as JSON.
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			parts[i] = claimString(e)
+		}
+		return strings.Join(parts, ",")
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// claimHeader returns the response header used to forward claim, e.g.
+// "X-Claim-Email" for "email" or "X-Claim-Preferred-Username" for
+// "preferred_username".
+func claimHeader(claim string) string {
+	return http.CanonicalHeaderKey("X-Claim-" + strings.ReplaceAll(claim, "_", "-"))
+}
+
+// forwardClaims copies the named claims into response headers. Claims the
+// token doesn't carry are skipped.
+func forwardClaims(w http.ResponseWriter, claims map[string]interface{}, names []string) {
+	for _, name := range names {
+		value, ok := claims[name]
+		if !ok {
+			continue
+		}
+		w.Header().Set(claimHeader(name), claimString(value))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestForwardClaims(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	h := OIDCMiddleware(OIDC{
+		Issuer:        p.Issuer(),
+		ClientID:      p.ClientID,
+		ForwardClaims: []string{"email", "email_verified", "age", "groups", "preferred_username", "address", "missing"},
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{
+		"sub":                "alice",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"age":                42,
+		"groups":             []string{"admins", "devs"},
+		"preferred_username": "alice",
+		"address":            map[string]string{"country": "NZ"},
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "X-Claim-Email", want: "alice@example.com"},
+		{header: "X-Claim-Email-Verified", want: "true"},
+		{header: "X-Claim-Age", want: "42"},
+		{header: "X-Claim-Groups", want: "admins,devs"},
+		{header: "X-Claim-Preferred-Username", want: "alice"},
+		{header: "X-Claim-Address", want: `{"country":"NZ"}`},
+	}
+	for _, tt := range tests {
+		if got := rec.Header().Get(tt.header); got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+	if _, ok := rec.Header()["X-Claim-Missing"]; ok {
+		t.Error("header set for a claim the token doesn't carry")
+	}
+}
+
+func TestIdentityClaim(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	claims := map[string]interface{}{
+		"sub":                "user-123",
+		"email":              "alice@example.com",
+		"preferred_username": "alice",
+	}
+	tests := []struct {
+		name   string
+		claim  string
+		claims map[string]interface{}
+		want   string
+	}{
+		{name: "default is email", claims: claims, want: "alice@example.com"},
+		{name: "sub", claim: "sub", claims: claims, want: "user-123"},
+		{name: "preferred_username", claim: "preferred_username", claims: claims, want: "alice"},
+		{name: "falls back to sub", claim: "upn", claims: claims, want: "user-123"},
+		{name: "default falls back to sub", claims: map[string]interface{}{"sub": "user-456"}, want: "user-456"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&logs, nil))
+			var fromContext string
+			h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, IdentityClaim: tt.claim})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fromContext = IdentityFromContext(r.Context())
+			}))
+			h = requestInfoMiddleware(nil, loggingMiddleware(logger, h))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(tt.claims))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if fromContext != tt.want {
+				t.Errorf("IdentityFromContext = %q, want %q", fromContext, tt.want)
+			}
+			var line struct {
+				Identity string `json:"identity"`
+			}
+			if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+				t.Fatalf("decoding log line %q: %v", logs.String(), err)
+			}
+			if line.Identity != tt.want {
+				t.Errorf("logged identity = %q, want %q", line.Identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnonymousRequestLogsNoIdentity(t *testing.T) {
+	var logs bytes.Buffer
+	h := loggingMiddleware(slog.New(slog.NewJSONHandler(&logs, nil)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Contains(logs.String(), `"identity"`) {
+		t.Errorf("log line %q has an identity for an unauthenticated request", logs.String())
+	}
+}
+
+func TestClaimMappings(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	token := p.SignToken(map[string]interface{}{
+		"sub":          "u1",
+		"upn":          "alice@corp.example",
+		"realm_access": map[string]interface{}{"roles": []string{"admin", "dev"}},
+		"address":      map[string]interface{}{"locality": "Springfield"},
+	})
+	tests := []struct {
+		name     string
+		mappings map[string]string
+		want     map[string]interface{}
+		absent   []string
+	}{
+		{
+			name:     "rename",
+			mappings: map[string]string{"email": "upn"},
+			want:     map[string]interface{}{"email": "alice@corp.example", "upn": "alice@corp.example"},
+		},
+		{
+			name:     "nested path",
+			mappings: map[string]string{"groups": "realm_access.roles", "city": "address.locality"},
+			want:     map[string]interface{}{"groups": []interface{}{"admin", "dev"}, "city": "Springfield"},
+		},
+		{
+			name:     "missing source is skipped",
+			mappings: map[string]string{"email": "mail", "team": "realm_access.team", "deep": "upn.nope"},
+			absent:   []string{"email", "team", "deep"},
+		},
+		{
+			// Sources come from the token, not from other mappings.
+			name:     "swap",
+			mappings: map[string]string{"sub": "upn", "upn": "sub"},
+			want:     map[string]interface{}{"sub": "alice@corp.example", "upn": "u1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]interface{}
+			h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, ClaimMappings: tt.mappings})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClaimsFromContext(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			for name, want := range tt.want {
+				if !reflect.DeepEqual(got[name], want) {
+					t.Errorf("claim %s = %#v, want %#v", name, got[name], want)
+				}
+			}
+			for _, name := range tt.absent {
+				if v, ok := got[name]; ok {
+					t.Errorf("claim %s = %#v, want it absent", name, v)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is the set of networks whose X-Forwarded-For headers we
+// believe.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of IP addresses and CIDR ranges.
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	var nets trustedProxies
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent r. X-Forwarded-For
+// is only consulted when the direct peer is a trusted proxy, and then the
+// result is the rightmost entry not itself a trusted proxy: entries further
+// left were supplied by the client and can't be believed.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	peer := remoteIP(r)
+	ip := net.ParseIP(peer)
+	if ip == nil || !t.contains(ip) {
+		return peer
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// A malformed entry ends the chain we can vouch for.
+			break
+		}
+		client = hop.String()
+		if !t.contains(hop) {
+			break
+		}
+	}
+	return client
+}
+
+// clientIP returns the client address resolved by requestInfoMiddleware, or
+// the direct peer if the request didn't pass through it.
+func clientIP(r *http.Request) string {
+	if ip := ClientIPFromContext(r.Context()); ip != "" {
+		return ip
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the host part of r.RemoteAddr.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		peer string
+		xff  []string
+		want string
+	}{
+		{name: "no header", peer: "198.51.100.7:5000", want: "198.51.100.7"},
+		{name: "forged header from untrusted peer", peer: "198.51.100.7:5000", xff: []string{"203.0.113.1"}, want: "198.51.100.7"},
+		{name: "legitimate single hop", peer: "10.1.2.3:5000", xff: []string{"203.0.113.1"}, want: "203.0.113.1"},
+		{name: "client-supplied entries ignored", peer: "10.1.2.3:5000", xff: []string{"1.1.1.1, 203.0.113.1"}, want: "203.0.113.1"},
+		{name: "chain of trusted proxies", peer: "10.1.2.3:5000", xff: []string{"203.0.113.1, 192.0.2.10, 10.9.9.9"}, want: "203.0.113.1"},
+		{name: "multiple headers", peer: "192.0.2.10:5000", xff: []string{"1.1.1.1", "203.0.113.1"}, want: "203.0.113.1"},
+		{name: "malformed entry stops the walk", peer: "10.1.2.3:5000", xff: []string{"203.0.113.1, garbage, 10.2.2.2"}, want: "10.2.2.2"},
+		{name: "all hops trusted", peer: "10.1.2.3:5000", xff: []string{"10.4.4.4"}, want: "10.4.4.4"},
+		{name: "trusted peer without header", peer: "10.1.2.3:5000", want: "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := proxies.clientIP(req); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("parseTrustedProxies accepted %q", entry)
+		}
+	}
+}
+
+func TestRateLimitUsesResolvedClientIP(t *testing.T) {
+	proxies, _ := parseTrustedProxies([]string{"10.0.0.1"})
+	l := newRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 1})
+	h := requestInfoMiddleware(proxies, l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	// Every request arrives from the balancer; each distinct client gets
+	// its own bucket, and a forged header from outside gains nothing.
+	tests := []struct {
+		peer, xff  string
+		wantStatus int
+	}{
+		{peer: "10.0.0.1:1", xff: "203.0.113.1", wantStatus: http.StatusOK},
+		{peer: "10.0.0.1:1", xff: "203.0.113.2", wantStatus: http.StatusOK},
+		{peer: "10.0.0.1:1", xff: "203.0.113.1", wantStatus: http.StatusTooManyRequests},
+		{peer: "198.51.100.9:1", xff: "203.0.113.3", wantStatus: http.StatusOK},
+		{peer: "198.51.100.9:1", xff: "203.0.113.4", wantStatus: http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.peer
+		req.Header.Set("X-Forwarded-For", tt.xff)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("request %d (%s via %s): status = %d, want %d", i+1, tt.xff, tt.peer, rec.Code, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressionConfig enables gzip for clients that accept it. Responses
+// smaller than MinSize bytes (default 1024) are sent as they are.
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	MinSize int  `yaml:"min_size" json:"min_size"`
+}
+
+const defaultCompressionMinSize = 1024
+
+// Validate checks the size threshold.
+func (c CompressionConfig) Validate() error {
+	if c.MinSize < 0 {
+		return errors.New("compression.min_size must not be negative")
+	}
+	return nil
+}
+
+func (c CompressionConfig) minSize() int {
+	if c.MinSize > 0 {
+		return c.MinSize
+	}
+	return defaultCompressionMinSize
+}
+
+// compressionMiddleware gzips responses for clients that accept it. Output
+// is buffered until it reaches minSize, so small responses go out
+// uncompressed; responses that already have a Content-Encoding, such as
+// proxied gzip, are never compressed again.
+func compressionMiddleware(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		// Not deferred: if the handler panics, whatever it buffered is
+		// dropped so the recovery middleware can still send its 500.
+		next.ServeHTTP(gw, r)
+		gw.close()
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, field := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(field, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+			q := 1.0
+			if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+				q, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the response until it knows whether to
+// compress it: once minSize bytes have been written, on Flush, or when the
+// handler returns.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 && !w.decided {
+		w.status = status
+		// Informational responses go straight out.
+		if status < 200 {
+			w.ResponseWriter.WriteHeader(status)
+			w.status = 0
+		}
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the headers, compressing if the response is big enough and
+// not already encoded, then writes out the buffered body.
+func (w *gzipResponseWriter) decide(bigEnough bool) error {
+	w.decided = true
+	h := w.Header()
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	compress := bigEnough && h.Get("Content-Encoding") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified
+	if compress {
+		if h.Get("Content-Type") == "" {
+			h.Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush commits to compressing (streamed responses are worth it) and
+// pushes out what has been written so far.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack passes through for protocol upgrades, which bypass compression.
+func (w *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.decided = true
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close sends a response that stayed under the threshold, or finishes the
+// gzip stream.
+func (w *gzipResponseWriter) close() {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			// The handler wrote nothing; let net/http send its default.
+			return
+		}
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header []string
+		want   bool
+	}{
+		{header: nil, want: false},
+		{header: []string{"gzip"}, want: true},
+		{header: []string{"br, GZIP;q=0.5"}, want: true},
+		{header: []string{"deflate", "gzip"}, want: true},
+		{header: []string{"*"}, want: true},
+		{header: []string{"gzip;q=0"}, want: false},
+		{header: []string{"identity, br"}, want: false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, v := range tt.header {
+			req.Header.Add("Accept-Encoding", v)
+		}
+		if got := acceptsGzip(req); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat(`{"item":"value"},`, 200)
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		body           string
+		encoding       string
+		status         int
+		wantGzip       bool
+	}{
+		{name: "accepted", acceptEncoding: "gzip", body: large, wantGzip: true},
+		{name: "not accepted", body: large},
+		{name: "refused", acceptEncoding: "gzip;q=0", body: large},
+		{name: "below threshold", acceptEncoding: "gzip", body: `{"item":"value"}`},
+		{name: "already encoded", acceptEncoding: "gzip", body: large, encoding: "br"},
+		{name: "HEAD", method: http.MethodHead, acceptEncoding: "gzip"},
+		{name: "no content", acceptEncoding: "gzip", status: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := compressionMiddleware(defaultCompressionMinSize, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if tt.encoding != "" {
+					w.Header().Set("Content-Encoding", tt.encoding)
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				// Written in pieces, as handlers stream.
+				for i := 0; i < len(tt.body); i += 100 {
+					io.WriteString(w, tt.body[i:min(i+100, len(tt.body))])
+				}
+			}))
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			body := rec.Body.String()
+			gotEncoding := rec.Header().Get("Content-Encoding")
+			if tt.wantGzip {
+				if gotEncoding != "gzip" {
+					t.Fatalf("Content-Encoding = %q, want gzip", gotEncoding)
+				}
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(b)
+				if rec.Body.Len() >= len(tt.body) {
+					t.Errorf("compressed to %d bytes from %d", rec.Body.Len(), len(tt.body))
+				}
+			} else if gotEncoding != tt.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", gotEncoding, tt.encoding)
+			}
+			if body != tt.body {
+				t.Errorf("body = %.40q..., want %.40q...", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestCompressionThroughServer(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	large := strings.Repeat("compressible ", 200)
+	endpoint := staticEndpoint("/report", large)
+	endpoint.OIDC = OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+	config := Config{
+		Compression: CompressionConfig{Enabled: true, MinSize: 512},
+		Endpoints:   []Endpoint{endpoint},
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.srv.Handler)
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name     string
+		gzip     bool
+		wantGzip bool
+	}{
+		{name: "client accepts gzip", gzip: true, wantGzip: true},
+		{name: "client without gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/report", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "alice"}))
+			if tt.gzip {
+				req.Header.Set("Accept-Encoding", "gzip")
+			} else {
+				req.Header.Set("Accept-Encoding", "identity")
+			}
+			// Setting Accept-Encoding stops the transport decoding the body.
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			var r io.Reader = resp.Body
+			if got := resp.Header.Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("gzipped = %v, want %v", got, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				if r, err = gzip.NewReader(resp.Body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != large {
+				t.Errorf("body = %.40q..., want %.40q...", b, large)
+			}
+		})
+	}
+}
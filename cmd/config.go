@@ -0,0 +1,954 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+)
+
+type Endpoint struct {
+	Path   string `yaml:"path" json:"path"`
+	Method string `yaml:"method" json:"method"`
+	// Methods lists additional methods for the same path; it may be used
+	// instead of, or alongside, Method.
+	Methods []string    `yaml:"methods" json:"methods"`
+	Handler HandlerType `yaml:"handler" json:"handler"`
+	// AnonymousHandler serves requests that carry no valid token, instead
+	// of rejecting them with 401; Handler then only sees authenticated
+	// requests.
+	AnonymousHandler HandlerType `yaml:"anonymous_handler" json:"anonymous_handler"`
+	OIDC             OIDC        `yaml:"oidc" json:"oidc"`
+	// Public opts the endpoint out of require_auth. It can't be combined
+	// with an oidc block of its own, or with handleHello, which needs a
+	// signed-in user.
+	Public bool `yaml:"public" json:"public"`
+	// Timeout bounds how long the handler may run (e.g. "5s"); requests
+	// that exceed it get a 503.
+	Timeout string `yaml:"timeout" json:"timeout"`
+	// Response is the fixed response returned by the static handler.
+	Response StaticResponse `yaml:"response" json:"response"`
+	// Upstream is the URL the proxy handler forwards requests to.
+	Upstream string `yaml:"upstream" json:"upstream"`
+	// ForwardedUserHeader names the header carrying the authenticated
+	// identity to the upstream (default X-Forwarded-User).
+	ForwardedUserHeader string `yaml:"forwarded_user_header" json:"forwarded_user_header"`
+	// RateLimit, when set, limits each client of this endpoint.
+	RateLimit *RateLimitConfig `yaml:"rate_limit" json:"rate_limit"`
+	// GreetingClaims lists the claims handleHello tries in order when
+	// choosing a name to greet (default email, preferred_username, sub).
+	GreetingClaims []string `yaml:"greeting_claims" json:"greeting_claims"`
+	// Login configures the login and callback handlers.
+	Login LoginConfig `yaml:"login" json:"login"`
+	// MaxBodyBytes limits the request body; larger requests get a 413.
+	// Zero uses server.max_body_bytes.
+	MaxBodyBytes int64 `yaml:"max_body_bytes" json:"max_body_bytes"`
+	// ResponseFormat is "text" (the default) or "json" for handleHello.
+	ResponseFormat string `yaml:"response_format" json:"response_format"`
+	// Headers are set on every response from the endpoint, including
+	// authentication failures, e.g. {Cache-Control: no-store}. The handler
+	// may still override them.
+	Headers map[string]string `yaml:"headers" json:"headers"`
+}
+
+// StaticResponse configures the static handler. Status defaults to 200 and
+// ContentType to text/plain.
+type StaticResponse struct {
+	Status      int    `yaml:"status" json:"status"`
+	ContentType string `yaml:"content_type" json:"content_type"`
+	Body        string `yaml:"body" json:"body"`
+}
+
+type OIDC struct {
+	Issuer string `yaml:"issuer" json:"issuer"`
+	// Issuers lists additional accepted issuers; a token is accepted if it
+	// verifies against Issuer or any of these.
+	Issuers      []string `yaml:"issuers" json:"issuers"`
+	ClientID     string   `yaml:"client_id" json:"client_id"`
+	ClientSecret string   `yaml:"client_secret" json:"client_secret"`
+	// ClientSecretFile reads the client secret from a file, such as a
+	// mounted Kubernetes secret, when the config is loaded. It takes
+	// precedence over ClientSecret; trailing newlines are trimmed.
+	ClientSecretFile string `yaml:"client_secret_file" json:"client_secret_file"`
+	// NormalizeIssuer trims a trailing slash from Issuer and Issuers
+	// before they are used, so "https://idp.example.com/" matches tokens
+	// from "https://idp.example.com". Without it issuers are compared
+	// exactly, as go-oidc requires; leave it off for providers whose
+	// issuer really ends in a slash.
+	NormalizeIssuer bool `yaml:"normalize_issuer" json:"normalize_issuer"`
+	// Audience is the expected "aud" claim. When empty the token's audience
+	// must contain ClientID; when set it must contain Audience instead and
+	// ClientID is only used to identify this client to the provider.
+	Audience string `yaml:"audience" json:"audience"`
+	// Audiences, when set, accepts a token whose "aud" claim contains any
+	// of these (or Audience) instead of the single expected audience.
+	Audiences []string `yaml:"audiences" json:"audiences"`
+	// RequiredScopes must all be granted to the token, otherwise the request
+	// is rejected with 403.
+	RequiredScopes []string `yaml:"required_scopes" json:"required_scopes"`
+	// RequiredClaims maps claim names to the value each must have, e.g.
+	// tenant: acme. A mismatch is rejected with 403.
+	RequiredClaims map[string]interface{} `yaml:"required_claims" json:"required_claims"`
+	// Optional lets requests without a valid token through anonymously;
+	// handlers see no claims. Valid tokens are still subject to the scope
+	// and authz checks.
+	Optional bool `yaml:"optional" json:"optional"`
+	// Authz further restricts the endpoint to listed users or domains.
+	Authz AuthzConfig `yaml:"authz" json:"authz"`
+	// VerifyTimeout bounds provider discovery and token verification for a
+	// request (default 5s). Exceeding it returns 504.
+	VerifyTimeout string `yaml:"verify_timeout" json:"verify_timeout"`
+	// ForwardClaims lists claims copied into X-Claim-* response headers
+	// after successful verification.
+	ForwardClaims []string `yaml:"forward_claims" json:"forward_claims"`
+	// IdentityClaim names the claim identifying the caller in logs and the
+	// request context (default "email"). If the token lacks it, "sub" is
+	// used instead.
+	IdentityClaim string `yaml:"identity_claim" json:"identity_claim"`
+	// ClaimMappings copies claims to new names once the token is verified,
+	// keyed by the new name, e.g. {email: upn, groups: realm_access.roles}.
+	// Sources may be dotted paths into nested claims; mappings whose
+	// source is missing are skipped. Later checks and handlers see the
+	// mapped claims.
+	ClaimMappings map[string]string `yaml:"claim_mappings" json:"claim_mappings"`
+	// TokenType is "id" (the default) for OIDC ID tokens or "access" for
+	// JWT access tokens, which are verified against the provider's keys
+	// but only checked against Audience rather than ClientID.
+	TokenType string `yaml:"token_type" json:"token_type"`
+	// Introspection, when its endpoint is set, validates tokens by calling
+	// the provider's introspection endpoint instead of verifying them
+	// locally.
+	Introspection IntrospectionConfig `yaml:"introspection" json:"introspection"`
+	// TokenSource is where the token is read from: "header" (the default,
+	// an Authorization: Bearer header), "cookie:<name>" or "query:<param>".
+	TokenSource string `yaml:"token_source" json:"token_source"`
+	// TokenCacheSize, when positive, caches up to this many verified tokens
+	// until they expire so repeat requests skip signature verification.
+	TokenCacheSize int `yaml:"token_cache_size" json:"token_cache_size"`
+	// DiscoveryAttempts is how many times provider discovery is tried,
+	// with exponential backoff, before the request fails (default 3).
+	DiscoveryAttempts int `yaml:"discovery_attempts" json:"discovery_attempts"`
+	// JWKSFetchAttempts is how many times fetching the provider's signing
+	// keys is tried, with jittered backoff, before the request fails with
+	// 503 (default 3).
+	JWKSFetchAttempts int `yaml:"jwks_fetch_attempts" json:"jwks_fetch_attempts"`
+	// DiscoveryURL fetches the discovery document from this URL instead of
+	// the issuer's /.well-known/openid-configuration. The document must
+	// still name the configured issuer.
+	DiscoveryURL string `yaml:"discovery_url" json:"discovery_url"`
+	// JWKSFile verifies tokens against the keys in a local JWKS file
+	// instead of discovering the provider, for offline use. Tokens must
+	// still carry the configured issuer.
+	JWKSFile string `yaml:"jwks_file" json:"jwks_file"`
+	// Nonce, when set, must equal the token's "nonce" claim. NonceCookie
+	// names a cookie holding the expected nonce for each request instead,
+	// as set by a login flow; it takes precedence over Nonce.
+	Nonce       string `yaml:"nonce" json:"nonce"`
+	NonceCookie string `yaml:"nonce_cookie" json:"nonce_cookie"`
+	// FetchUserInfo merges the claims from the provider's UserInfo
+	// endpoint, called with the presented token, into the verified claims.
+	// Claims in the token win. Responses are cached per subject for
+	// UserInfoCacheTTL (default 1m), and failed calls are tried up to
+	// UserInfoAttempts times (default 2); if they all fail the request is
+	// rejected with 502.
+	FetchUserInfo    bool   `yaml:"fetch_userinfo" json:"fetch_userinfo"`
+	UserInfoCacheTTL string `yaml:"userinfo_cache_ttl" json:"userinfo_cache_ttl"`
+	UserInfoAttempts int    `yaml:"userinfo_attempts" json:"userinfo_attempts"`
+	// InsecureSkipExpiryCheck accepts expired tokens. DANGEROUS: it lets
+	// captured tokens be replayed forever, so it is only honoured when the
+	// ALLOW_INSECURE_OIDC=1 environment variable is also set, and startup
+	// fails otherwise. Never enable it outside local testing.
+	InsecureSkipExpiryCheck bool `yaml:"insecure_skip_expiry_check" json:"insecure_skip_expiry_check"`
+	// ClockSkew is the tolerance allowed when checking the token's exp,
+	// nbf and iat claims against the local clock (default 60s).
+	ClockSkew string `yaml:"clock_skew" json:"clock_skew"`
+	// SupportedSigningAlgs pins the JWT signing algorithms accepted, e.g.
+	// [RS256, ES256]. By default the provider's advertised algorithms are
+	// accepted, or RS256 if it advertises none.
+	SupportedSigningAlgs []string `yaml:"supported_signing_algs" json:"supported_signing_algs"`
+	// TLSCAFile is a PEM bundle of CAs trusted for discovery, JWKS and
+	// introspection requests, for providers behind a private CA.
+	TLSCAFile string `yaml:"tls_ca_file" json:"tls_ca_file"`
+	// InsecureSkipVerify disables certificate checks on calls to the
+	// provider. Like InsecureSkipExpiryCheck it requires
+	// ALLOW_INSECURE_OIDC=1.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+// TLSConfig enables HTTPS when both CertFile and KeyFile are set.
+type TLSConfig struct {
+	CertFile   string `yaml:"cert_file" json:"cert_file"`
+	KeyFile    string `yaml:"key_file" json:"key_file"`
+	MinVersion string `yaml:"min_version" json:"min_version"`
+	// CipherSuites restricts TLS 1.0-1.2 connections to these suites, named
+	// as in crypto/tls (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). TLS
+	// 1.3 suites are not configurable.
+	CipherSuites []string `yaml:"cipher_suites" json:"cipher_suites"`
+	// CurvePreferences lists the key exchange curves in preference order:
+	// X25519, P256, P384 or P521.
+	CurvePreferences []string `yaml:"curve_preferences" json:"curve_preferences"`
+}
+
+// LoggingConfig controls logging. Format is "text" (the default) or "json";
+// Level is "debug", "info" (the default), "warn" or "error". At debug,
+// request details and token verification steps are logged too.
+type LoggingConfig struct {
+	Format string `yaml:"format" json:"format"`
+	Level  string `yaml:"level" json:"level"`
+}
+
+var logLevels = map[string]slog.Level{
+	"":      slog.LevelInfo,
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// SecurityHeadersConfig adds common hardening headers to every response
+// when enabled. Each field overrides the default value of its header;
+// StrictTransportSecurity is only sent when TLS is enabled.
+type SecurityHeadersConfig struct {
+	Enabled                 bool   `yaml:"enabled" json:"enabled"`
+	ContentTypeOptions      string `yaml:"content_type_options" json:"content_type_options"`
+	FrameOptions            string `yaml:"frame_options" json:"frame_options"`
+	ReferrerPolicy          string `yaml:"referrer_policy" json:"referrer_policy"`
+	StrictTransportSecurity string `yaml:"strict_transport_security" json:"strict_transport_security"`
+}
+
+// securityHeadersKeys are the keys a security_headers block may set.
+var securityHeadersKeys = func() map[string]bool {
+	t := reflect.TypeOf(SecurityHeadersConfig{})
+	keys := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys[yamlFieldName(t.Field(i))] = true
+	}
+	return keys
+}()
+
+// UnmarshalYAML accepts "security_headers: true" as shorthand for the
+// defaults, as well as the full block. The block's keys are checked here
+// because the decoder's unknown-field check doesn't reach inside a custom
+// unmarshaler.
+func (c *SecurityHeadersConfig) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		var enabled bool
+		if err := value.Decode(&enabled); err != nil {
+			return fmt.Errorf("line %d: security_headers must be a boolean or a mapping", value.Line)
+		}
+		*c = SecurityHeadersConfig{Enabled: enabled}
+		return nil
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			key := value.Content[i]
+			if key.Value != "<<" && !securityHeadersKeys[key.Value] {
+				return fmt.Errorf("line %d: field %s not found in type main.SecurityHeadersConfig", key.Line, key.Value)
+			}
+		}
+	}
+	type plain SecurityHeadersConfig
+	return value.Decode((*plain)(c))
+}
+
+// UnmarshalJSON accepts true or false as well as the object. The object's
+// unknown keys are rejected here, since json.Decoder.DisallowUnknownFields
+// doesn't carry into a custom unmarshaler.
+func (c *SecurityHeadersConfig) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		type plain SecurityHeadersConfig
+		dec := json.NewDecoder(bytes.NewReader(trimmed))
+		dec.DisallowUnknownFields()
+		return dec.Decode((*plain)(c))
+	}
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err != nil {
+		return errors.New("security_headers must be a boolean or an object")
+	}
+	*c = SecurityHeadersConfig{Enabled: enabled}
+	return nil
+}
+
+// headers returns the headers to set, with defaults filled in.
+func (c SecurityHeadersConfig) headers(tls bool) map[string]string {
+	or := func(v, def string) string {
+		if v != "" {
+			return v
+		}
+		return def
+	}
+	headers := map[string]string{
+		"X-Content-Type-Options": or(c.ContentTypeOptions, "nosniff"),
+		"X-Frame-Options":        or(c.FrameOptions, "DENY"),
+		"Referrer-Policy":        or(c.ReferrerPolicy, "no-referrer"),
+	}
+	if tls {
+		headers["Strict-Transport-Security"] = or(c.StrictTransportSecurity, "max-age=63072000; includeSubDomains")
+	}
+	return headers
+}
+
+// MiddlewareConfig turns off server-wide middleware by name; see
+// middlewareNames.
+type MiddlewareConfig struct {
+	Disabled []string `yaml:"disabled" json:"disabled"`
+}
+
+func (c MiddlewareConfig) disabled(name string) bool {
+	for _, d := range c.Disabled {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate rejects unknown middleware names.
+func (c MiddlewareConfig) Validate() error {
+	var errs []error
+	for _, name := range c.Disabled {
+		known := false
+		for _, n := range middlewareNames {
+			known = known || n == name
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("middleware.disabled: unknown middleware %q (expected one of %s)", name, strings.Join(middlewareNames, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ServerConfig holds settings for the underlying *http.Server. Durations use
+// time.ParseDuration syntax.
+type ServerConfig struct {
+	ReadTimeout       string `yaml:"read_timeout" json:"read_timeout"`
+	ReadHeaderTimeout string `yaml:"read_header_timeout" json:"read_header_timeout"`
+	WriteTimeout      string `yaml:"write_timeout" json:"write_timeout"`
+	IdleTimeout       string `yaml:"idle_timeout" json:"idle_timeout"`
+	// ShutdownTimeout is the grace period for in-flight requests on
+	// shutdown (default 15s). The -shutdown-timeout flag overrides it.
+	ShutdownTimeout string `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	// MaxHeaderBytes caps the size of request headers (default 1 MiB).
+	MaxHeaderBytes int `yaml:"max_header_bytes" json:"max_header_bytes"`
+	// MaxBodyBytes is the default request body limit for endpoints that
+	// don't set their own. Zero means no limit.
+	MaxBodyBytes int64 `yaml:"max_body_bytes" json:"max_body_bytes"`
+	// HTTP2 serves HTTP/2 alongside HTTP/1.1: over TLS via ALPN, and over
+	// plain HTTP as h2c (HTTP/2 with prior knowledge or Upgrade).
+	HTTP2 bool `yaml:"http2" json:"http2"`
+	// MaxConcurrent caps the number of requests handled at once; requests
+	// over the limit get a 503. Zero means no limit.
+	MaxConcurrent int `yaml:"max_concurrent" json:"max_concurrent"`
+	// WarmupTimeout bounds provider discovery for every configured issuer
+	// at startup (default 30s). Readiness fails until it has succeeded for
+	// all of them.
+	WarmupTimeout string `yaml:"warmup_timeout" json:"warmup_timeout"`
+}
+
+const (
+	defaultReadTimeout       = 30 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultWriteTimeout      = 30 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+	defaultShutdownTimeout   = 15 * time.Second
+	defaultWarmupTimeout     = 30 * time.Second
+	defaultMaxHeaderBytes    = 1 << 20
+)
+
+func (c ServerConfig) maxHeaderBytes() int {
+	if c.MaxHeaderBytes > 0 {
+		return c.MaxHeaderBytes
+	}
+	return defaultMaxHeaderBytes
+}
+
+// MetricsConfig enables the Prometheus endpoint, served without
+// authentication at Path (default /metrics).
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Path    string `yaml:"path" json:"path"`
+}
+
+// RouterConfig controls how request paths are matched to endpoints.
+type RouterConfig struct {
+	// StrictSlash redirects a path that differs from an endpoint's only by
+	// a trailing slash to the endpoint's own path with a 301, e.g. /foo/ to
+	// /foo for a /foo endpoint and vice versa. By default such paths are
+	// not normalized and get 404. Clients follow the redirect with GET, so
+	// other methods should use the exact path.
+	StrictSlash bool `yaml:"strict_slash" json:"strict_slash"`
+}
+
+type Config struct {
+	// Version is the config schema version (default 1).
+	Version int `yaml:"version" json:"version"`
+	// Listen is a TCP address such as ":8080" or a Unix socket such as
+	// "unix:/var/run/app.sock".
+	Listen string `yaml:"listen" json:"listen"`
+	// SocketMode sets the permissions of a Unix socket, in octal (e.g.
+	// "0660").
+	SocketMode string `yaml:"socket_mode" json:"socket_mode"`
+	// BasePath prefixes every endpoint path, e.g. "/api/v1". Health,
+	// metrics and admin routes stay at the root unless PrefixBuiltinRoutes
+	// is set.
+	BasePath            string `yaml:"base_path" json:"base_path"`
+	PrefixBuiltinRoutes bool   `yaml:"prefix_builtin_routes" json:"prefix_builtin_routes"`
+	// TrustedProxies lists the IPs and CIDR ranges of load balancers whose
+	// X-Forwarded-For header identifies the real client.
+	TrustedProxies  []string              `yaml:"trusted_proxies" json:"trusted_proxies"`
+	TLS             *TLSConfig            `yaml:"tls" json:"tls"`
+	Server          ServerConfig          `yaml:"server" json:"server"`
+	Middleware      MiddlewareConfig      `yaml:"middleware" json:"middleware"`
+	Router          RouterConfig          `yaml:"router" json:"router"`
+	Logging         LoggingConfig         `yaml:"logging" json:"logging"`
+	Metrics         MetricsConfig         `yaml:"metrics" json:"metrics"`
+	CORS            CORSConfig            `yaml:"cors" json:"cors"`
+	Compression     CompressionConfig     `yaml:"compression" json:"compression"`
+	SecurityHeaders SecurityHeadersConfig `yaml:"security_headers" json:"security_headers"`
+	Admin           AdminConfig           `yaml:"admin" json:"admin"`
+	Session         SessionConfig         `yaml:"session" json:"session"`
+	Audit           AuditConfig           `yaml:"audit" json:"audit"`
+	Index           IndexConfig           `yaml:"index" json:"index"`
+	Debug           DebugConfig           `yaml:"debug" json:"debug"`
+	// ErrorFormat is "text" (the default) or "json".
+	ErrorFormat string `yaml:"error_format" json:"error_format"`
+	// RequireAuth protects every endpoint with the top-level OIDC block,
+	// except those marked public and those with an oidc block of their
+	// own, which is used instead. Without it only endpoints that configure
+	// oidc are protected.
+	RequireAuth bool `yaml:"require_auth" json:"require_auth"`
+	OIDC        OIDC `yaml:"oidc" json:"oidc"`
+	// Defaults supplies the settings of any endpoint that doesn't set its
+	// own; see applyDefaults.
+	Defaults Endpoint `yaml:"defaults" json:"defaults"`
+	// Endpoints can share an oidc (or any other) block through YAML
+	// anchors and aliases, e.g. "oidc: &main {...}" on one endpoint and
+	// "oidc: *main" on the next; "<<: *main" merges it and overrides keys.
+	// Anchors can't live under a key of their own unless -lax allows
+	// unknown keys.
+	Endpoints []Endpoint `yaml:"endpoints" json:"endpoints"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// tlsCipherSuite looks up a cipher suite by name. Only the suites crypto/tls
+// considers secure are accepted.
+func tlsCipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+func tlsCipherSuiteNames() []string {
+	var names []string
+	for _, suite := range tls.CipherSuites() {
+		names = append(names, suite.Name)
+	}
+	return names
+}
+
+// Enabled reports whether the TLS block is present and configured.
+func (t *TLSConfig) Enabled() bool {
+	return t != nil && (t.CertFile != "" || t.KeyFile != "")
+}
+
+// Validate checks that the certificate and key are set together and that the
+// minimum version is one we know about.
+func (t *TLSConfig) Validate() error {
+	if t == nil {
+		return nil
+	}
+	if t.CertFile == "" && t.KeyFile != "" {
+		return fmt.Errorf("tls: key_file is set but cert_file is missing")
+	}
+	if t.CertFile != "" && t.KeyFile == "" {
+		return fmt.Errorf("tls: cert_file is set but key_file is missing")
+	}
+	if t.MinVersion != "" {
+		if _, ok := tlsVersions[t.MinVersion]; !ok {
+			return fmt.Errorf("tls: unsupported min_version %q (expected 1.0, 1.1, 1.2 or 1.3)", t.MinVersion)
+		}
+	}
+	for _, name := range t.CipherSuites {
+		if _, ok := tlsCipherSuite(name); !ok {
+			return fmt.Errorf("tls: unsupported cipher suite %q (expected one of %s)", name, strings.Join(tlsCipherSuiteNames(), ", "))
+		}
+	}
+	for _, name := range t.CurvePreferences {
+		if _, ok := tlsCurves[name]; !ok {
+			return fmt.Errorf("tls: unsupported curve %q (expected X25519, P256, P384 or P521)", name)
+		}
+	}
+	return nil
+}
+
+// Build returns the *tls.Config used by the HTTP server.
+func (t *TLSConfig) Build() (*tls.Config, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if t.MinVersion != "" {
+		cfg.MinVersion = tlsVersions[t.MinVersion]
+	}
+	for _, name := range t.CipherSuites {
+		id, _ := tlsCipherSuite(name)
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	for _, name := range t.CurvePreferences {
+		cfg.CurvePreferences = append(cfg.CurvePreferences, tlsCurves[name])
+	}
+	return cfg, nil
+}
+
+var validMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// Validate checks the whole configuration and reports every problem it
+// finds, one per line, rather than stopping at the first.
+func (c Config) Validate() error {
+	var errs []error
+	if err := c.TLS.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.CORS.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Debug.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Session.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Middleware.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Compression.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Audit.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.RequireAuth {
+		for _, err := range c.OIDC.validate() {
+			errs = append(errs, fmt.Errorf("oidc.%w", err))
+		}
+		if len(c.OIDC.issuerList()) == 0 && c.OIDC.Introspection.Endpoint == "" {
+			errs = append(errs, errors.New("require_auth needs oidc.issuer"))
+		}
+		if c.OIDC.ClientID == "" {
+			errs = append(errs, errors.New("require_auth needs oidc.client_id"))
+		}
+	} else if c.OIDC.configured() {
+		errs = append(errs, errors.New("oidc is only used with require_auth: true; set it or move the block into the endpoints"))
+	}
+	if err := c.Admin.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseSocketMode(c.SocketMode); err != nil {
+		errs = append(errs, fmt.Errorf("socket_mode: %w", err))
+	}
+	switch c.Logging.Format {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("logging.format: unsupported format %q (expected text or json)", c.Logging.Format))
+	}
+	if _, ok := logLevels[c.Logging.Level]; !ok {
+		errs = append(errs, fmt.Errorf("logging.level: unsupported level %q (expected debug, info, warn or error)", c.Logging.Level))
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	if _, err := parseDuration(c.Server.ReadTimeout, defaultReadTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("server.read_timeout: %w", err))
+	}
+	if _, err := parseDuration(c.Server.ReadHeaderTimeout, defaultReadHeaderTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("server.read_header_timeout: %w", err))
+	}
+	if _, err := parseDuration(c.Server.WriteTimeout, defaultWriteTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("server.write_timeout: %w", err))
+	}
+	if _, err := parseDuration(c.Server.IdleTimeout, defaultIdleTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("server.idle_timeout: %w", err))
+	}
+	if _, err := parseDuration(c.Server.ShutdownTimeout, defaultShutdownTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("server.shutdown_timeout: %w", err))
+	}
+	if _, err := parseDuration(c.Server.WarmupTimeout, defaultWarmupTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("server.warmup_timeout: %w", err))
+	}
+	if c.Server.MaxHeaderBytes < 0 {
+		errs = append(errs, errors.New("server.max_header_bytes must not be negative"))
+	}
+	if c.Server.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New("server.max_body_bytes must not be negative"))
+	}
+	if c.Server.MaxConcurrent < 0 {
+		errs = append(errs, errors.New("server.max_concurrent must not be negative"))
+	}
+	switch c.ErrorFormat {
+	case "", "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("error_format: unsupported format %q (expected text or json)", c.ErrorFormat))
+	}
+
+	for i, endpoint := range c.Endpoints {
+		prefix := fmt.Sprintf("endpoints[%d]", i)
+		if endpoint.Path != "" {
+			prefix = fmt.Sprintf("endpoints[%d] (%s)", i, endpoint.Path)
+		}
+		for _, err := range endpoint.validate() {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+	}
+	errs = append(errs, duplicateEndpoints(c.Endpoints)...)
+	errs = append(errs, slashMismatchedIssuers(c)...)
+	if c.Index.Enabled {
+		for i, e := range c.Endpoints {
+			if e.Path == indexPath {
+				errs = append(errs, fmt.Errorf("endpoints[%d] (%s): conflicts with index.enabled, which serves /", i, e.Path))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// duplicateEndpoints reports endpoints that repeat an earlier endpoint's
+// path and method; mux would silently route them all to the first. The same
+// path with different methods is fine.
+func duplicateEndpoints(endpoints []Endpoint) []error {
+	type route struct{ path, method string }
+	first := make(map[route]int)
+	var errs []error
+	for i, endpoint := range endpoints {
+		for _, method := range endpoint.methodList() {
+			key := route{endpoint.Path, strings.ToUpper(method)}
+			if j, ok := first[key]; ok {
+				errs = append(errs, fmt.Errorf("endpoints[%d] (%s): %s is already handled by endpoints[%d] (handler %s)", i, endpoint.Path, key.method, j, endpoints[j].Handler))
+				continue
+			}
+			first[key] = i
+		}
+	}
+	return errs
+}
+
+// slashMismatchedIssuers reports issuers, in any of the oidc blocks the
+// server uses, that differ from an earlier one only by a trailing slash. A
+// provider has one issuer, so one of them will reject every token.
+func slashMismatchedIssuers(c Config) []error {
+	// Each block is named as its errors are prefixed, and as other
+	// blocks' errors refer to it.
+	type block struct {
+		prefix, name string
+		oidc         OIDC
+	}
+	blocks := []block{{"oidc", "oidc", c.OIDC}}
+	for i, endpoint := range c.Endpoints {
+		name := fmt.Sprintf("endpoints[%d]", i)
+		blocks = append(blocks, block{fmt.Sprintf("%s (%s): oidc", name, endpoint.Path), name, endpoint.OIDC})
+	}
+	blocks = append(blocks, block{"admin.oidc", "admin.oidc", c.Admin.OIDC}, block{"debug.oidc", "debug.oidc", c.Debug.OIDC})
+
+	type seen struct {
+		issuer string
+		name   string
+	}
+	first := make(map[string]seen)
+	var errs []error
+	for _, b := range blocks {
+		for _, issuer := range b.oidc.issuerList() {
+			trimmed := strings.TrimSuffix(issuer, "/")
+			prev, ok := first[trimmed]
+			if !ok {
+				first[trimmed] = seen{issuer, b.name}
+				continue
+			}
+			if prev.issuer != issuer {
+				errs = append(errs, fmt.Errorf("%s.issuer %q differs from %q in %s only by a trailing slash; use the provider's exact issuer for both, or set normalize_issuer", b.prefix, issuer, prev.issuer, prev.name))
+			}
+		}
+	}
+	return errs
+}
+
+// validate returns every problem with the endpoint's own settings.
+func (e Endpoint) validate() []error {
+	var errs []error
+	if e.Path == "" {
+		errs = append(errs, errors.New("path is required"))
+	}
+	methods := e.methodList()
+	if len(methods) == 0 {
+		errs = append(errs, errors.New("method is required"))
+	}
+	if e.Public && e.OIDC.configured() {
+		errs = append(errs, errors.New("public endpoints cannot have an oidc block"))
+	} else if e.Public && e.Handler == HandlerHello {
+		errs = append(errs, errors.New("public endpoints cannot use handleHello, which greets the signed-in user"))
+	}
+	for _, method := range methods {
+		if !validMethods[method] {
+			errs = append(errs, fmt.Errorf("invalid HTTP method %q for path %s", method, e.Path))
+		}
+	}
+	if _, err := getHandlerFunc(e); err != nil {
+		errs = append(errs, err)
+	}
+	if e.AnonymousHandler != "" {
+		if !e.requiresOIDC() {
+			errs = append(errs, errors.New("anonymous_handler requires oidc settings"))
+		} else if _, err := getHandlerFunc(e.anonymousEndpoint()); err != nil {
+			errs = append(errs, fmt.Errorf("anonymous_handler: %w", err))
+		}
+	}
+	if status := e.Response.Status; status != 0 && (status < 100 || status > 599) {
+		errs = append(errs, fmt.Errorf("response.status: invalid HTTP status %d", status))
+	}
+	if rl := e.RateLimit; rl != nil {
+		if rl.RequestsPerSecond <= 0 {
+			errs = append(errs, errors.New("rate_limit.requests_per_second must be positive"))
+		}
+		if rl.Burst < 0 {
+			errs = append(errs, errors.New("rate_limit.burst must not be negative"))
+		}
+	}
+	if _, err := parseDuration(e.Timeout, 0); err != nil {
+		errs = append(errs, fmt.Errorf("timeout: %w", err))
+	}
+	if e.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New("max_body_bytes must not be negative"))
+	}
+	for name, value := range e.Headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs = append(errs, fmt.Errorf("headers: invalid header name %q", name))
+		} else if !httpguts.ValidHeaderFieldValue(value) {
+			errs = append(errs, fmt.Errorf("headers: invalid value for %s", name))
+		}
+	}
+
+	for _, err := range e.OIDC.validate() {
+		errs = append(errs, fmt.Errorf("oidc.%w", err))
+	}
+	// A public handleHello is reported above instead.
+	if e.requiresOIDC() && !e.Public {
+		if len(e.OIDC.issuerList()) == 0 && e.OIDC.Introspection.Endpoint == "" {
+			errs = append(errs, errors.New("oidc.issuer is required"))
+		}
+		if e.OIDC.ClientID == "" {
+			errs = append(errs, errors.New("oidc.client_id is required"))
+		}
+	}
+	return errs
+}
+
+// validate checks the individual OIDC settings. Errors are reported
+// relative to the oidc block, e.g. "verify_timeout: ...".
+func (o OIDC) validate() []error {
+	var errs []error
+	for _, issuer := range o.issuerList() {
+		if err := validateURL(issuer); err != nil {
+			errs = append(errs, fmt.Errorf("issuer: %w", err))
+		}
+	}
+	if o.DiscoveryURL != "" {
+		if err := validateURL(o.DiscoveryURL); err != nil {
+			errs = append(errs, fmt.Errorf("discovery_url: %w", err))
+		}
+		if len(o.issuerList()) > 1 {
+			errs = append(errs, errors.New("discovery_url cannot be used with multiple issuers"))
+		}
+	}
+	if o.JWKSFile != "" {
+		if o.DiscoveryURL != "" {
+			errs = append(errs, errors.New("jwks_file cannot be used with discovery_url"))
+		}
+		if _, err := loadJWKSFile(o.JWKSFile); err != nil {
+			errs = append(errs, fmt.Errorf("jwks_file: %w", err))
+		}
+	}
+	if o.FetchUserInfo && o.JWKSFile != "" {
+		errs = append(errs, errors.New("fetch_userinfo needs a discoverable provider and cannot use jwks_file"))
+	}
+	if _, err := parseDuration(o.UserInfoCacheTTL, defaultUserInfoCacheTTL); err != nil {
+		errs = append(errs, fmt.Errorf("userinfo_cache_ttl: %w", err))
+	}
+	if o.UserInfoAttempts < 0 {
+		errs = append(errs, errors.New("userinfo_attempts must not be negative"))
+	}
+	if o.Introspection.Endpoint != "" {
+		if err := validateURL(o.Introspection.Endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("introspection.endpoint: %w", err))
+		}
+	}
+	if _, err := parseDuration(o.VerifyTimeout, defaultVerifyTimeout); err != nil {
+		errs = append(errs, fmt.Errorf("verify_timeout: %w", err))
+	}
+	if _, err := parseDuration(o.ClockSkew, defaultClockSkew); err != nil {
+		errs = append(errs, fmt.Errorf("clock_skew: %w", err))
+	}
+	switch o.TokenType {
+	case "", tokenTypeID, tokenTypeAccess:
+	default:
+		errs = append(errs, fmt.Errorf("token_type: unsupported type %q (expected id or access)", o.TokenType))
+	}
+	if _, err := parseDuration(o.Introspection.CacheTTL, defaultIntrospectionCacheTTL); err != nil {
+		errs = append(errs, fmt.Errorf("introspection.cache_ttl: %w", err))
+	}
+	if _, _, err := parseTokenSource(o.TokenSource); err != nil {
+		errs = append(errs, fmt.Errorf("token_source: %w", err))
+	}
+	for to, from := range o.ClaimMappings {
+		if to == "" || from == "" {
+			errs = append(errs, errors.New("claim_mappings: claim names must not be empty"))
+			break
+		}
+	}
+	if o.TokenCacheSize < 0 {
+		errs = append(errs, errors.New("token_cache_size must not be negative"))
+	}
+	if o.DiscoveryAttempts < 0 {
+		errs = append(errs, errors.New("discovery_attempts must not be negative"))
+	}
+	if o.JWKSFetchAttempts < 0 {
+		errs = append(errs, errors.New("jwks_fetch_attempts must not be negative"))
+	}
+	if o.InsecureSkipExpiryCheck && !insecureOIDCAllowed() {
+		errs = append(errs, errors.New("insecure_skip_expiry_check is set but ALLOW_INSECURE_OIDC=1 is not; refusing to disable token expiry checks"))
+	}
+	for _, alg := range o.SupportedSigningAlgs {
+		if !signingAlgorithms[alg] {
+			errs = append(errs, fmt.Errorf("supported_signing_algs: unsupported algorithm %q", alg))
+		}
+	}
+	if o.InsecureSkipVerify && !insecureOIDCAllowed() {
+		errs = append(errs, errors.New("insecure_skip_verify is set but ALLOW_INSECURE_OIDC=1 is not; refusing to disable certificate verification"))
+	} else if _, err := o.clientKey().client(); err != nil {
+		errs = append(errs, fmt.Errorf("tls_ca_file: %w", err))
+	}
+	return errs
+}
+
+// anonymousEndpoint is the endpoint as seen by its anonymous handler, which
+// by definition serves requests without a token.
+func (e Endpoint) anonymousEndpoint() Endpoint {
+	e.Handler = e.AnonymousHandler
+	e.OIDC.Optional = true
+	return e
+}
+
+// methodList returns the endpoint's methods from either the scalar method
+// field or the methods list.
+func (e Endpoint) methodList() []string {
+	var methods []string
+	if e.Method != "" {
+		methods = append(methods, e.Method)
+	}
+	return append(methods, e.Methods...)
+}
+
+// bodyLimit returns the endpoint's request body limit, falling back to the
+// server-wide default.
+func (e Endpoint) bodyLimit(def int64) int64 {
+	if e.MaxBodyBytes > 0 {
+		return e.MaxBodyBytes
+	}
+	return def
+}
+
+// requiresOIDC reports whether requests to the endpoint must be authenticated,
+// either because an oidc block is configured or because the handler reads
+// the verified token. The login handlers use their oidc block to sign users
+// in instead.
+func (e Endpoint) requiresOIDC() bool {
+	if loginHandlers[e.Handler] {
+		return false
+	}
+	return e.OIDC.configured() || e.Handler == HandlerHello
+}
+
+// parseDuration parses value with time.ParseDuration, returning def when
+// value is empty. Negative durations are rejected.
+func parseDuration(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration %q must not be negative", value)
+	}
+	return d, nil
+}
+
+// validateURL checks that value is an absolute http or https URL.
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q must be an absolute http or https URL", value)
+	}
+	return nil
+}
+
+// insecureOIDCAllowed reports whether the environment explicitly permits
+// the insecure_* OIDC options. Config.Validate rejects them without it, but
+// an OIDC value can reach the verifier without passing through Validate, so
+// the code that applies each option checks this again at the point of use.
+func insecureOIDCAllowed() bool {
+	return os.Getenv("ALLOW_INSECURE_OIDC") == "1"
+}
+
+// parseSocketMode parses an octal permission string such as "0660". An
+// empty string means the umask default.
+func parseSocketMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid permissions %q (expected octal such as 0660)", value)
+	}
+	return os.FileMode(mode), nil
+}
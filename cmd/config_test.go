@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// loadYAML loads config text the way -config would.
+func loadYAML(t *testing.T, text string) Config {
+	t.Helper()
+	config, err := loadConfig(writeFile(t, t.TempDir(), "config.yaml", text), true)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+	return config
+}
+
+func TestEndpointMethods(t *testing.T) {
+	tests := []struct {
+		name        string
+		yaml        string
+		wantMethods []string
+		wantErr     string
+	}{
+		{
+			name:        "scalar",
+			yaml:        "method: GET",
+			wantMethods: []string{"GET"},
+		},
+		{
+			name:        "list",
+			yaml:        "methods: [GET, POST]",
+			wantMethods: []string{"GET", "POST"},
+		},
+		{
+			name:    "invalid verb",
+			yaml:    "method: GETT",
+			wantErr: `endpoints[0] (/things): invalid HTTP method "GETT" for path /things`,
+		},
+		{
+			name:    "invalid verb in list",
+			yaml:    "methods: [GET, FETCH]",
+			wantErr: `invalid HTTP method "FETCH" for path /things`,
+		},
+		{
+			name:    "none",
+			yaml:    "response: {body: x}",
+			wantErr: "method is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadYAML(t, "endpoints:\n  - path: /things\n    handler: static\n    "+tt.yaml+"\n")
+			err := config.Validate()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Validate() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.Endpoints[0].methodList(); !slices.Equal(got, tt.wantMethods) {
+				t.Errorf("methods = %v, want %v", got, tt.wantMethods)
+			}
+
+			// Every listed method routes to the handler; others don't.
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			for _, method := range []string{"GET", "POST", "PUT"} {
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, httptest.NewRequest(method, "/things", nil))
+				want := http.StatusMethodNotAllowed
+				if slices.Contains(tt.wantMethods, method) {
+					want = http.StatusOK
+				}
+				if rec.Code != want {
+					t.Errorf("%s /things = %d, want %d", method, rec.Code, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicateEndpoints(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	t.Setenv("ISSUER", p.Issuer())
+	t.Setenv("CLIENT_ID", p.ClientID)
+	tests := []struct {
+		name      string
+		endpoints string
+		wantErrs  []string
+	}{
+		{
+			name:      "exact duplicate",
+			endpoints: "- {path: /things, method: GET, handler: static}\n- {path: /things, method: GET, handler: handleHello, oidc: {issuer: $ISSUER, client_id: $CLIENT_ID}}",
+			wantErrs:  []string{"endpoints[1] (/things): GET is already handled by endpoints[0] (handler static)"},
+		},
+		{
+			name:      "overlapping method lists",
+			endpoints: "- {path: /things, methods: [GET, POST], handler: static}\n- {path: /things, methods: [PUT, POST], handler: static}",
+			wantErrs:  []string{"endpoints[1] (/things): POST is already handled by endpoints[0]"},
+		},
+		{
+			name:      "each repeat reported",
+			endpoints: "- {path: /things, method: GET, handler: static}\n- {path: /things, method: GET, handler: static}\n- {path: /things, method: GET, handler: static}",
+			wantErrs:  []string{"endpoints[1] (/things): GET is already handled by endpoints[0]", "endpoints[2] (/things): GET is already handled by endpoints[0]"},
+		},
+		{
+			name:      "same path, different methods",
+			endpoints: "- {path: /things, method: GET, handler: static, response: {body: listed}}\n- {path: /things, method: POST, handler: handleHello, oidc: {issuer: $ISSUER, client_id: $CLIENT_ID}}",
+		},
+		{
+			name:      "same method, different paths",
+			endpoints: "- {path: /things, method: GET, handler: static}\n- {path: /things/, method: GET, handler: static}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, t.TempDir(), "config.yaml", "endpoints:\n  "+strings.ReplaceAll(tt.endpoints, "\n", "\n  ")+"\n")
+			config, err := loadConfig(path, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = config.Validate()
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate() accepted duplicate endpoints")
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, want %q", err, want)
+				}
+			}
+			if got, want := strings.Count(err.Error(), "is already handled by"), len(tt.wantErrs); got != want {
+				t.Errorf("%d duplicates reported, want %d", got, want)
+			}
+		})
+	}
+
+	// Both methods of a shared path route to their own handler.
+	config := loadYAML(t, "endpoints:\n  - {path: /things, method: GET, handler: static, response: {body: listed}}\n  - {path: /things, method: POST, handler: handleHello, oidc: {issuer: $ISSUER, client_id: $CLIENT_ID}}\n")
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(s, "/things"); rec.Code != http.StatusOK || rec.Body.String() != "listed" {
+		t.Errorf("GET /things = %d %q, want the static body", rec.Code, rec.Body)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/things", nil)
+	req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "u1", "email": "alice@example.com"}))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "Hello, alice@example.com!" {
+		t.Errorf("POST /things = %d %q, want the greeting", rec.Code, rec.Body)
+	}
+}
+
+func TestTLSBuild(t *testing.T) {
+	tests := []struct {
+		name       string
+		tls        TLSConfig
+		wantSuites []uint16
+		wantCurves []tls.CurveID
+		wantErr    string
+	}{
+		{name: "defaults"},
+		{
+			name: "cipher suites",
+			tls:  TLSConfig{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}},
+			wantSuites: []uint16{
+				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			},
+		},
+		{
+			name:       "curve preferences keep their order",
+			tls:        TLSConfig{CurvePreferences: []string{"P384", "X25519"}},
+			wantCurves: []tls.CurveID{tls.CurveP384, tls.X25519},
+		},
+		{
+			name:    "unknown cipher suite",
+			tls:     TLSConfig{CipherSuites: []string{"TLS_RSA_WITH_NOPE"}},
+			wantErr: `unsupported cipher suite "TLS_RSA_WITH_NOPE" (expected one of TLS_`,
+		},
+		{
+			// Suites crypto/tls considers insecure are not offered.
+			name:    "insecure cipher suite",
+			tls:     TLSConfig{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+			wantErr: "unsupported cipher suite",
+		},
+		{
+			name:    "unknown curve",
+			tls:     TLSConfig{CurvePreferences: []string{"P224"}},
+			wantErr: `unsupported curve "P224"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := tt.tls.Build()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Build error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(cfg.CipherSuites, tt.wantSuites) {
+				t.Errorf("CipherSuites = %v, want %v", cfg.CipherSuites, tt.wantSuites)
+			}
+			if !slices.Equal(cfg.CurvePreferences, tt.wantCurves) {
+				t.Errorf("CurvePreferences = %v, want %v", cfg.CurvePreferences, tt.wantCurves)
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersShorthand(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		text    string
+		lax     bool
+		want    SecurityHeadersConfig
+		wantErr string
+	}{
+		{name: "yaml true", file: "config.yaml", text: "security_headers: true\n", want: SecurityHeadersConfig{Enabled: true}},
+		{name: "yaml false", file: "config.yaml", text: "security_headers: false\nerror_format: json\n"},
+		{name: "yaml block", file: "config.yaml", text: "security_headers:\n  enabled: true\n  frame_options: SAMEORIGIN\n", want: SecurityHeadersConfig{Enabled: true, FrameOptions: "SAMEORIGIN"}},
+		{name: "yaml merge key", file: "config.yaml", text: "x-anchors: &h {enabled: true}\nsecurity_headers:\n  <<: *h\n  referrer_policy: same-origin\n", lax: true, want: SecurityHeadersConfig{Enabled: true, ReferrerPolicy: "same-origin"}},
+		{name: "yaml unknown key", file: "config.yaml", text: "security_headers:\n  enabled: true\n  frame_option: DENY\n", wantErr: "line 3: field frame_option not found"},
+		{name: "yaml not a boolean", file: "config.yaml", text: "security_headers: sometimes\n", wantErr: "line 1: security_headers must be a boolean or a mapping"},
+		{name: "json true", file: "config.json", text: `{"security_headers": true}`, want: SecurityHeadersConfig{Enabled: true}},
+		{name: "json block", file: "config.json", text: `{"security_headers": {"enabled": true, "referrer_policy": "same-origin"}}`, want: SecurityHeadersConfig{Enabled: true, ReferrerPolicy: "same-origin"}},
+		{name: "json unknown key", file: "config.json", text: `{"security_headers": {"enable": true}}`, wantErr: `unknown field "enable"`},
+		{name: "json not a boolean", file: "config.json", text: `{"security_headers": "yes"}`, wantErr: "security_headers must be a boolean or an object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadConfig(writeFile(t, t.TempDir(), tt.file, tt.text), !tt.lax)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("load error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.SecurityHeaders != tt.want {
+				t.Errorf("security_headers = %+v, want %+v", config.SecurityHeaders, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+	defaults := map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "no-referrer",
+	}
+	tests := []struct {
+		name   string
+		config string
+		tls    bool
+		want   map[string]string
+	}{
+		{name: "shorthand", config: "security_headers: true", want: defaults},
+		{name: "shorthand under TLS", config: "security_headers: true", tls: true, want: map[string]string{"X-Frame-Options": "DENY", "Strict-Transport-Security": "max-age=63072000; includeSubDomains"}},
+		{name: "no HSTS without TLS", config: "security_headers: {enabled: true, strict_transport_security: max-age=60}", want: map[string]string{"Strict-Transport-Security": ""}},
+		{name: "overrides", config: "security_headers: {enabled: true, frame_options: SAMEORIGIN, strict_transport_security: max-age=60}", tls: true, want: map[string]string{"X-Frame-Options": "SAMEORIGIN", "Referrer-Policy": "no-referrer", "Strict-Transport-Security": "max-age=60"}},
+		{name: "off", config: "security_headers: false", want: map[string]string{"X-Frame-Options": "", "Referrer-Policy": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadYAML(t, tt.config)
+			if tt.tls {
+				config.TLS = &TLSConfig{CertFile: certFile, KeyFile: keyFile}
+			}
+			endpoint := staticEndpoint("/me", "ok")
+			endpoint.OIDC = OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+			config.Endpoints = []Endpoint{endpoint}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+
+			// Rejected requests carry the headers too.
+			for _, token := range []string{p.SignToken(map[string]interface{}{"sub": "alice"}), ""} {
+				req := httptest.NewRequest(http.MethodGet, "/me", nil)
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				rec := httptest.NewRecorder()
+				s.srv.Handler.ServeHTTP(rec, req)
+				for name, want := range tt.want {
+					if got := rec.Header().Get(name); got != want {
+						t.Errorf("%d response: %s = %q, want %q", rec.Code, name, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSlashMismatchedIssuers(t *testing.T) {
+	const bare, slashed = "https://idp.example.com", "https://idp.example.com/"
+	endpoint := func(path, issuer string) Endpoint {
+		return Endpoint{Path: path, Method: http.MethodGet, Handler: HandlerStatic, OIDC: OIDC{Issuer: issuer, ClientID: "app"}}
+	}
+	hint := " only by a trailing slash; use the provider's exact issuer for both, or set normalize_issuer"
+	tests := []struct {
+		name     string
+		config   Config
+		wantErrs []string
+	}{
+		{
+			name:   "consistent",
+			config: Config{OIDC: OIDC{Issuer: bare}, Endpoints: []Endpoint{endpoint("/a", bare), endpoint("/b", bare)}, Admin: AdminConfig{OIDC: OIDC{Issuer: bare}}},
+		},
+		{
+			name:     "between endpoints",
+			config:   Config{Endpoints: []Endpoint{endpoint("/a", bare), endpoint("/b", slashed), endpoint("/c", slashed)}},
+			wantErrs: []string{`endpoints[1] (/b): oidc.issuer "https://idp.example.com/" differs from "https://idp.example.com" in endpoints[0]` + hint, `endpoints[2] (/c): oidc.issuer "https://idp.example.com/" differs from "https://idp.example.com" in endpoints[0]` + hint},
+		},
+		{
+			name:     "within one endpoint",
+			config:   Config{Endpoints: []Endpoint{{Path: "/a", OIDC: OIDC{Issuers: []string{bare, slashed}}}}},
+			wantErrs: []string{`endpoints[0] (/a): oidc.issuer "https://idp.example.com/" differs from "https://idp.example.com" in endpoints[0]` + hint},
+		},
+		{
+			name:     "top-level oidc",
+			config:   Config{RequireAuth: true, OIDC: OIDC{Issuer: slashed}, Endpoints: []Endpoint{endpoint("/a", bare)}},
+			wantErrs: []string{`endpoints[0] (/a): oidc.issuer "https://idp.example.com" differs from "https://idp.example.com/" in oidc` + hint},
+		},
+		{
+			name:     "admin oidc",
+			config:   Config{Endpoints: []Endpoint{endpoint("/a", bare)}, Admin: AdminConfig{Enabled: true, OIDC: OIDC{Issuer: slashed}}},
+			wantErrs: []string{`admin.oidc.issuer "https://idp.example.com/" differs from "https://idp.example.com" in endpoints[0]` + hint},
+		},
+		{
+			name:     "debug oidc",
+			config:   Config{Admin: AdminConfig{OIDC: OIDC{Issuer: bare}}, Debug: DebugConfig{OIDC: OIDC{Issuer: slashed}}},
+			wantErrs: []string{`debug.oidc.issuer "https://idp.example.com/" differs from "https://idp.example.com" in admin.oidc` + hint},
+		},
+		{
+			name:   "normalized",
+			config: Config{Endpoints: []Endpoint{endpoint("/a", bare)}, Admin: AdminConfig{OIDC: OIDC{Issuer: slashed, NormalizeIssuer: true}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range slashMismatchedIssuers(tt.config) {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.wantErrs) {
+				t.Errorf("errors = %q\nwant     %q", got, tt.wantErrs)
+			}
+		})
+	}
+
+	config := Config{Endpoints: []Endpoint{endpoint("/a", bare)}, Debug: DebugConfig{OIDC: OIDC{Issuer: slashed, ClientID: "app"}}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "debug.oidc.issuer") {
+		t.Errorf("Validate() = %v, want the debug.oidc mismatch", err)
+	}
+}
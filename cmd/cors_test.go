@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     CORSConfig
+		origin  string
+		headers string
+		want    map[string]string
+	}{
+		{
+			name:   "listed origin",
+			cfg:    CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedMethods: []string{"GET", "PUT"}, MaxAge: 600},
+			origin: "https://app.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, PUT",
+				"Access-Control-Max-Age":       "600",
+				"Vary":                         "Origin",
+			},
+		},
+		{
+			name:   "wildcard",
+			cfg:    CORSConfig{AllowedOrigins: []string{"*"}},
+			origin: "https://anywhere.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "*",
+				"Access-Control-Allow-Methods": "GET, HEAD, POST",
+			},
+		},
+		{
+			name:    "credentials and requested headers",
+			cfg:     CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true},
+			origin:  "https://app.example.com",
+			headers: "Authorization, Content-Type",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Headers":     "Authorization, Content-Type",
+			},
+		},
+		{
+			name:    "configured headers win",
+			cfg:     CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowedHeaders: []string{"Authorization"}},
+			origin:  "https://app.example.com",
+			headers: "X-Custom",
+			want:    map[string]string{"Access-Control-Allow-Headers": "Authorization"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := corsMiddleware(tt.cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("preflight reached the handler")
+			}))
+			req := httptest.NewRequest(http.MethodOptions, "/api", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", "PUT")
+			if tt.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Errorf("status = %d, want 204", rec.Code)
+			}
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	cfg := CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}
+	h := corsMiddleware(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantOrigin string
+	}{
+		{name: "allowed origin", method: http.MethodGet, origin: "https://app.example.com", wantOrigin: "https://app.example.com"},
+		{name: "origin case-insensitive", method: http.MethodGet, origin: "https://APP.example.com", wantOrigin: "https://APP.example.com"},
+		{name: "other origin", method: http.MethodGet, origin: "https://evil.example.com"},
+		{name: "no origin", method: http.MethodGet},
+		{name: "plain OPTIONS", method: http.MethodOptions, origin: "https://app.example.com", wantOrigin: "https://app.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusTeapot {
+				t.Errorf("status = %d, want the handler's response", rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+				t.Errorf("Access-Control-Allow-Methods = %q on a non-preflight request", got)
+			}
+		})
+	}
+}
+
+func TestCORSValidate(t *testing.T) {
+	tests := []struct {
+		cfg     CORSConfig
+		wantErr bool
+	}{
+		{cfg: CORSConfig{AllowedOrigins: []string{"*"}}},
+		{cfg: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true}},
+		{cfg: CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: Validate() = %v, wantErr %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/pprof"
+)
+
+const pprofPath = "/debug/pprof/"
+
+// DebugConfig enables debugging aids. PProf serves the net/http/pprof
+// endpoints under /debug/pprof/, protected by the debug block's own OIDC
+// settings; they are not registered at all unless it is set.
+type DebugConfig struct {
+	PProf bool `yaml:"pprof" json:"pprof"`
+	OIDC  OIDC `yaml:"oidc" json:"oidc"`
+	// AuthHeaders adds X-Auth-Subject, X-Auth-Issuer and
+	// X-Auth-Verify-Duration to authenticated responses, and X-Auth-Error
+	// to rejected ones. The token itself is never included.
+	AuthHeaders bool `yaml:"auth_headers" json:"auth_headers"`
+}
+
+// Validate requires OIDC settings whenever pprof is enabled.
+func (d DebugConfig) Validate() error {
+	if !d.PProf {
+		return nil
+	}
+	var errs []error
+	if len(d.OIDC.issuerList()) == 0 && d.OIDC.Introspection.Endpoint == "" {
+		errs = append(errs, errors.New("debug.oidc.issuer is required when debug.pprof is enabled"))
+	}
+	if d.OIDC.ClientID == "" {
+		errs = append(errs, errors.New("debug.oidc.client_id is required when debug.pprof is enabled"))
+	}
+	for _, err := range d.OIDC.validate() {
+		errs = append(errs, errors.New("debug.oidc."+err.Error()))
+	}
+	return errors.Join(errs...)
+}
+
+// registerDebugRoutes adds the authenticated pprof endpoints to rt.
+func (s *Server) registerDebugRoutes(rt *routes) {
+	if !s.debug.PProf {
+		return
+	}
+	auth := newOIDCMiddleware(s.debug.OIDC, s.metrics)
+
+	handlers := map[string]http.Handler{
+		"":        http.HandlerFunc(pprof.Index),
+		"cmdline": http.HandlerFunc(pprof.Cmdline),
+		"profile": http.HandlerFunc(pprof.Profile),
+		"symbol":  http.HandlerFunc(pprof.Symbol),
+		"trace":   http.HandlerFunc(pprof.Trace),
+	}
+	// pprof.Index finds named profiles from the request path, which doesn't
+	// work under a base path, so register each one explicitly.
+	for _, name := range []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"} {
+		handlers[name] = pprof.Handler(name)
+	}
+	for name, h := range handlers {
+		rt.handle(s.prefixBuiltins, pprofPath+name, auth.wrap(h), http.MethodGet, http.MethodPost)
+	}
+}
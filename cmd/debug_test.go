@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestPProfRoutes(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	enabled := DebugConfig{PProf: true, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}}
+	token := p.SignToken(map[string]interface{}{"sub": "oncall"})
+
+	tests := []struct {
+		name       string
+		debug      DebugConfig
+		path       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "index", debug: enabled, path: "/debug/pprof/", token: token, wantStatus: http.StatusOK, wantBody: "goroutine"},
+		{name: "named profile", debug: enabled, path: "/debug/pprof/goroutine?debug=1", token: token, wantStatus: http.StatusOK, wantBody: "goroutine profile"},
+		{name: "no token", debug: enabled, path: "/debug/pprof/", wantStatus: http.StatusUnauthorized},
+		{name: "token from another provider", debug: enabled, path: "/debug/pprof/heap", token: oidctest.NewProvider(t).SignToken(map[string]interface{}{"sub": "oncall"}), wantStatus: http.StatusUnauthorized},
+		{name: "disabled", path: "/debug/pprof/", token: token, wantStatus: http.StatusNotFound},
+		{name: "disabled profile", path: "/debug/pprof/heap", token: token, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Config{Debug: tt.debug})
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body does not contain %q", tt.wantBody)
+			}
+		})
+	}
+
+	if err := (DebugConfig{PProf: true}).Validate(); err == nil || !strings.Contains(err.Error(), "debug.oidc.issuer is required") {
+		t.Errorf("pprof without oidc: Validate = %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// jsonErrors makes writeError render JSON rather than text matching
+// http.Error, for error_format: json. setResponseState sets it.
+var jsonErrors atomic.Bool
+
+// writeError writes an error response in the configured format.
+func writeError(w http.ResponseWriter, status int, message string) {
+	if jsonErrors.Load() {
+		writeJSONError(w, status, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// writeJSONError writes {"error": message, "status": status} with the given
+// status code.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Status int    `json:"status"`
+	}{message, status})
+}
+
+// handleNotFound replaces mux's plain-text 404.
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSONError(w, http.StatusNotFound, "Not found")
+}
+
+// methodNotAllowedHandler replaces mux's plain-text 405, listing the methods
+// router does serve for the path in the Allow header.
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowed := allowedMethods(router, r); len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+		}
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	})
+}
+
+// allowedMethods returns the sorted methods of every route matching r's
+// path.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	seen := make(map[string]bool)
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			req := r.Clone(r.Context())
+			req.Method = method
+			var match mux.RouteMatch
+			if route.Match(req, &match) {
+				seen[method] = true
+			}
+		}
+		return nil
+	})
+
+	allowed := make([]string, 0, len(seen))
+	for method := range seen {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
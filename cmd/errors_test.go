@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestNotFoundAndMethodNotAllowed(t *testing.T) {
+	read := staticEndpoint("/items", "list")
+	write := staticEndpoint("/items", "created")
+	write.Method = ""
+	write.Methods = []string{http.MethodPost, http.MethodPut}
+	config := Config{Endpoints: []Endpoint{read, write, staticEndpoint("/items/{id}", "item")}}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantError  string
+		wantAllow  string
+	}{
+		{name: "unknown path", method: http.MethodGet, path: "/nope", wantStatus: http.StatusNotFound, wantError: "Not found"},
+		{name: "wrong method", method: http.MethodDelete, path: "/items", wantStatus: http.StatusMethodNotAllowed, wantError: "Method not allowed", wantAllow: "GET, POST, PUT"},
+		{name: "wrong method on a pattern", method: http.MethodPost, path: "/items/7", wantStatus: http.StatusMethodNotAllowed, wantError: "Method not allowed", wantAllow: "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body struct {
+				Error  string `json:"error"`
+				Status int    `json:"status"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q: %v", rec.Body, err)
+			}
+			if body.Error != tt.wantError || body.Status != tt.wantStatus {
+				t.Errorf("body = %+v, want error %q status %d", body, tt.wantError, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestErrorFormatReset(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	hello := Endpoint{Path: "/hello", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}}
+	jsonConfig := Config{ErrorFormat: "json", Endpoints: []Endpoint{hello}}
+	textConfig := Config{Endpoints: []Endpoint{hello}}
+
+	// A setting left out of the config returns to its default, whether the
+	// config is reloaded or used to build another server.
+	s := newTestServer(t, jsonConfig)
+	steps := []struct {
+		name   string
+		apply  func() error
+		wantCT string
+	}{
+		{name: "json", apply: func() error { return s.Reload(jsonConfig) }, wantCT: "application/json"},
+		{name: "reloaded without error_format", apply: func() error { return s.Reload(textConfig) }, wantCT: "text/plain; charset=utf-8"},
+		{name: "reloaded as json", apply: func() error { return s.Reload(jsonConfig) }, wantCT: "application/json"},
+		{name: "new server without error_format", apply: func() error {
+			s = newTestServer(t, textConfig)
+			return s.Reload(textConfig)
+		}, wantCT: "text/plain; charset=utf-8"},
+	}
+	for _, step := range steps {
+		if err := step.apply(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		rec := get(s, "/hello")
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: GET /hello = %d, want 401", step.name, rec.Code)
+		}
+		if got := rec.Header().Get("Content-Type"); got != step.wantCT {
+			t.Errorf("%s: Content-Type = %q, want %q", step.name, got, step.wantCT)
+		}
+	}
+}
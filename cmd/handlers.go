@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// HandlerFactory builds the handler for an endpoint from its configuration.
+type HandlerFactory func(endpoint Endpoint) (http.HandlerFunc, error)
+
+// HandlerType names a registered handler in an endpoint's handler field.
+type HandlerType string
+
+// The built-in handlers. Handlers registered elsewhere may use any name.
+const (
+	HandlerHello    HandlerType = "handleHello"
+	HandlerStatic   HandlerType = "static"
+	HandlerProxy    HandlerType = "proxy"
+	HandlerLogin    HandlerType = "login"
+	HandlerCallback HandlerType = "callback"
+	HandlerLogout   HandlerType = "logout"
+)
+
+// UnmarshalYAML rejects names that no handler is registered under, so a
+// typo is reported with its line number when the config is parsed.
+func (h *HandlerType) UnmarshalYAML(value *yaml.Node) error {
+	var name string
+	if err := value.Decode(&name); err != nil {
+		return err
+	}
+	if err := checkHandlerType(HandlerType(name)); err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*h = HandlerType(name)
+	return nil
+}
+
+// UnmarshalJSON rejects unregistered names as UnmarshalYAML does, but
+// without a line number, which encoding/json doesn't report.
+func (h *HandlerType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	if err := checkHandlerType(HandlerType(name)); err != nil {
+		return err
+	}
+	*h = HandlerType(name)
+	return nil
+}
+
+// checkHandlerType accepts registered handler names, and the empty name,
+// which Config.Validate reports as a missing handler.
+func checkHandlerType(h HandlerType) error {
+	if h == "" {
+		return nil
+	}
+	handlersMu.RLock()
+	_, ok := handlers[h]
+	handlersMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown handler %q (registered: %s)", h, strings.Join(handlerNames(), ", "))
+	}
+	return nil
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[HandlerType]HandlerFactory)
+)
+
+// RegisterHandler makes a handler available to endpoints under name. It is
+// typically called from an init function; registering the same name twice
+// replaces the earlier factory.
+func RegisterHandler(name HandlerType, factory HandlerFactory) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[name] = factory
+}
+
+// handlerNames returns the registered handler names in sorted order.
+func handlerNames() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func getHandlerFunc(endpoint Endpoint) (http.HandlerFunc, error) {
+	handlersMu.RLock()
+	factory, ok := handlers[endpoint.Handler]
+	handlersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("handler function not found: %s (registered: %s)", endpoint.Handler, strings.Join(handlerNames(), ", "))
+	}
+	return factory(endpoint)
+}
+
+func init() {
+	RegisterHandler(HandlerHello, newHelloHandler)
+	RegisterHandler(HandlerStatic, newStaticHandler)
+}
+
+func newHelloHandler(endpoint Endpoint) (http.HandlerFunc, error) {
+	greetingClaims := endpoint.GreetingClaims
+	if len(greetingClaims) == 0 {
+		greetingClaims = defaultGreetingClaims
+	}
+	format := endpoint.ResponseFormat
+	if format != "" && format != "text" && format != "json" {
+		return nil, fmt.Errorf("unsupported response_format %q (expected text or json)", format)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The token has already been verified by OIDCMiddleware
+		claims := ClaimsFromContext(r.Context())
+		if claims == nil && !endpoint.OIDC.Optional {
+			writeError(w, http.StatusUnauthorized, "Authentication required")
+			return
+		}
+
+		// Greet the user by the first configured claim the token carries
+		name := firstClaim(claims, greetingClaims)
+		if format == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(greeting{Greeting: "Hello", User: name})
+			return
+		}
+		if name == "" {
+			io.WriteString(w, "Hello!")
+			return
+		}
+		fmt.Fprintf(w, "Hello, %s!", name)
+	}, nil
+}
+
+// greeting is handleHello's JSON response body.
+type greeting struct {
+	Greeting string `json:"greeting"`
+	User     string `json:"user,omitempty"`
+}
+
+// PathVars returns the variables matched from the endpoint's path pattern,
+// e.g. {"id": "42"} for /users/{id}.
+func PathVars(r *http.Request) map[string]string {
+	return mux.Vars(r)
+}
+
+var (
+	pathVarPattern     = regexp.MustCompile(`\{([^{}:]+)(?::[^{}]*)?\}`)
+	templateVarPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// pathVarNames returns the names of the variables in a mux path pattern.
+func pathVarNames(path string) map[string]bool {
+	names := make(map[string]bool)
+	for _, m := range pathVarPattern.FindAllStringSubmatch(path, -1) {
+		names[m[1]] = true
+	}
+	return names
+}
+
+// newStaticHandler returns the endpoint's configured response. {name} in
+// the body is replaced by the path variable of that name, escaped for the
+// response's content type, since the client controls its value.
+func newStaticHandler(endpoint Endpoint) (http.HandlerFunc, error) {
+	resp := endpoint.Response
+	vars := pathVarNames(endpoint.Path)
+	templated := false
+	for _, m := range templateVarPattern.FindAllStringSubmatch(resp.Body, -1) {
+		if !vars[m[1]] {
+			return nil, fmt.Errorf("response.body references {%s}, which is not a variable in path %s", m[1], endpoint.Path)
+		}
+		templated = true
+	}
+
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	contentType := resp.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	escape := templateEscaper(contentType)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if !templated {
+			w.WriteHeader(status)
+			io.WriteString(w, resp.Body)
+			return
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		pathVars := PathVars(r)
+		io.WriteString(w, templateVarPattern.ReplaceAllStringFunc(resp.Body, func(ref string) string {
+			return escape(pathVars[ref[1:len(ref)-1]])
+		}))
+	}, nil
+}
+
+// templateEscaper returns how path variables are escaped in a body of the
+// given content type. JSON bodies get string escaping, for variables placed
+// inside a string literal; plain text is left as is; anything else, HTML and
+// XML included, is HTML-escaped.
+func templateEscaper(contentType string) func(string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/plain":
+		return func(s string) string { return s }
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return jsonStringEscape
+	default:
+		return html.EscapeString
+	}
+}
+
+// jsonStringEscape escapes s for use between the quotes of a JSON string.
+// encoding/json also escapes <, > and &, so the result is safe if the body
+// is sniffed as HTML.
+func jsonStringEscape(s string) string {
+	quoted, _ := json.Marshal(s)
+	return string(quoted[1 : len(quoted)-1])
+}
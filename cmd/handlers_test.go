@@ -0,0 +1,277 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestHelloGreetingFallback(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	tests := []struct {
+		name   string
+		claims []string
+		token  map[string]interface{}
+		want   string
+	}{
+		{name: "email first", token: map[string]interface{}{"sub": "u1", "email": "alice@example.com", "preferred_username": "alice"}, want: "Hello, alice@example.com!"},
+		{name: "preferred_username", token: map[string]interface{}{"sub": "u1", "preferred_username": "alice"}, want: "Hello, alice!"},
+		{name: "sub", token: map[string]interface{}{"sub": "u1"}, want: "Hello, u1!"},
+		{name: "none present", claims: []string{"name", "nickname"}, token: map[string]interface{}{"sub": "u1"}, want: "Hello!"},
+		{name: "configured order", claims: []string{"name", "email"}, token: map[string]interface{}{"sub": "u1", "email": "alice@example.com", "name": "Alice"}, want: "Hello, Alice!"},
+		{name: "configured fallback", claims: []string{"name", "email"}, token: map[string]interface{}{"sub": "u1", "email": "alice@example.com"}, want: "Hello, alice@example.com!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+			hello, err := newHelloHandler(Endpoint{Path: "/hello", GreetingClaims: tt.claims, OIDC: oidcConfig})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := OIDCMiddleware(oidcConfig)(hello)
+
+			req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(tt.token))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelloResponseFormat(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+	tests := []struct {
+		format          string
+		claims          map[string]interface{}
+		wantBody        string
+		wantContentType string
+	}{
+		{format: "", claims: map[string]interface{}{"sub": "u1", "email": "alice@example.com"}, wantBody: "Hello, alice@example.com!", wantContentType: "text/plain"},
+		{format: "text", claims: map[string]interface{}{"sub": "u1", "email": "alice@example.com"}, wantBody: "Hello, alice@example.com!", wantContentType: "text/plain"},
+		{format: "json", claims: map[string]interface{}{"sub": "u1", "email": "alice@example.com"}, wantBody: `{"greeting":"Hello","user":"alice@example.com"}` + "\n", wantContentType: "application/json"},
+		{format: "json", claims: map[string]interface{}{"sub": ""}, wantBody: `{"greeting":"Hello"}` + "\n", wantContentType: "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			hello, err := newHelloHandler(Endpoint{Path: "/hello", ResponseFormat: tt.format, OIDC: oidcConfig})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(tt.claims))
+			rec := httptest.NewRecorder()
+			OIDCMiddleware(oidcConfig)(hello).ServeHTTP(rec, req)
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.wantContentType)
+			}
+		})
+	}
+
+	if _, err := newHelloHandler(Endpoint{Path: "/hello", ResponseFormat: "xml"}); err == nil {
+		t.Error("response_format xml accepted")
+	}
+}
+
+func TestStaticPathVars(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		path        string
+		want        string
+	}{
+		{name: "echoes id", body: "user {id}", path: "/users/42", want: "user 42"},
+		{name: "plain text is verbatim", body: "user {id}", path: "/users/%3Cb%3E", want: "user <b>"},
+		{name: "html is escaped", contentType: "text/html; charset=utf-8", body: "<p>{id}</p>", path: "/users/%3Cimg%20src=x%20onerror=alert(1)%3E", want: "<p>&lt;img src=x onerror=alert(1)&gt;</p>"},
+		{name: "json string is escaped", contentType: "application/json", body: `{"id":"{id}"}`, path: `/users/a%22%2C%22admin%22:true%3C`, want: `{"id":"a\",\"admin\":true\u003c"}`},
+		{name: "unknown types are html escaped", contentType: "application/xml", body: "<id>{id}</id>", path: "/users/%3Cx%3E", want: "<id>&lt;x&gt;</id>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := staticEndpoint("/users/{id}", tt.body)
+			endpoint.Response.ContentType = tt.contentType
+			config := Config{Endpoints: []Endpoint{endpoint}}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			rec := get(s, tt.path)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	_, err := newStaticHandler(staticEndpoint("/users/{id}", "user {name}"))
+	if err == nil || !strings.Contains(err.Error(), "references {name}") {
+		t.Errorf("body naming a variable missing from the path: error = %v", err)
+	}
+}
+
+func TestAnonymousHandler(t *testing.T) {
+	p, other := oidctest.NewProvider(t), oidctest.NewProvider(t)
+	endpoint := Endpoint{
+		Path:             "/feed",
+		Method:           http.MethodGet,
+		Handler:          HandlerHello,
+		AnonymousHandler: HandlerStatic,
+		Response:         StaticResponse{Body: "Sign in for more"},
+		OIDC:             OIDC{Issuer: p.Issuer(), ClientID: p.ClientID},
+	}
+	config := Config{Endpoints: []Endpoint{endpoint}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{name: "authenticated", token: p.SignToken(map[string]interface{}{"sub": "alice"}), want: "Hello, alice!"},
+		{name: "no token", want: "Sign in for more"},
+		{name: "other issuer", token: other.SignToken(map[string]interface{}{"sub": "alice"}), want: "Sign in for more"},
+		{name: "expired", token: p.SignToken(map[string]interface{}{"sub": "alice", "exp": 1}), want: "Sign in for more"},
+		{name: "garbage", token: "not-a-jwt", want: "Sign in for more"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/feed", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+				t.Errorf("GET /feed = %d %q, want 200 %q", rec.Code, rec.Body, tt.want)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name    string
+		edit    func(*Endpoint)
+		wantErr string
+	}{
+		{name: "without oidc", edit: func(e *Endpoint) { e.OIDC = OIDC{} }, wantErr: "anonymous_handler requires oidc settings"},
+		{name: "unknown handler", edit: func(e *Endpoint) { e.AnonymousHandler = "handleNope" }, wantErr: "anonymous_handler: "},
+	}
+	for _, tt := range invalid {
+		// A static primary handler has no oidc requirement of its own.
+		e := endpoint
+		e.Handler = HandlerStatic
+		tt.edit(&e)
+		var found bool
+		for _, err := range e.validate() {
+			found = found || strings.Contains(err.Error(), tt.wantErr)
+		}
+		if !found {
+			t.Errorf("%s: validate() = %v, want %q", tt.name, e.validate(), tt.wantErr)
+		}
+	}
+}
+
+func TestHandlerType(t *testing.T) {
+	RegisterHandler("echo_path", func(endpoint Endpoint) (http.HandlerFunc, error) {
+		return func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, r.URL.Path) }, nil
+	})
+	t.Cleanup(func() {
+		handlersMu.Lock()
+		delete(handlers, "echo_path")
+		handlersMu.Unlock()
+	})
+
+	tests := []struct {
+		name    string
+		file    string
+		text    string
+		want    HandlerType
+		wantErr string
+	}{
+		{name: "hello", file: "config.yaml", text: "handler: handleHello", want: HandlerHello},
+		{name: "static", file: "config.yaml", text: "handler: static", want: HandlerStatic},
+		{name: "proxy", file: "config.yaml", text: "handler: proxy", want: HandlerProxy},
+		{name: "login", file: "config.yaml", text: "handler: login", want: HandlerLogin},
+		{name: "callback", file: "config.yaml", text: "handler: callback", want: HandlerCallback},
+		{name: "logout", file: "config.yaml", text: "handler: logout", want: HandlerLogout},
+		{name: "registered elsewhere", file: "config.yaml", text: "handler: echo_path", want: "echo_path"},
+		{name: "unset", file: "config.yaml", text: "method: GET"},
+		{name: "typo", file: "config.yaml", text: "handler: handleHelo", wantErr: `line 3: unknown handler "handleHelo" (registered: callback, echo_path, handleHello, login, logout, proxy, static)`},
+		{name: "wrong case", file: "config.yaml", text: "handler: Static", wantErr: `line 3: unknown handler "Static"`},
+		{name: "anonymous typo", file: "config.yaml", text: "anonymous_handler: statik", wantErr: `line 3: unknown handler "statik"`},
+		{name: "json", file: "config.json", text: `"handler": "proxy"`, want: HandlerProxy},
+		{name: "json typo", file: "config.json", text: `"handler": "proxi"`, wantErr: `unknown handler "proxi"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "endpoints:\n  - path: /x\n    " + tt.text + "\n"
+			if tt.file == "config.json" {
+				text = `{"endpoints": [{"path": "/x", ` + tt.text + `}]}`
+			}
+			config, err := loadConfig(writeFile(t, t.TempDir(), tt.file, text), true)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.Endpoints[0].Handler; got != tt.want {
+				t.Errorf("handler = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Built-in and registered names both dispatch to their handlers.
+	p := oidctest.NewProvider(t)
+	config := loadYAML(t, `
+endpoints:
+  - path: /hello
+    method: GET
+    handler: handleHello
+    oidc: {issuer: "`+p.Issuer()+`", client_id: "`+p.ClientID+`"}
+  - path: /echo
+    method: GET
+    handler: echo_path
+`)
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "alice"}))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "Hello, alice!" {
+		t.Errorf("GET /hello = %d %q", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/echo"); rec.Code != http.StatusOK || rec.Body.String() != "/echo" {
+		t.Errorf("GET /echo = %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	healthPath    = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// registerHealthChecks adds the unauthenticated liveness and readiness
+// routes, unless the config already defines an endpoint at the same path.
+func (s *Server) registerHealthChecks(rt *routes) {
+	if !rt.has(s.prefixBuiltins, healthPath) {
+		rt.handle(s.prefixBuiltins, healthPath, http.HandlerFunc(s.handleHealth), http.MethodGet)
+	}
+	if !rt.has(s.prefixBuiltins, readinessPath) {
+		rt.handle(s.prefixBuiltins, readinessPath, http.HandlerFunc(s.handleReady), http.MethodGet)
+	}
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		writeStatus(w, http.StatusServiceUnavailable, "not ready")
+		return
+	}
+	done, failed := s.warmup.status()
+	if !done {
+		writeStatus(w, http.StatusServiceUnavailable, "warming up")
+		return
+	}
+	if len(failed) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "provider discovery failed",
+			"failed_issuers": failed,
+		})
+		return
+	}
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+const (
+	// rediscoveryTimeout bounds each background retry of an issuer that
+	// failed warm-up.
+	rediscoveryTimeout = 2 * time.Second
+	// The retries back off from warmupRetryBackoff, doubling up to
+	// maxWarmupRetryBackoff.
+	warmupRetryBackoff    = time.Second
+	maxWarmupRetryBackoff = 30 * time.Second
+)
+
+// warmupState tracks the startup discovery of every configured issuer.
+type warmupState struct {
+	mu      sync.Mutex
+	started bool
+	done    bool
+	// failed holds the providers that haven't been discovered since
+	// warm-up timed out. Each is retried in the background.
+	failed map[providerKey]bool
+	// cancel stops the current run of warm-up and its retries, and gen
+	// counts the runs, so that a run replaced by a reload doesn't record
+	// its result.
+	cancel context.CancelFunc
+	gen    int
+	// retryBackoff overrides warmupRetryBackoff when set.
+	retryBackoff time.Duration
+}
+
+type warmupTarget struct {
+	issuer   string
+	attempts int
+}
+
+// WarmUp discovers every provider the registered endpoints and the admin
+// and debug routes use, concurrently and in the background, so that the
+// readiness check only passes once they can all be reached. Providers that
+// can't be discovered before the warm-up timeout keep being retried until
+// they are. Calling it again, as Reload does, cancels the previous run;
+// readiness keeps that run's result until the new one finishes.
+func (s *Server) WarmUp() {
+	var blocks []OIDC
+	s.mu.RLock()
+	for _, e := range s.routes.endpoints {
+		blocks = append(blocks, e.OIDC)
+	}
+	s.mu.RUnlock()
+	if s.admin.Enabled {
+		blocks = append(blocks, s.admin.OIDC)
+	}
+	if s.debug.PProf {
+		blocks = append(blocks, s.debug.OIDC)
+	}
+	// Blocks for the same issuer can still need different providers, for
+	// instance with their own discovery_url.
+	targets := make(map[providerKey]warmupTarget)
+	for _, o := range blocks {
+		if !o.configured() {
+			continue
+		}
+		for _, issuer := range o.issuerList() {
+			targets[o.verifierKey(issuer).providerKey] = warmupTarget{issuer: issuer, attempts: o.discoveryAttempts()}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.warmup.mu.Lock()
+	if s.warmup.cancel != nil {
+		s.warmup.cancel()
+	}
+	s.warmup.started = true
+	s.warmup.cancel = cancel
+	s.warmup.gen++
+	gen := s.warmup.gen
+	s.warmup.mu.Unlock()
+
+	go func() {
+		warmupCtx, cancel := context.WithTimeout(ctx, s.warmupTimeout)
+		defer cancel()
+
+		var mu sync.Mutex
+		failed := make(map[providerKey]warmupTarget)
+		var wg sync.WaitGroup
+		for key, t := range targets {
+			wg.Add(1)
+			go func(key providerKey, t warmupTarget) {
+				defer wg.Done()
+				if _, err := providers.provider(warmupCtx, key, t.attempts); err != nil {
+					s.logger.Warn("provider warm-up failed", "issuer", t.issuer, "error", err)
+					mu.Lock()
+					failed[key] = t
+					mu.Unlock()
+				}
+			}(key, t)
+		}
+		wg.Wait()
+
+		s.warmup.mu.Lock()
+		if s.warmup.gen != gen {
+			s.warmup.mu.Unlock()
+			return
+		}
+		s.warmup.done = true
+		s.warmup.failed = make(map[providerKey]bool, len(failed))
+		for key := range failed {
+			s.warmup.failed[key] = true
+		}
+		s.warmup.mu.Unlock()
+		for key, t := range failed {
+			go s.rediscover(ctx, key, t)
+		}
+	}()
+}
+
+// rediscover retries the discovery of a provider that failed warm-up,
+// backing off between attempts, until it succeeds or ctx is cancelled.
+func (s *Server) rediscover(ctx context.Context, key providerKey, t warmupTarget) {
+	backoff := s.warmup.retryBackoff
+	if backoff <= 0 {
+		backoff = warmupRetryBackoff
+	}
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, rediscoveryTimeout)
+		_, err := providers.provider(attemptCtx, key, 1)
+		cancel()
+		if err == nil {
+			s.logger.Info("provider discovered after warm-up failure", "issuer", t.issuer)
+			s.warmup.mu.Lock()
+			delete(s.warmup.failed, key)
+			s.warmup.mu.Unlock()
+			return
+		}
+		backoff = min(2*backoff, maxWarmupRetryBackoff)
+	}
+}
+
+// status reports whether warm-up has finished and the issuers of the
+// providers that still can't be discovered. It only reads the state WarmUp and its retries
+// maintain, so it never waits on a provider. It reports done if WarmUp was
+// never called.
+func (w *warmupState) status() (done bool, failed []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.started {
+		return true, nil
+	}
+	if !w.done {
+		return false, nil
+	}
+	for key := range w.failed {
+		failed = append(failed, key.issuer)
+	}
+	sort.Strings(failed)
+	return true, slices.Compact(failed)
+}
+
+// running reports whether WarmUp has been called, so that Reload knows to
+// run it again for the new routes.
+func (w *warmupState) running() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.started
+}
+
+// stop cancels warm-up and any retries still running.
+func (w *warmupState) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// warmupServer returns a ready server whose only endpoint uses issuer, with
+// warm-up retries backing off quickly.
+func warmupServer(t *testing.T, issuer, clientID, warmupTimeout string) *Server {
+	t.Helper()
+	config := Config{
+		Server:    ServerConfig{WarmupTimeout: warmupTimeout},
+		Endpoints: []Endpoint{{Path: "/hello", Handler: HandlerHello, OIDC: OIDC{Issuer: issuer, ClientID: clientID, DiscoveryAttempts: 1}}},
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	s.warmup.retryBackoff = 10 * time.Millisecond
+	t.Cleanup(s.warmup.stop)
+	s.MarkReady()
+	return s
+}
+
+type readiness struct {
+	code   int
+	status string
+	failed []string
+}
+
+func ready(t *testing.T, s *Server) readiness {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body struct {
+		Status        string   `json:"status"`
+		FailedIssuers []string `json:"failed_issuers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("readyz body %q: %v", rec.Body, err)
+	}
+	return readiness{code: rec.Code, status: body.Status, failed: body.FailedIssuers}
+}
+
+// waitReady polls the readiness check until cond holds or a second passes.
+func waitReady(t *testing.T, s *Server, cond func(readiness) bool) readiness {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		r := ready(t, s)
+		if cond(r) || time.Now().After(deadline) {
+			return r
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReadinessRecoversAfterWarmupFailure(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	p.FailDiscovery(1 << 20)
+	s := warmupServer(t, p.Issuer(), p.ClientID, "1s")
+
+	s.WarmUp()
+	r := waitReady(t, s, func(r readiness) bool { return r.status != "warming up" })
+	if r.code != http.StatusServiceUnavailable || len(r.failed) != 1 || r.failed[0] != p.Issuer() {
+		t.Fatalf("readyz with the provider down = %d %+v, want 503 naming %s", r.code, r, p.Issuer())
+	}
+
+	p.FailDiscovery(0)
+	if r := waitReady(t, s, func(r readiness) bool { return r.code == http.StatusOK }); r.code != http.StatusOK {
+		t.Fatalf("readyz after the provider came back = %d %+v, want 200", r.code, r)
+	}
+}
+
+func TestReadinessWarmupTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hanging.Close)
+	t.Cleanup(func() { close(release) })
+	s := warmupServer(t, hanging.URL, "app", "50ms")
+
+	if r := ready(t, s); r.code != http.StatusOK {
+		t.Errorf("readyz before WarmUp = %d, want 200", r.code)
+	}
+	s.WarmUp()
+	if r := ready(t, s); r.code != http.StatusServiceUnavailable || r.status != "warming up" {
+		t.Errorf("readyz during warm-up = %d %q, want 503 warming up", r.code, r.status)
+	}
+	r := waitReady(t, s, func(r readiness) bool { return r.status != "warming up" })
+	if r.code != http.StatusServiceUnavailable || len(r.failed) != 1 || r.failed[0] != hanging.URL {
+		t.Fatalf("readyz after the warm-up timeout = %d %+v, want 503 naming %s", r.code, r, hanging.URL)
+	}
+
+	// The check answers from cached state while the retries hang.
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if r := ready(t, s); r.code != http.StatusServiceUnavailable {
+			t.Errorf("readyz = %d, want 503", r.code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("readyz took %v with a hanging issuer", elapsed)
+	}
+}
+
+func TestWarmupTargets(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	down := oidctest.NewProvider(t)
+	down.FailDiscovery(1 << 20)
+	admin := oidctest.NewProvider(t)
+	debug := oidctest.NewProvider(t)
+	config := Config{
+		Admin: AdminConfig{Enabled: true, OIDC: OIDC{Issuer: admin.Issuer(), ClientID: admin.ClientID}},
+		Debug: DebugConfig{PProf: true, OIDC: OIDC{Issuer: debug.Issuer(), ClientID: debug.ClientID}},
+		Endpoints: []Endpoint{
+			{Path: "/a", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}},
+			// The same issuer, but its document comes from elsewhere.
+			{Path: "/b", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, DiscoveryURL: down.Issuer() + "/.well-known/openid-configuration", DiscoveryAttempts: 1}},
+		},
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	s.warmup.retryBackoff = time.Hour
+	t.Cleanup(s.warmup.stop)
+	s.MarkReady()
+
+	s.WarmUp()
+	r := waitReady(t, s, func(r readiness) bool { return r.status != "warming up" })
+	if r.code != http.StatusServiceUnavailable || len(r.failed) != 1 || r.failed[0] != p.Issuer() {
+		t.Fatalf("readyz with /b's discovery_url down = %d %+v, want 503 naming %s", r.code, r, p.Issuer())
+	}
+	for name, provider := range map[string]*oidctest.Provider{"endpoint": p, "discovery_url": down, "admin": admin, "debug": debug} {
+		if got := provider.DiscoveryCalls(); got != 1 {
+			t.Errorf("%s provider discovered %d times during warm-up, want 1", name, got)
+		}
+	}
+
+	// Reloading warms the providers of the new routes and drops the old.
+	added := oidctest.NewProvider(t)
+	config.Endpoints = []Endpoint{{Path: "/c", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: added.Issuer(), ClientID: added.ClientID}}}
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if r := waitReady(t, s, func(r readiness) bool { return r.code == http.StatusOK }); r.code != http.StatusOK {
+		t.Fatalf("readyz after reloading without /b = %d %+v, want 200", r.code, r)
+	}
+	if got := added.DiscoveryCalls(); got != 1 {
+		t.Errorf("reloaded endpoint's provider discovered %d times, want 1", got)
+	}
+}
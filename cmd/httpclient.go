@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// clientKey describes the TLS trust settings for calls to an identity
+// provider. The zero value means the system roots and http.DefaultClient.
+type clientKey struct {
+	caFile             string
+	insecureSkipVerify bool
+}
+
+var (
+	httpClientsMu sync.Mutex
+	httpClients   = make(map[clientKey]*http.Client)
+)
+
+// client returns the HTTP client for k, building it on first use so that
+// every provider with the same settings shares one connection pool.
+func (k clientKey) client() (*http.Client, error) {
+	if k == (clientKey{}) {
+		return http.DefaultClient, nil
+	}
+	// See insecureOIDCAllowed. Checked before the cache is consulted, so
+	// an earlier allowed client isn't reused.
+	if k.insecureSkipVerify && !insecureOIDCAllowed() {
+		return nil, errors.New("insecure_skip_verify requires ALLOW_INSECURE_OIDC=1")
+	}
+
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+	if c, ok := httpClients[k]; ok {
+		return c, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if k.caFile != "" {
+		pem, err := os.ReadFile(k.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", k.caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	tlsConfig.InsecureSkipVerify = k.insecureSkipVerify
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c := &http.Client{Transport: transport}
+	httpClients[k] = c
+	return c, nil
+}
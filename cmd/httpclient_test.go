@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestPrivateCA(t *testing.T) {
+	p := oidctest.NewTLSProvider(t)
+	caFile := writeFile(t, t.TempDir(), "ca.pem", string(p.CertificatePEM()))
+	token := p.SignToken(map[string]interface{}{"sub": "alice"})
+
+	tests := []struct {
+		name     string
+		cfg      OIDC
+		insecure string
+		wantErr  string
+	}{
+		{name: "system roots", wantErr: "certificate"},
+		{name: "matching CA file", cfg: OIDC{TLSCAFile: caFile}},
+		{name: "skip verify allowed", cfg: OIDC{InsecureSkipVerify: true}, insecure: "1"},
+		{name: "skip verify without the guard", cfg: OIDC{InsecureSkipVerify: true}, wantErr: "ALLOW_INSECURE_OIDC=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOW_INSECURE_OIDC", tt.insecure)
+			cfg := tt.cfg
+			cfg.Issuer, cfg.ClientID, cfg.DiscoveryAttempts = p.Issuer(), p.ClientID, 1
+			_, err := newProviderCache().verify(context.Background(), cfg, token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCAFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := writeFile(t, dir, "ca.pem", "not a certificate")
+	tests := []struct {
+		caFile  string
+		wantErr string
+	}{
+		{caFile: dir + "/missing.pem", wantErr: "reading CA file"},
+		{caFile: notPEM, wantErr: "no certificates found"},
+	}
+	for _, tt := range tests {
+		errs := OIDC{TLSCAFile: tt.caFile}.validate()
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), tt.wantErr) {
+			t.Errorf("%s: validate() = %v, want %q", tt.caFile, errs, tt.wantErr)
+		}
+	}
+}
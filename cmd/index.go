@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const indexPath = "/"
+
+// IndexConfig enables a landing page at / (under the base path) listing
+// the configured endpoints, their methods and whether they require a
+// token. It is served as HTML, or as JSON to clients that ask for it, and
+// shows nothing else of an endpoint's config.
+type IndexConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+}
+
+// indexEntry is the public view of an endpoint on the index page.
+type indexEntry struct {
+	Path      string   `json:"path"`
+	Methods   []string `json:"methods"`
+	Protected bool     `json:"protected"`
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Endpoints</title></head>
+<body>
+<h1>Endpoints</h1>
+<table>
+<tr><th>Path</th><th>Methods</th><th>Authentication</th></tr>
+{{- range .}}
+<tr><td>{{.Path}}</td><td>{{range $i, $m := .Methods}}{{if $i}}, {{end}}{{$m}}{{end}}</td><td>{{if .Protected}}OIDC token required{{else}}public{{end}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// registerIndex adds the index page to rt unless an endpoint already
+// serves /.
+func (s *Server) registerIndex(rt *routes) {
+	if s.index.Enabled && !rt.has(true, indexPath) {
+		rt.handle(true, indexPath, http.HandlerFunc(s.handleIndex), http.MethodGet, http.MethodHead)
+	}
+}
+
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	endpoints := s.routes.endpoints
+	s.mu.RUnlock()
+
+	entries := make([]indexEntry, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		entries = append(entries, indexEntry{
+			Path:      s.basePath + endpoint.Path,
+			Methods:   endpoint.methodList(),
+			Protected: endpoint.requiresOIDC(),
+		})
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, entries)
+}
+
+// wantsJSON reports whether the client asked for JSON rather than HTML.
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
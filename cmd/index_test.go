@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestIndex(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	reports := staticEndpoint("/reports", "reports")
+	reports.Methods = []string{http.MethodPost}
+	reports.OIDC = OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, ClientSecret: "hunter2"}
+	reports.Headers = map[string]string{"X-Upstream-Key": "key-123"}
+	hello := Endpoint{Path: "/hello", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}}
+	status := staticEndpoint("/status", "ok")
+	secrets := []string{"hunter2", "key-123", p.Issuer(), p.ClientID}
+
+	tests := []struct {
+		name     string
+		basePath string
+		accept   string
+		want     []indexEntry
+	}{
+		{
+			name:   "json",
+			accept: "application/json",
+			want: []indexEntry{
+				{Path: "/reports", Methods: []string{"GET", "POST"}, Protected: true},
+				{Path: "/hello", Methods: []string{"GET"}, Protected: true},
+				{Path: "/status", Methods: []string{"GET"}},
+			},
+		},
+		{
+			name:     "json under a base path",
+			basePath: "/api",
+			accept:   "application/json",
+			want: []indexEntry{
+				{Path: "/api/reports", Methods: []string{"GET", "POST"}, Protected: true},
+				{Path: "/api/hello", Methods: []string{"GET"}, Protected: true},
+				{Path: "/api/status", Methods: []string{"GET"}},
+			},
+		},
+		{name: "html", accept: "text/html,application/json;q=0.9"},
+		{name: "no accept header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{BasePath: tt.basePath, Index: IndexConfig{Enabled: true}, Endpoints: []Endpoint{reports, hello, status}}
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.basePath+"/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("GET %s/ = %d: %s", tt.basePath, rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			for _, secret := range secrets {
+				if strings.Contains(body, secret) {
+					t.Errorf("index shows %q:\n%s", secret, body)
+				}
+			}
+
+			if tt.want != nil {
+				if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", ct)
+				}
+				var got []indexEntry
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatalf("index %q: %v", body, err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("index = %+v\nwant    %+v", got, tt.want)
+				}
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("Content-Type = %q, want text/html", ct)
+			}
+			for _, row := range []string{
+				"<tr><td>/reports</td><td>GET, POST</td><td>OIDC token required</td></tr>",
+				"<tr><td>/hello</td><td>GET</td><td>OIDC token required</td></tr>",
+				"<tr><td>/status</td><td>GET</td><td>public</td></tr>",
+			} {
+				if !strings.Contains(body, row) {
+					t.Errorf("index lacks %s:\n%s", row, body)
+				}
+			}
+		})
+	}
+
+	// The index is public, but the endpoints it marks protected are not.
+	config := Config{Index: IndexConfig{Enabled: true}, Endpoints: []Endpoint{hello}}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(s, "/hello"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /hello without a token = %d, want 401", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "alice"}))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /hello with a token = %d, want 200", rec.Code)
+	}
+}
+
+func TestIndexRequireAuth(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+require_auth: true
+oidc: {issuer: "`+p.Issuer()+`", client_id: app}
+index: {enabled: true}
+endpoints:
+  - {path: /reports, method: GET, handler: static}
+  - {path: /status, method: GET, handler: static, public: true}
+`)
+	config, err := loadConfigs([]string{path}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	var got []indexEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("index %q: %v", rec.Body, err)
+	}
+	want := []indexEntry{{Path: "/reports", Methods: []string{"GET"}, Protected: true}, {Path: "/status", Methods: []string{"GET"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("index = %+v, want %+v", got, want)
+	}
+}
+
+func TestIndexRoot(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   int
+	}{
+		{name: "disabled", config: Config{Endpoints: []Endpoint{staticEndpoint("/status", "ok")}}, want: http.StatusNotFound},
+		{name: "endpoint at the root", config: Config{Index: IndexConfig{Enabled: true}, Endpoints: []Endpoint{staticEndpoint("/", "home")}}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, tt.config)
+		if err := s.Reload(tt.config); err != nil {
+			t.Fatal(err)
+		}
+		if rec := get(s, "/"); rec.Code != tt.want || strings.Contains(rec.Body.String(), "<h1>Endpoints</h1>") {
+			t.Errorf("%s: GET / = %d %q, want %d without the index", tt.name, rec.Code, rec.Body, tt.want)
+		}
+	}
+	config := Config{Index: IndexConfig{Enabled: true}, Endpoints: []Endpoint{staticEndpoint("/", "home")}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "conflicts with index.enabled") {
+		t.Errorf("endpoint at / with the index enabled: error = %v", err)
+	}
+}
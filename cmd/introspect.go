@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IntrospectionConfig enables RFC 7662 token introspection for opaque
+// tokens. The endpoint is called with the OIDC block's client_id and
+// client_secret as HTTP basic credentials.
+type IntrospectionConfig struct {
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+	// CacheTTL caps how long an active result is cached (default 5m). Results
+	// are never cached past the token's exp.
+	CacheTTL string `yaml:"cache_ttl" json:"cache_ttl"`
+}
+
+const defaultIntrospectionCacheTTL = 5 * time.Minute
+
+// introspectionError reports that the introspection endpoint could not be
+// reached or returned an unusable response, as opposed to an inactive token.
+type introspectionError struct {
+	err error
+}
+
+func (e *introspectionError) Error() string {
+	return "token introspection failed: " + e.err.Error()
+}
+
+func (e *introspectionError) Unwrap() error {
+	return e.err
+}
+
+var errTokenInactive = errors.New("token is not active")
+
+// introspectionCache remembers active introspection results keyed by the
+// SHA-256 of the endpoint and raw token. Inactive results are never cached.
+type introspectionCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]introspectionEntry
+	client  *http.Client
+}
+
+type introspectionEntry struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+var introspector = newIntrospectionCache()
+
+func newIntrospectionCache() *introspectionCache {
+	return &introspectionCache{
+		entries: make(map[[sha256.Size]byte]introspectionEntry),
+		client:  http.DefaultClient,
+	}
+}
+
+// introspect returns the claims of an active token, consulting the cache
+// before calling the endpoint.
+func (c *introspectionCache) introspect(ctx context.Context, oidcConfig OIDC, rawToken string) (map[string]interface{}, error) {
+	cfg := oidcConfig.Introspection
+	key := sha256.Sum256([]byte(cfg.Endpoint + "\x00" + rawToken))
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.claims, nil
+	}
+
+	claims, err := c.fetch(ctx, oidcConfig, rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := now.Add(mustParseDuration(cfg.CacheTTL, defaultIntrospectionCacheTTL))
+	if exp, ok := claims["exp"].(float64); ok {
+		if tokenExp := time.Unix(int64(exp), 0); tokenExp.Before(expires) {
+			expires = tokenExp
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	if now.Before(expires) {
+		c.entries[key] = introspectionEntry{claims: claims, expires: expires}
+	}
+	return claims, nil
+}
+
+func (c *introspectionCache) fetch(ctx context.Context, oidcConfig OIDC, rawToken string) (map[string]interface{}, error) {
+	form := url.Values{"token": {rawToken}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oidcConfig.Introspection.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, &introspectionError{err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(oidcConfig.ClientID), url.QueryEscape(oidcConfig.ClientSecret))
+
+	client := c.client
+	if key := oidcConfig.clientKey(); key != (clientKey{}) {
+		if client, err = key.client(); err != nil {
+			return nil, &introspectionError{err: err}
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &introspectionError{err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, &introspectionError{err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &introspectionError{err: fmt.Errorf("%s: %s", resp.Status, body)}
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, &introspectionError{err: err}
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errTokenInactive
+	}
+	return claims, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// introspectionServer mimics an RFC 7662 endpoint: it answers with the
+// response registered for the posted token, and inactive for anything else.
+type introspectionServer struct {
+	*httptest.Server
+	responses map[string]map[string]interface{}
+	calls     atomic.Int64
+}
+
+func newIntrospectionServer(t *testing.T, responses map[string]map[string]interface{}) *introspectionServer {
+	s := &introspectionServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.calls.Add(1)
+		if user, pass, ok := r.BasicAuth(); !ok || user != "client" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		resp, ok := s.responses[r.PostFormValue("token")]
+		if !ok {
+			resp = map[string]interface{}{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestIntrospection(t *testing.T) {
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	srv := newIntrospectionServer(t, map[string]map[string]interface{}{
+		"opaque-active": {"active": true, "sub": "alice", "exp": exp},
+		"opaque-broken": {"active": "yes"},
+	})
+	cfg := OIDC{ClientID: "client", ClientSecret: "secret", Introspection: IntrospectionConfig{Endpoint: srv.URL}}
+
+	tests := []struct {
+		name    string
+		cfg     OIDC
+		token   string
+		wantSub string
+		wantErr error
+	}{
+		{name: "active", cfg: cfg, token: "opaque-active", wantSub: "alice"},
+		{name: "inactive", cfg: cfg, token: "opaque-revoked", wantErr: errTokenInactive},
+		{name: "active not a bool", cfg: cfg, token: "opaque-broken", wantErr: errTokenInactive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := newIntrospectionCache().introspect(context.Background(), tt.cfg, tt.token)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("introspect error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims["sub"] != tt.wantSub {
+				t.Errorf("sub = %v, want %q", claims["sub"], tt.wantSub)
+			}
+		})
+	}
+
+	t.Run("bad credentials", func(t *testing.T) {
+		bad := cfg
+		bad.ClientSecret = "wrong"
+		_, err := newIntrospectionCache().introspect(context.Background(), bad, "opaque-active")
+		var ie *introspectionError
+		if !errors.As(err, &ie) {
+			t.Fatalf("introspect error = %v, want an introspectionError", err)
+		}
+	})
+}
+
+func TestIntrospectionCache(t *testing.T) {
+	soon := float64(time.Now().Add(2 * time.Second).Unix())
+	later := float64(time.Now().Add(time.Hour).Unix())
+	srv := newIntrospectionServer(t, map[string]map[string]interface{}{
+		"long-lived":  {"active": true, "sub": "alice", "exp": later},
+		"short-lived": {"active": true, "sub": "bob", "exp": soon},
+	})
+	cfg := OIDC{ClientID: "client", ClientSecret: "secret", Introspection: IntrospectionConfig{Endpoint: srv.URL, CacheTTL: "10m"}}
+	cache := newIntrospectionCache()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.introspect(ctx, cfg, "long-lived"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.calls.Load(); got != 1 {
+		t.Errorf("endpoint called %d times for a cached token, want 1", got)
+	}
+
+	// Inactive results aren't cached, so every attempt asks the endpoint.
+	srv.calls.Store(0)
+	for i := 0; i < 2; i++ {
+		cache.introspect(ctx, cfg, "revoked")
+	}
+	if got := srv.calls.Load(); got != 2 {
+		t.Errorf("endpoint called %d times for an inactive token, want 2", got)
+	}
+
+	// The cache entry ends at the token's exp even though cache_ttl is
+	// longer.
+	if _, err := cache.introspect(ctx, cfg, "short-lived"); err != nil {
+		t.Fatal(err)
+	}
+	var entry introspectionEntry
+	cache.mu.Lock()
+	for _, e := range cache.entries {
+		if e.claims["sub"] == "bob" {
+			entry = e
+		}
+	}
+	cache.mu.Unlock()
+	if want := time.Unix(int64(soon), 0); !entry.expires.Equal(want) {
+		t.Errorf("cached until %v, want the token's exp %v", entry.expires, want)
+	}
+}
+
+func TestIntrospectionMiddleware(t *testing.T) {
+	srv := newIntrospectionServer(t, map[string]map[string]interface{}{
+		"opaque-active": {"active": true, "sub": "alice"},
+	})
+	h := OIDCMiddleware(OIDC{ClientID: "client", ClientSecret: "secret", Introspection: IntrospectionConfig{Endpoint: srv.URL}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(tokenContextKey) != nil {
+			t.Error("introspected request carries an ID token")
+		}
+		w.Write([]byte(ClaimsFromContext(r.Context())["sub"].(string)))
+	}))
+
+	tests := []struct {
+		token      string
+		wantStatus int
+	}{
+		{token: "opaque-active", wantStatus: http.StatusOK},
+		{token: "opaque-revoked", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d: %s", tt.token, rec.Code, tt.wantStatus, rec.Body)
+		}
+	}
+}
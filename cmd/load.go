@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads, expands and parses the config file at path, or stdin
+// if path is "-".
+func loadConfig(path string, strict bool) (Config, error) {
+	var config Config
+
+	data, err := readConfigFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	data, err = expandEnv(data)
+	if err != nil {
+		return config, fmt.Errorf("failed to expand config file %s: %w", path, err)
+	}
+
+	if err := unmarshalConfig(path, data, &config, strict); err != nil {
+		return config, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := checkConfigVersion(config.Version); err != nil {
+		return config, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// stdinPath is the config path that reads from stdin.
+const stdinPath = "-"
+
+// maxStdinConfigBytes caps how much config is read from stdin.
+const maxStdinConfigBytes = 10 << 20
+
+// stdin is where a "-" config path is read from.
+var stdin io.Reader = os.Stdin
+
+var stdinConfig struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// readConfigFile returns the contents of path. Stdin is read once and
+// remembered, so a reload sees the same config rather than an empty stream.
+func readConfigFile(path string) ([]byte, error) {
+	if path != stdinPath {
+		return os.ReadFile(path)
+	}
+	stdinConfig.once.Do(func() {
+		stdinConfig.data, stdinConfig.err = readLimited(stdin, maxStdinConfigBytes)
+	})
+	return stdinConfig.data, stdinConfig.err
+}
+
+// readLimited reads all of r, failing if it holds more than limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("config is larger than %d bytes", limit)
+	}
+	return data, nil
+}
+
+// configVersion is the config schema version this binary understands.
+// Files without a version field are treated as version 1.
+const configVersion = 1
+
+// checkConfigVersion refuses configs written for a different schema, whose
+// fields may have been renamed or removed.
+func checkConfigVersion(version int) error {
+	if version == 0 {
+		version = 1
+	}
+	if version != configVersion {
+		return fmt.Errorf("unsupported config version %d (this binary supports version %d)", version, configVersion)
+	}
+	return nil
+}
+
+// unmarshalConfig decodes data as JSON for .json files and as YAML
+// otherwise. YAML errors already carry a line number; JSON syntax errors
+// are given one.
+func unmarshalConfig(path string, data []byte, config *Config, strict bool) error {
+	// A blank file decodes to the zero config, for checkNotEmpty to report,
+	// even when its whitespace includes tabs that YAML would reject.
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if strict {
+			dec.DisallowUnknownFields()
+		}
+		err := dec.Decode(config)
+		if errors.Is(err, io.EOF) {
+			err = errors.New("unexpected end of JSON input")
+		} else if err == nil && dec.More() {
+			err = errors.New("unexpected data after the top-level value")
+		}
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// Offset counts the bytes read, including the offending one.
+			line, col := lineColumn(data, syntaxErr.Offset-1)
+			return fmt.Errorf("line %d, column %d: %w", line, col, err)
+		}
+		return err
+	}
+	return decodeYAML(data, config, strict)
+}
+
+// decodeYAML is yaml.Unmarshal, except that in strict mode a key that
+// doesn't match any field, such as a misspelled "isseur", is an error
+// rather than being silently dropped.
+func decodeYAML(data []byte, out interface{}, strict bool) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// lineColumn converts a byte offset in data to a 1-based line and column.
+func lineColumn(data []byte, offset int64) (line, col int) {
+	offset = max(0, min(offset, int64(len(data))))
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	col = int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// checkNotEmpty rejects a config that sets nothing at all, which is usually
+// an empty or mistyped file rather than intent.
+func checkNotEmpty(config Config, allowEmpty bool) error {
+	if allowEmpty || !reflect.ValueOf(config).IsZero() {
+		return nil
+	}
+	return errors.New("config is empty; pass -allow-empty to start without any settings")
+}
+
+// expandEnv replaces ${VAR} and $VAR references with values from the
+// environment. "$$" produces a literal "$". Referencing an unset variable is
+// an error rather than silently expanding to an empty string.
+func expandEnv(data []byte) ([]byte, error) {
+	missing := make(map[string]bool)
+	expanded := os.Expand(string(data), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing[name] = true
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("undefined environment variables: %s", strings.Join(names, ", "))
+	}
+	return []byte(expanded), nil
+}
+
+// loadConfigs loads every path, expanding directories to the *.yaml, *.yml
+// and *.json files they contain, and merges the results with mergeConfigs.
+// The overlays are then applied in order with applyOverlay.
+func loadConfigs(paths, overlays []string, strict bool) (Config, error) {
+	files, err := expandConfigPaths(paths)
+	if err != nil {
+		return Config{}, err
+	}
+
+	sources := make([]configSource, 0, len(files))
+	for _, path := range files {
+		config, err := loadConfig(path, strict)
+		if err != nil {
+			return Config{}, err
+		}
+		sources = append(sources, configSource{path: path, config: config})
+	}
+	config, err := mergeConfigs(sources)
+	if err != nil {
+		return Config{}, err
+	}
+	for _, overlay := range overlays {
+		if config, err = applyOverlay(config, overlay, strict); err != nil {
+			return Config{}, err
+		}
+	}
+	applyDefaults(&config)
+	if err := resolveSecretFiles(&config); err != nil {
+		return Config{}, err
+	}
+	// After the secrets, so endpoints inherit the top-level client secret
+	// rather than each reading its file.
+	applyRequireAuth(&config)
+	return config, nil
+}
+
+// resolveSecretFiles replaces inline secrets with the contents of their
+// *_file counterparts. A reload reads the files again, so rotated secrets
+// are picked up on SIGHUP.
+func resolveSecretFiles(config *Config) error {
+	var errs []error
+	resolve := func(field string, file string, secret *string) {
+		if file == "" {
+			return
+		}
+		value, err := readSecretFile(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+			return
+		}
+		*secret = value
+	}
+	for i := range config.Endpoints {
+		e := &config.Endpoints[i]
+		resolve(fmt.Sprintf("endpoints[%d] (%s): oidc.client_secret_file", i, e.Path), e.OIDC.ClientSecretFile, &e.OIDC.ClientSecret)
+	}
+	resolve("oidc.client_secret_file", config.OIDC.ClientSecretFile, &config.OIDC.ClientSecret)
+	resolve("admin.oidc.client_secret_file", config.Admin.OIDC.ClientSecretFile, &config.Admin.OIDC.ClientSecret)
+	resolve("debug.oidc.client_secret_file", config.Debug.OIDC.ClientSecretFile, &config.Debug.OIDC.ClientSecret)
+	resolve("session.secret_file", config.Session.SecretFile, &config.Session.Secret)
+	return errors.Join(errs...)
+}
+
+// readSecretFile returns the secret in path without trailing newlines.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading secret: %w", err)
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// applyDefaults fills every setting an endpoint leaves unset from the
+// defaults block. Nested blocks such as oidc are filled field by field, so an
+// endpoint can override just its issuer, say. Only zero values count as
+// unset, so a default can't be turned off for one endpoint by setting it to
+// false or "". The path is never inherited, and neither is oidc by public
+// endpoints. method and methods are one setting: an endpoint that sets
+// either inherits neither.
+func applyDefaults(config *Config) {
+	defaults := reflect.ValueOf(config.Defaults)
+	if defaults.IsZero() {
+		return
+	}
+	for i := range config.Endpoints {
+		e := &config.Endpoints[i]
+		path, public, oidc := e.Path, e.Public, e.OIDC
+		method, methods := e.Method, e.Methods
+		fillZero(reflect.ValueOf(e).Elem(), defaults)
+		e.Path = path
+		if public || e.Public {
+			e.OIDC = oidc
+		}
+		if method != "" || len(methods) > 0 {
+			e.Method, e.Methods = method, methods
+		}
+	}
+}
+
+// applyRequireAuth gives every endpoint that is neither public nor has an
+// oidc block of its own the top-level oidc block, when require_auth is set.
+func applyRequireAuth(config *Config) {
+	if !config.RequireAuth {
+		return
+	}
+	for i := range config.Endpoints {
+		e := &config.Endpoints[i]
+		if !e.Public && !e.OIDC.configured() {
+			e.OIDC = config.OIDC
+		}
+	}
+}
+
+// fillZero copies each field of src into dst where dst's is zero, recursing
+// into structs.
+func fillZero(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		d, s := dst.Field(i), src.Field(i)
+		switch {
+		case s.IsZero():
+		case d.Kind() == reflect.Struct:
+			fillZero(d, s)
+		case d.IsZero():
+			d.Set(s)
+		}
+	}
+}
+
+func expandConfigPaths(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		if path == stdinPath {
+			files = append(files, path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		var matches []string
+		for _, pattern := range []string{"*.yaml", "*.yml", "*.json"} {
+			m, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, m...)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("config directory %s contains no *.yaml, *.yml or *.json files", path)
+		}
+		sort.Strings(matches)
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+type configSource struct {
+	path   string
+	config Config
+}
+
+// mergeConfigs concatenates the endpoints of every source. A path and method
+// pair defined in more than one file is an error naming both files. Other
+// top-level settings may be set in any one file, or in several as long as
+// the values agree.
+func mergeConfigs(sources []configSource) (Config, error) {
+	var merged Config
+	setBy := make(map[string]string)
+	endpointSource := make(map[string]string)
+
+	for _, src := range sources {
+		mv := reflect.ValueOf(&merged).Elem()
+		sv := reflect.ValueOf(src.config)
+		for i := 0; i < sv.NumField(); i++ {
+			name := sv.Type().Field(i).Name
+			if name == "Endpoints" || sv.Field(i).IsZero() {
+				continue
+			}
+			if prev, ok := setBy[name]; ok {
+				if !reflect.DeepEqual(mv.Field(i).Interface(), sv.Field(i).Interface()) {
+					return Config{}, fmt.Errorf("%s is set to different values in %s and %s", yamlFieldName(sv.Type().Field(i)), prev, src.path)
+				}
+				continue
+			}
+			mv.Field(i).Set(sv.Field(i))
+			setBy[name] = src.path
+		}
+
+		for _, endpoint := range src.config.Endpoints {
+			for _, method := range endpoint.methodList() {
+				key := method + " " + endpoint.Path
+				if prev, ok := endpointSource[key]; ok && prev != src.path {
+					return Config{}, fmt.Errorf("endpoint %s is defined in both %s and %s", key, prev, src.path)
+				}
+				endpointSource[key] = src.path
+			}
+			merged.Endpoints = append(merged.Endpoints, endpoint)
+		}
+	}
+	return merged, nil
+}
+
+// applyOverlay deep-merges the overlay file at path onto config. Settings in
+// the overlay replace those in config, and nested blocks are merged key by
+// key, so an overlay can change one field of a block without repeating the
+// rest. Endpoints are matched by path: a matching endpoint is merged the
+// same way, and one with a new path is appended. Lists other than endpoints
+// are replaced wholesale.
+func applyOverlay(config Config, path string, strict bool) (Config, error) {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read overlay file %s: %w", path, err)
+	}
+	data, err = expandEnv(data)
+	if err != nil {
+		return config, fmt.Errorf("failed to expand overlay file %s: %w", path, err)
+	}
+	// JSON is valid YAML, so one decoder handles both.
+	var overlay map[string]interface{}
+	if err := yaml.Unmarshal(data, &overlay); err != nil {
+		return config, fmt.Errorf("failed to parse overlay file %s: %w", path, err)
+	}
+	// Decode it as a config too, only to catch unknown keys with their
+	// line numbers in the overlay itself.
+	if strict {
+		if err := decodeYAML(data, &Config{}, true); err != nil {
+			return config, fmt.Errorf("failed to parse overlay file %s: %w", path, err)
+		}
+	}
+
+	// Merge in the generic form so that an overlay can set a field back to
+	// its zero value, e.g. enabled: false.
+	var base map[string]interface{}
+	if err := roundTrip(config, &base); err != nil {
+		return config, err
+	}
+	mergeMaps(base, overlay, true)
+
+	var merged Config
+	if err := roundTrip(base, &merged); err != nil {
+		return config, fmt.Errorf("failed to apply overlay file %s: %w", path, err)
+	}
+	if err := checkConfigVersion(merged.Version); err != nil {
+		return config, fmt.Errorf("overlay file %s: %w", path, err)
+	}
+	return merged, nil
+}
+
+// roundTrip converts in to out through YAML.
+func roundTrip(in, out interface{}) error {
+	data, err := yaml.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, out)
+}
+
+// mergeMaps merges src into dst as described by applyOverlay. top is true for
+// the document root, where the endpoints list is merged by path.
+func mergeMaps(dst, src map[string]interface{}, top bool) {
+	for key, value := range src {
+		if top && key == "endpoints" {
+			dst[key] = mergeEndpoints(dst[key], value)
+			continue
+		}
+		srcMap, ok := value.(map[string]interface{})
+		dstMap, dstOK := dst[key].(map[string]interface{})
+		if ok && dstOK {
+			mergeMaps(dstMap, srcMap, false)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+func mergeEndpoints(dst, src interface{}) interface{} {
+	base, _ := dst.([]interface{})
+	overlay, ok := src.([]interface{})
+	if !ok {
+		return src
+	}
+	for _, o := range overlay {
+		oe, ok := o.(map[string]interface{})
+		if !ok {
+			base = append(base, o)
+			continue
+		}
+		merged := false
+		for _, b := range base {
+			if be, ok := b.(map[string]interface{}); ok && be["path"] == oe["path"] {
+				mergeMaps(be, oe, false)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			base = append(base, oe)
+		}
+	}
+	return base
+}
+
+func yamlFieldName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
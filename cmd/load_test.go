@@ -0,0 +1,818 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// writeFile writes content to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("CLIENT_SECRET", "s3cret")
+	t.Setenv("ISSUER_HOST", "idp.example.com")
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{name: "braces", in: "client_secret: ${CLIENT_SECRET}", want: "client_secret: s3cret"},
+		{name: "bare", in: "client_secret: $CLIENT_SECRET", want: "client_secret: s3cret"},
+		{name: "inside a value", in: "issuer: https://${ISSUER_HOST}/", want: "issuer: https://idp.example.com/"},
+		{name: "escaped dollar", in: "body: costs $$5", want: "body: costs $5"},
+		{name: "escaped reference", in: "body: $${CLIENT_SECRET}", want: "body: ${CLIENT_SECRET}"},
+		{name: "missing", in: "a: ${NOT_SET_1}\nb: $NOT_SET_2", wantErr: "undefined environment variables: NOT_SET_1, NOT_SET_2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnv([]byte(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expandEnv error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expandEnv(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigExpandsSecret(t *testing.T) {
+	t.Setenv("CLIENT_SECRET", "from-env")
+	path := writeFile(t, t.TempDir(), "config.yaml", `
+endpoints:
+  - path: /hello
+    method: GET
+    handler: handleHello
+    oidc:
+      issuer: https://idp.example.com
+      client_id: app
+      client_secret: ${CLIENT_SECRET}
+`)
+	config, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Endpoints[0].OIDC.ClientSecret; got != "from-env" {
+		t.Errorf("client_secret = %q, want %q", got, "from-env")
+	}
+}
+
+func TestJSONAndYAMLConfigsMatch(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := writeFile(t, dir, "config.yaml", `
+listen: ":9000"
+endpoints:
+  - path: /hello
+    methods: [GET, POST]
+    handler: handleHello
+    timeout: 5s
+    oidc:
+      issuer: https://idp.example.com
+      client_id: app
+      required_scopes: [read]
+      token_cache_size: 100
+  - path: /status
+    method: GET
+    handler: static
+    response:
+      status: 201
+      content_type: application/json
+      body: '{"ok":true}'
+`)
+	jsonPath := writeFile(t, dir, "config.json", `{
+  "listen": ":9000",
+  "endpoints": [
+    {
+      "path": "/hello",
+      "methods": ["GET", "POST"],
+      "handler": "handleHello",
+      "timeout": "5s",
+      "oidc": {
+        "issuer": "https://idp.example.com",
+        "client_id": "app",
+        "required_scopes": ["read"],
+        "token_cache_size": 100
+      }
+    },
+    {
+      "path": "/status",
+      "method": "GET",
+      "handler": "static",
+      "response": {"status": 201, "content_type": "application/json", "body": "{\"ok\":true}"}
+    }
+  ]
+}`)
+
+	fromYAML, err := loadConfig(yamlPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := loadConfig(jsonPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("configs differ:\nyaml: %+v\njson: %+v", fromYAML, fromJSON)
+	}
+}
+
+func TestJSONConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{name: "syntax error has a position", json: "{\n  \"listen\": \":9000\",\n}", wantErr: "line 3, column 1"},
+		{name: "unknown field", json: `{"endpoints": [{"path": "/a", "isseur": "x"}]}`, wantErr: `unknown field "isseur"`},
+		{name: "wrong type", json: `{"endpoints": [{"path": "/a", "response": {"status": "200"}}]}`, wantErr: "cannot unmarshal string"},
+		{name: "trailing data", json: `{} {}`, wantErr: "unexpected data after the top-level value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeFile(t, t.TempDir(), "config.json", tt.json), true)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadConfig error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{name: "matching", yaml: "version: 1\nlisten: :8080\n"},
+		{name: "missing", yaml: "listen: :8080\n"},
+		{name: "newer", yaml: "version: 2\nlisten: :8080\n", wantErr: "unsupported config version 2 (this binary supports version 1)"},
+		{name: "negative", yaml: "version: -1\n", wantErr: "unsupported config version -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, t.TempDir(), "config.yaml", tt.yaml)
+			_, err := loadConfig(path, true)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), path) {
+				t.Fatalf("loadConfig error = %v, want %q naming the file", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEmptyConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		wantEmpty bool
+	}{
+		{name: "empty file", yaml: "", wantEmpty: true},
+		{name: "whitespace only", yaml: "  \n\t\n\n", wantEmpty: true},
+		{name: "comments only", yaml: "# endpoints go here\n", wantEmpty: true},
+		{name: "settings without endpoints", yaml: "listen: \":9000\"\n"},
+		{name: "endpoints", yaml: "endpoints:\n  - path: /a\n    handler: static\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := loadYAML(t, tt.yaml)
+			err := checkNotEmpty(config, false)
+			if tt.wantEmpty != (err != nil) {
+				t.Fatalf("checkNotEmpty = %v, want empty %v", err, tt.wantEmpty)
+			}
+			if err != nil && !strings.Contains(err.Error(), "-allow-empty") {
+				t.Errorf("error %q does not mention -allow-empty", err)
+			}
+			if err := checkNotEmpty(config, true); err != nil {
+				t.Errorf("with -allow-empty: %v", err)
+			}
+		})
+	}
+}
+
+func TestMalformedYAMLHasLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{name: "missing colon", yaml: "endpoints:\n  - path: /a\n    handler: static\n  oops\n", wantErr: "line 4: could not find expected ':'"},
+		{name: "unclosed flow sequence", yaml: "listen: \":9000\"\nendpoints:\n  - path: /a\n    methods: [GET\n", wantErr: "line 3: did not find expected ',' or ']'"},
+		{name: "tab indentation", yaml: "listen: \":9000\"\n\nendpoints:\n\t- path: /a\n", wantErr: "line 4: found character that cannot start any token"},
+		{name: "nested mapping on one line", yaml: "listen: a\nserver: b: c\n", wantErr: "line 2: mapping values are not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeFile(t, t.TempDir(), "config.yaml", tt.yaml), true)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadConfig error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "base.yaml", `
+listen: ":8080"
+endpoints:
+  - path: /hello
+    method: GET
+    handler: handleHello
+    oidc:
+      issuer: https://idp.staging.example.com
+      client_id: app
+      optional: true
+      required_scopes: [read, write]
+  - path: /status
+    method: GET
+    handler: static
+`)
+	overlay := writeFile(t, dir, "prod.yaml", `
+listen: ":443"
+endpoints:
+  - path: /hello
+    oidc:
+      issuer: https://idp.example.com
+      optional: false
+      required_scopes: [read]
+  - path: /metrics-proxy
+    method: GET
+    handler: static
+`)
+
+	config, err := loadConfigs([]string{base}, []string{overlay}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Listen != ":443" {
+		t.Errorf("listen = %q, want the overlay's :443", config.Listen)
+	}
+	var paths []string
+	for _, e := range config.Endpoints {
+		paths = append(paths, e.Path)
+	}
+	if want := []string{"/hello", "/status", "/metrics-proxy"}; !slices.Equal(paths, want) {
+		t.Fatalf("endpoints = %v, want %v", paths, want)
+	}
+
+	hello := config.Endpoints[0]
+	if hello.OIDC.Issuer != "https://idp.example.com" {
+		t.Errorf("issuer = %q, want the overlay's", hello.OIDC.Issuer)
+	}
+	// Fields the overlay doesn't mention are kept; lists are replaced, and
+	// a field can be set back to its zero value.
+	if hello.Handler != HandlerHello || hello.OIDC.ClientID != "app" {
+		t.Errorf("handler, client_id = %q, %q; want the base values", hello.Handler, hello.OIDC.ClientID)
+	}
+	if hello.OIDC.Optional {
+		t.Error("optional still true after the overlay set it to false")
+	}
+	if !slices.Equal(hello.OIDC.RequiredScopes, []string{"read"}) {
+		t.Errorf("required_scopes = %v, want [read]", hello.OIDC.RequiredScopes)
+	}
+
+	typo := writeFile(t, dir, "typo.yaml", "endpoints:\n  - path: /hello\n    oidc: {isseur: x}\n")
+	if _, err := loadConfigs([]string{base}, []string{typo}, true); err == nil || !strings.Contains(err.Error(), "isseur") {
+		t.Errorf("overlay with an unknown key: error = %v", err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	config, err := loadConfigs([]string{writeFile(t, t.TempDir(), "config.yaml", `
+defaults:
+  method: GET
+  handler: handleHello
+  timeout: 5s
+  oidc:
+    issuer: https://idp.example.com
+    client_id: app
+    required_scopes: [read]
+endpoints:
+  - path: /inherits
+  - path: /own-issuer
+    oidc: {issuer: https://other.example.com}
+  - path: /own-methods
+    methods: [POST, PUT]
+  - path: /own-method
+    method: DELETE
+  - path: /own-handler
+    handler: static
+    timeout: 1s
+  - path: /public
+    public: true
+    handler: static
+`)}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byPath := make(map[string]Endpoint)
+	for _, e := range config.Endpoints {
+		byPath[e.Path] = e
+	}
+	tests := []struct {
+		path        string
+		wantMethods []string
+		wantHandler HandlerType
+		wantTimeout string
+		wantOIDC    OIDC
+	}{
+		{
+			path:        "/inherits",
+			wantMethods: []string{"GET"},
+			wantHandler: HandlerHello,
+			wantTimeout: "5s",
+			wantOIDC:    OIDC{Issuer: "https://idp.example.com", ClientID: "app", RequiredScopes: []string{"read"}},
+		},
+		{
+			// The oidc block merges field by field.
+			path:        "/own-issuer",
+			wantMethods: []string{"GET"},
+			wantHandler: HandlerHello,
+			wantTimeout: "5s",
+			wantOIDC:    OIDC{Issuer: "https://other.example.com", ClientID: "app", RequiredScopes: []string{"read"}},
+		},
+		{
+			// Setting methods drops the default method rather than
+			// adding to it.
+			path:        "/own-methods",
+			wantMethods: []string{"POST", "PUT"},
+			wantHandler: HandlerHello,
+			wantTimeout: "5s",
+			wantOIDC:    OIDC{Issuer: "https://idp.example.com", ClientID: "app", RequiredScopes: []string{"read"}},
+		},
+		{
+			path:        "/own-method",
+			wantMethods: []string{"DELETE"},
+			wantHandler: HandlerHello,
+			wantTimeout: "5s",
+			wantOIDC:    OIDC{Issuer: "https://idp.example.com", ClientID: "app", RequiredScopes: []string{"read"}},
+		},
+		{
+			path:        "/own-handler",
+			wantMethods: []string{"GET"},
+			wantHandler: HandlerStatic,
+			wantTimeout: "1s",
+			wantOIDC:    OIDC{Issuer: "https://idp.example.com", ClientID: "app", RequiredScopes: []string{"read"}},
+		},
+		{
+			path:        "/public",
+			wantMethods: []string{"GET"},
+			wantHandler: HandlerStatic,
+			wantTimeout: "5s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			e, ok := byPath[tt.path]
+			if !ok {
+				t.Fatalf("endpoint %s missing", tt.path)
+			}
+			if got := e.methodList(); !slices.Equal(got, tt.wantMethods) {
+				t.Errorf("methods = %v, want %v", got, tt.wantMethods)
+			}
+			if e.Handler != tt.wantHandler || e.Timeout != tt.wantTimeout {
+				t.Errorf("handler, timeout = %q, %q; want %q, %q", e.Handler, e.Timeout, tt.wantHandler, tt.wantTimeout)
+			}
+			if !reflect.DeepEqual(e.OIDC, tt.wantOIDC) {
+				t.Errorf("oidc = %+v, want %+v", e.OIDC, tt.wantOIDC)
+			}
+		})
+	}
+}
+
+func TestSharedOIDCBlocks(t *testing.T) {
+	data := []byte(`
+endpoints:
+  - path: /okta
+    method: GET
+    handler: handleHello
+    oidc: &google
+      issuer: https://accounts.google.com
+      client_id: YOUR_CLIENT_ID
+  - path: /someother
+    method: GET
+    handler: handleHello
+    oidc: *google
+  - path: /admin
+    method: GET
+    handler: handleHello
+    oidc:
+      <<: *google
+      required_scopes: [admin]
+`)
+	var config Config
+	if err := unmarshalConfig("config.yaml", data, &config, true); err != nil {
+		t.Fatal(err)
+	}
+	shared := OIDC{Issuer: "https://accounts.google.com", ClientID: "YOUR_CLIENT_ID"}
+	// The alias shares the anchored block as is; the merge key copies it
+	// and adds to it.
+	withScopes := shared
+	withScopes.RequiredScopes = []string{"admin"}
+	want := map[string]OIDC{"/okta": shared, "/someother": shared, "/admin": withScopes}
+
+	if len(config.Endpoints) != len(want) {
+		t.Fatalf("config has %d endpoints, want %d", len(config.Endpoints), len(want))
+	}
+	for _, e := range config.Endpoints {
+		if !reflect.DeepEqual(e.OIDC, want[e.Path]) {
+			t.Errorf("%s: oidc = %+v, want %+v", e.Path, e.OIDC, want[e.Path])
+		}
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SECRETS", dir)
+	writeFile(t, dir, "client-secret", "from-file\n")
+	writeFile(t, dir, "crlf-secret", "from-file\r\n")
+	writeFile(t, dir, "empty-secret", "\n")
+	tests := []struct {
+		name     string
+		oidc     string
+		session  string
+		want     string
+		wantSess string
+		wantErr  string
+	}{
+		{name: "file", oidc: "{client_secret_file: ${SECRETS}/client-secret}", want: "from-file"},
+		{name: "file over inline", oidc: "{client_secret: inline, client_secret_file: ${SECRETS}/client-secret}", want: "from-file"},
+		{name: "inline only", oidc: "{client_secret: inline}", want: "inline"},
+		{name: "crlf trimmed", oidc: "{client_secret_file: ${SECRETS}/crlf-secret}", want: "from-file"},
+		{name: "session secret over inline", session: "{secret: inline, secret_file: ${SECRETS}/client-secret}", wantSess: "from-file"},
+		{name: "missing file", oidc: "{client_secret_file: ${SECRETS}/missing}", wantErr: "endpoints[0] (/hello): oidc.client_secret_file: reading secret:"},
+		{name: "empty file", oidc: "{client_secret_file: ${SECRETS}/empty-secret}", wantErr: "empty-secret is empty"},
+		{name: "missing session file", session: "{secret_file: ${SECRETS}/missing}", wantErr: "session.secret_file: reading secret:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "endpoints:\n  - {path: /hello, method: GET, handler: handleHello, oidc: {issuer: https://idp.example.com, client_id: app}}\n"
+			if tt.oidc != "" {
+				text = "defaults:\n  oidc: " + tt.oidc + "\n" + text
+			}
+			if tt.session != "" {
+				text += "session: " + tt.session + "\n"
+			}
+			config, err := loadConfigs([]string{writeFile(t, t.TempDir(), "config.yaml", text)}, nil, true)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("load error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.Endpoints[0].OIDC.ClientSecret; got != tt.want {
+				t.Errorf("client_secret = %q, want %q", got, tt.want)
+			}
+			if got := config.Session.Secret; got != tt.wantSess {
+				t.Errorf("session.secret = %q, want %q", got, tt.wantSess)
+			}
+		})
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	t.Setenv("ISSUER", p.Issuer())
+	t.Setenv("CLIENT_ID", p.ClientID)
+	misspelled := `
+endpoints:
+  - path: /hello
+    method: GET
+    handler: handleHello
+    oidc:
+      issuer: $ISSUER
+      isseur: https://typo.example.com
+      client_id: $CLIENT_ID
+`
+	tests := []struct {
+		name     string
+		file     string
+		config   string
+		overlay  string
+		lax      bool
+		wantErr  string
+		wantPath string
+	}{
+		{name: "misspelled nested key", file: "config.yaml", config: misspelled, wantErr: "line 8: field isseur not found in type main.OIDC"},
+		{name: "misspelled top-level key", file: "config.yaml", config: "endpoint:\n  - {path: /hello}\n", wantErr: "line 1: field endpoint not found in type main.Config"},
+		{name: "misspelled JSON key", file: "config.json", config: `{"endpoints": [{"path": "/hello", "methd": "GET"}]}`, wantErr: `json: unknown field "methd"`},
+		{name: "lax", file: "config.yaml", config: misspelled, lax: true, wantPath: "/hello"},
+		{name: "lax overlay", file: "config.yaml", config: misspelled, overlay: "logging:\n  levle: debug\n", lax: true, wantPath: "/hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sources := configSources{paths: []string{writeFile(t, dir, tt.file, tt.config)}, lax: tt.lax}
+			if tt.overlay != "" {
+				sources.overlays = []string{writeFile(t, dir, "overlay.yaml", tt.overlay)}
+			}
+			config, err := sources.load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("load error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The extra key is ignored and the endpoint works as configured.
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.wantPath, nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "alice"}))
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Body.String() != "Hello, alice!" {
+				t.Errorf("GET %s = %d %q", tt.wantPath, rec.Code, rec.Body)
+			}
+		})
+	}
+
+	// An overlay's own unknown keys are reported against the overlay.
+	dir := t.TempDir()
+	sources := configSources{
+		paths:    []string{writeFile(t, dir, "config.yaml", "error_format: json\n")},
+		overlays: []string{writeFile(t, dir, "overlay.yaml", "logging:\n  levle: debug\n")},
+	}
+	if _, err := sources.load(); err == nil || !strings.Contains(err.Error(), "overlay.yaml") || !strings.Contains(err.Error(), "line 2: field levle not found") {
+		t.Errorf("overlay with an unknown key: error = %v", err)
+	}
+}
+
+// setStdin makes a "-" config path read r, as if it were piped in.
+func setStdin(t *testing.T, r io.Reader) {
+	t.Helper()
+	stdin, stdinConfig.once = r, sync.Once{}
+	t.Cleanup(func() { stdin, stdinConfig.once = os.Stdin, sync.Once{} })
+}
+
+func TestStdinConfig(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	t.Setenv("ISSUER", p.Issuer())
+	piped := `
+endpoints:
+  - path: /hello
+    method: GET
+    handler: handleHello
+    oidc: {issuer: $ISSUER, client_id: ` + p.ClientID + `}
+  - path: /status
+    method: GET
+    handler: static
+    response: {body: ok}
+`
+	tests := []struct {
+		name      string
+		stdin     string
+		files     map[string]string
+		wantPaths []string
+		wantErr   string
+	}{
+		{name: "endpoints", stdin: piped, wantPaths: []string{"/hello", "/status"}},
+		{name: "alongside a file", stdin: piped, files: map[string]string{"extra.yaml": "endpoints: [{path: /extra, method: GET, handler: static}]"}, wantPaths: []string{"/hello", "/status", "/extra"}},
+		{name: "unset variable", stdin: "endpoints: [{path: $UNSET_STDIN_PATH}]", wantErr: "UNSET_STDIN_PATH"},
+		{name: "unknown handler", stdin: "endpoints: [{path: /hello, handler: statik}]", wantErr: `line 1: unknown handler "statik"`},
+		{name: "invalid", stdin: "endpoints: [{path: /hello, method: GET}]", wantErr: "endpoints[0] (/hello): handler function not found"},
+		{name: "empty", stdin: "", wantErr: "config is empty"},
+		{name: "too large", stdin: "#" + strings.Repeat(" ", maxStdinConfigBytes), wantErr: fmt.Sprintf("config is larger than %d bytes", maxStdinConfigBytes)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setStdin(t, strings.NewReader(tt.stdin))
+			sources := configSources{paths: []string{stdinPath}}
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				sources.paths = append(sources.paths, writeFile(t, dir, name, content))
+			}
+			config, err := sources.load()
+			if err == nil {
+				err = config.Validate()
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("load error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, e := range config.Endpoints {
+				paths = append(paths, e.Path)
+			}
+			if !slices.Equal(paths, tt.wantPaths) {
+				t.Errorf("endpoints = %v, want %v", paths, tt.wantPaths)
+			}
+
+			// Stdin is drained by the first load; a reload sees the same
+			// config.
+			reloaded, err := sources.load()
+			if err != nil || len(reloaded.Endpoints) != len(config.Endpoints) {
+				t.Fatalf("reload = %d endpoints, %v", len(reloaded.Endpoints), err)
+			}
+			s := newTestServer(t, reloaded)
+			if err := s.Reload(reloaded); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+			req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": "alice"}))
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Body.String() != "Hello, alice!" {
+				t.Errorf("GET /hello = %d %q", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	p, other := oidctest.NewProvider(t), oidctest.NewProvider(t)
+	dir := t.TempDir()
+	secretPath := writeFile(t, dir, "client-secret", "s3cret\n")
+	path := writeFile(t, dir, "config.yaml", `
+require_auth: true
+oidc:
+  issuer: `+p.Issuer()+`
+  client_id: `+p.ClientID+`
+  client_secret_file: `+secretPath+`
+defaults:
+  method: GET
+  handler: static
+  response: {body: ok}
+endpoints:
+  - path: /reports
+  - path: /hello
+    handler: handleHello
+  - path: /status
+    public: true
+  - path: /partner
+    oidc: {issuer: "`+other.Issuer()+`", client_id: "`+other.ClientID+`"}
+`)
+	config, err := loadConfigs([]string{path}, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	secrets := map[string]string{"/reports": "s3cret", "/hello": "s3cret", "/status": "", "/partner": ""}
+	for _, e := range config.Endpoints {
+		if got := e.OIDC.ClientSecret; got != secrets[e.Path] {
+			t.Errorf("%s: client secret = %q, want %q", e.Path, got, secrets[e.Path])
+		}
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := p.SignToken(map[string]interface{}{"sub": "alice"})
+	partner := other.SignToken(map[string]interface{}{"sub": "acme"})
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "inherited without a token", path: "/reports", wantStatus: http.StatusUnauthorized},
+		{name: "inherited", path: "/reports", token: alice, wantStatus: http.StatusOK, wantBody: "ok"},
+		{name: "inherited by handleHello", path: "/hello", token: alice, wantStatus: http.StatusOK, wantBody: "Hello, alice!"},
+		{name: "public", path: "/status", wantStatus: http.StatusOK, wantBody: "ok"},
+		{name: "override rejects the global issuer", path: "/partner", token: alice, wantStatus: http.StatusUnauthorized},
+		{name: "override", path: "/partner", token: partner, wantStatus: http.StatusOK, wantBody: "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("GET %s = %d, want %d: %s", tt.path, rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestRequireAuthValidation(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	global := "require_auth: true\noidc: {issuer: \"" + p.Issuer() + "\", client_id: app}\n"
+	tests := []struct {
+		name     string
+		yaml     string
+		wantErrs []string
+		notErrs  []string
+	}{
+		{
+			name:     "public with an oidc block",
+			yaml:     global + "endpoints:\n  - {path: /x, method: GET, handler: static, public: true, oidc: {issuer: \"" + p.Issuer() + "\", client_id: app}}\n",
+			wantErrs: []string{"public endpoints cannot have an oidc block"},
+		},
+		{
+			name:     "public handleHello",
+			yaml:     global + "endpoints:\n  - {path: /hello, method: GET, handler: handleHello, public: true}\n",
+			wantErrs: []string{"endpoints[0] (/hello): public endpoints cannot use handleHello"},
+			notErrs:  []string{"oidc.issuer is required", "oidc.client_id is required"},
+		},
+		{
+			name:     "public handleHello with defaults",
+			yaml:     global + "defaults: {oidc: {issuer: \"" + p.Issuer() + "\", client_id: app}}\nendpoints:\n  - {path: /hello, method: GET, handler: handleHello, public: true}\n",
+			wantErrs: []string{"public endpoints cannot use handleHello"},
+			notErrs:  []string{"cannot have an oidc block"},
+		},
+		{
+			name:     "without the oidc block",
+			yaml:     "require_auth: true\nendpoints:\n  - {path: /x, method: GET, handler: static}\n",
+			wantErrs: []string{"require_auth needs oidc.issuer", "require_auth needs oidc.client_id"},
+		},
+		{
+			name:     "oidc block without require_auth",
+			yaml:     "oidc: {issuer: \"" + p.Issuer() + "\", client_id: app}\nendpoints:\n  - {path: /x, method: GET, handler: static}\n",
+			wantErrs: []string{"oidc is only used with require_auth: true"},
+		},
+		{
+			name: "valid",
+			yaml: global + "endpoints:\n  - {path: /x, method: GET, handler: static, public: true}\n  - {path: /hello, method: GET, handler: handleHello}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadConfigs([]string{writeFile(t, t.TempDir(), "config.yaml", tt.yaml)}, nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = config.Validate()
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate succeeded, want %q", tt.wantErrs)
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q lacks %q", err, want)
+				}
+			}
+			for _, unwanted := range tt.notErrs {
+				if strings.Contains(err.Error(), unwanted) {
+					t.Errorf("error %q reports %q", err, unwanted)
+				}
+			}
+		})
+	}
+
+	// A missing top-level secret file is reported once, not per endpoint.
+	path := writeFile(t, t.TempDir(), "config.yaml", "require_auth: true\noidc: {issuer: \""+p.Issuer()+"\", client_id: app, client_secret_file: /nonexistent/secret}\n"+
+		"endpoints:\n  - {path: /a, method: GET, handler: static}\n  - {path: /b, method: GET, handler: static}\n")
+	_, err := loadConfigs([]string{path}, nil, true)
+	if err == nil || strings.Count(err.Error(), "client_secret_file") != 1 || !strings.HasPrefix(err.Error(), "oidc.client_secret_file: ") {
+		t.Errorf("missing oidc.client_secret_file: error = %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// LoginConfig configures the login and callback handlers, which implement
+// the OIDC authorization code flow with PKCE. Both endpoints need the same
+// login block and the provider settings from their oidc block, e.g.
+//
+//	endpoints:
+//	  - path: /login
+//	    method: GET
+//	    handler: login
+//	    oidc: &idp {issuer: ..., client_id: ..., client_secret: ...}
+//	    login: &login {redirect_url: https://app.example.com/callback}
+//	  - path: /callback
+//	    method: GET
+//	    handler: callback
+//	    oidc: *idp
+//	    login: *login
+type LoginConfig struct {
+	// RedirectURL is the absolute URL of the callback endpoint, as
+	// registered with the provider.
+	RedirectURL string `yaml:"redirect_url" json:"redirect_url"`
+	// LandingPath is where the callback sends the browser once the ID
+	// token cookie is set (default "/").
+	LandingPath string `yaml:"landing_path" json:"landing_path"`
+	// Scopes are requested in addition to "openid".
+	Scopes []string `yaml:"scopes" json:"scopes"`
+	// TokenCookie names the cookie holding the ID token (default
+	// "id_token"); protected endpoints can read it with
+	// token_source: cookie:<name>.
+	TokenCookie string `yaml:"token_cookie" json:"token_cookie"`
+	// StateSecret signs the state cookie. When empty a random key is used,
+	// which only works if the callback reaches the same instance.
+	StateSecret string `yaml:"state_secret" json:"state_secret"`
+}
+
+const (
+	defaultTokenCookie = "id_token"
+	stateCookieName    = "oidc_login_state"
+	stateCookieTTL     = 10 * time.Minute
+)
+
+func (l LoginConfig) tokenCookie() string {
+	if l.TokenCookie != "" {
+		return l.TokenCookie
+	}
+	return defaultTokenCookie
+}
+
+func (l LoginConfig) landingPath() string {
+	if l.LandingPath != "" {
+		return l.LandingPath
+	}
+	return "/"
+}
+
+func (l LoginConfig) stateKey() []byte {
+	if l.StateSecret == "" {
+		return processStateKey
+	}
+	key := sha256.Sum256([]byte(l.StateSecret))
+	return key[:]
+}
+
+// processStateKey signs state cookies when no state_secret is configured.
+var processStateKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+func init() {
+	RegisterHandler(HandlerLogin, newLoginHandler)
+	RegisterHandler(HandlerCallback, newCallbackHandler)
+}
+
+// loginHandlers are the handlers that use the oidc block to sign users in
+// rather than to require a token.
+var loginHandlers = map[HandlerType]bool{HandlerLogin: true, HandlerCallback: true}
+
+// loginFlow holds what the login and callback handlers share.
+type loginFlow struct {
+	oidc  OIDC
+	login LoginConfig
+}
+
+func newLoginFlow(endpoint Endpoint) (*loginFlow, error) {
+	if len(endpoint.OIDC.issuerList()) != 1 {
+		return nil, errors.New("login requires exactly one oidc.issuer")
+	}
+	if endpoint.OIDC.ClientID == "" {
+		return nil, errors.New("login requires oidc.client_id")
+	}
+	if endpoint.OIDC.JWKSFile != "" {
+		return nil, errors.New("login needs a discoverable provider and cannot use oidc.jwks_file")
+	}
+	if endpoint.Login.RedirectURL == "" {
+		return nil, errors.New("login requires login.redirect_url")
+	}
+	if err := validateURL(endpoint.Login.RedirectURL); err != nil {
+		return nil, fmt.Errorf("login.redirect_url: %w", err)
+	}
+	return &loginFlow{oidc: endpoint.OIDC, login: endpoint.Login}, nil
+}
+
+// oauth2Config discovers the provider and returns the client configuration
+// for it, along with the context to use for calls to the provider.
+func (f *loginFlow) oauth2Config(ctx context.Context) (*oauth2.Config, context.Context, error) {
+	issuer := f.oidc.issuerList()[0]
+	key := f.oidc.verifierKey(issuer).providerKey
+	info, err := providers.provider(ctx, key, f.oidc.discoveryAttempts())
+	if err != nil {
+		return nil, nil, &discoveryError{err: err}
+	}
+	client, err := key.tls.client()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &oauth2.Config{
+		ClientID:     f.oidc.ClientID,
+		ClientSecret: f.oidc.ClientSecret,
+		Endpoint:     info.provider.Endpoint(),
+		RedirectURL:  f.login.RedirectURL,
+		Scopes:       append([]string{oidc.ScopeOpenID}, f.login.Scopes...),
+	}
+	return config, context.WithValue(ctx, oauth2.HTTPClient, client), nil
+}
+
+// newLoginHandler redirects the browser to the provider, remembering the
+// state and PKCE verifier in a short-lived signed cookie.
+func newLoginHandler(endpoint Endpoint) (http.HandlerFunc, error) {
+	flow, err := newLoginFlow(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		config, _, err := flow.oauth2Config(r.Context())
+		if err != nil {
+			slog.Error("login: provider discovery failed", "path", endpoint.Path, "error", err)
+			writeError(w, http.StatusServiceUnavailable, "OIDC provider discovery failed")
+			return
+		}
+
+		state := oauth2.GenerateVerifier()
+		verifier := oauth2.GenerateVerifier()
+		expires := time.Now().Add(stateCookieTTL)
+		value := signValue(flow.login.stateKey(), strings.Join([]string{state, verifier, strconv.FormatInt(expires.Unix(), 10)}, "|"))
+		http.SetCookie(w, &http.Cookie{
+			Name:     stateCookieName,
+			Value:    value,
+			Path:     "/",
+			Expires:  expires,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, config.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+	}, nil
+}
+
+// newCallbackHandler completes the login: it checks the state, exchanges the
+// code for tokens, verifies the ID token and starts a session, or, without
+// sessions configured, stores the ID token itself in a cookie.
+func newCallbackHandler(endpoint Endpoint) (http.HandlerFunc, error) {
+	flow, err := newLoginFlow(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if errCode := query.Get("error"); errCode != "" {
+			writeError(w, http.StatusUnauthorized, "Login failed: "+errCode)
+			return
+		}
+
+		verifier, err := flow.checkState(r, query.Get("state"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid login state: "+err.Error())
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: stateCookieName, Path: "/", MaxAge: -1})
+
+		config, ctx, err := flow.oauth2Config(r.Context())
+		if err != nil {
+			slog.Error("callback: provider discovery failed", "path", endpoint.Path, "error", err)
+			writeError(w, http.StatusServiceUnavailable, "OIDC provider discovery failed")
+			return
+		}
+		token, err := config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(verifier))
+		if err != nil {
+			slog.Error("callback: code exchange failed", "path", endpoint.Path, "error", err)
+			writeError(w, http.StatusBadGateway, "Failed to exchange authorization code")
+			return
+		}
+		rawIDToken, _ := token.Extra("id_token").(string)
+		if rawIDToken == "" {
+			writeError(w, http.StatusBadGateway, "Provider returned no ID token")
+			return
+		}
+		idToken, err := providers.verify(r.Context(), flow.oidc, rawIDToken)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, "Failed to verify token: "+err.Error())
+			return
+		}
+
+		if store := sessions.Load(); store != nil {
+			claims, err := tokenClaims(idToken)
+			if err == nil {
+				err = store.save(w, r, claims, flow.oidc.ClientID, idToken.Expiry)
+			}
+			if err != nil {
+				slog.Error("callback: saving session failed", "path", endpoint.Path, "error", err)
+				writeError(w, http.StatusInternalServerError, "Failed to start session")
+				return
+			}
+			http.Redirect(w, r, flow.login.landingPath(), http.StatusFound)
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     flow.login.tokenCookie(),
+			Value:    rawIDToken,
+			Path:     "/",
+			Expires:  idToken.Expiry,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, flow.login.landingPath(), http.StatusFound)
+	}, nil
+}
+
+// checkState validates the state cookie against the state the provider
+// echoed back and returns the PKCE verifier stored with it.
+func (f *loginFlow) checkState(r *http.Request, state string) (string, error) {
+	cookie, err := r.Cookie(stateCookieName)
+	if err != nil {
+		return "", errors.New("state cookie missing")
+	}
+	payload, ok := verifyValue(f.login.stateKey(), cookie.Value)
+	if !ok {
+		return "", errors.New("state cookie signature mismatch")
+	}
+	parts := strings.Split(payload, "|")
+	if len(parts) != 3 {
+		return "", errors.New("state cookie malformed")
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", errors.New("state cookie expired")
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(parts[0])) != 1 {
+		return "", errors.New("state mismatch")
+	}
+	return parts[1], nil
+}
+
+// signValue returns value with an HMAC-SHA256 signature appended, both
+// base64url encoded.
+func signValue(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(value)) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// verifyValue reverses signValue, reporting false if the signature doesn't
+// match.
+func verifyValue(key []byte, signed string) (string, bool) {
+	encValue, encSig, ok := strings.Cut(signed, ".")
+	if !ok {
+		return "", false
+	}
+	enc := base64.RawURLEncoding
+	value, err := enc.DecodeString(encValue)
+	if err != nil {
+		return "", false
+	}
+	sig, err := enc.DecodeString(encSig)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(value)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	return string(value), true
+}
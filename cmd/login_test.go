@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// loginServer serves config with /login and /callback against p added.
+// Without a session block the ID token is kept in a cookie.
+func loginServer(t *testing.T, p *oidctest.Provider, config Config) *Server {
+	t.Helper()
+	oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, ClientSecret: "s3cret"}
+	login := LoginConfig{RedirectURL: "https://app.example.com/callback", LandingPath: "/home", StateSecret: "state-key"}
+	config.Endpoints = append(config.Endpoints,
+		Endpoint{Path: "/login", Method: http.MethodGet, Handler: HandlerLogin, OIDC: oidcConfig, Login: login},
+		Endpoint{Path: "/callback", Method: http.MethodGet, Handler: HandlerCallback, OIDC: oidcConfig, Login: login},
+	)
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// startLogin requests /login and follows the redirect to the provider,
+// returning the state cookie and the callback URL the provider sent the
+// browser back to.
+func startLogin(t *testing.T, s *Server) (*http.Cookie, *url.URL) {
+	t.Helper()
+	rec := get(s, "/login")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("GET /login = %d: %s", rec.Code, rec.Body)
+	}
+	var state *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == stateCookieName {
+			state = c
+		}
+	}
+	if state == nil || !state.HttpOnly {
+		t.Fatalf("login set no HttpOnly state cookie: %v", rec.Result().Cookies())
+	}
+	authURL, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := authURL.Query().Get("code_challenge_method"); got != "S256" {
+		t.Errorf("code_challenge_method = %q, want S256", got)
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noFollow.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, err := resp.Location()
+	if err != nil {
+		t.Fatalf("provider did not redirect back (status %d): %v", resp.StatusCode, err)
+	}
+	return state, callback
+}
+
+// completeLogin runs the login flow through to the callback, which must
+// redirect to the landing path. It returns the callback request and
+// response.
+func completeLogin(t *testing.T, s *Server) (*http.Request, *httptest.ResponseRecorder) {
+	t.Helper()
+	state, callback := startLogin(t, s)
+	req := httptest.NewRequest(http.MethodGet, "/callback?"+callback.RawQuery, nil)
+	req.AddCookie(state)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/home" {
+		t.Fatalf("GET /callback = %d to %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	return req, rec
+}
+
+func TestLoginRoundTrip(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	p.LoginClaims = map[string]interface{}{"sub": "alice", "email": "alice@example.com"}
+	s := loginServer(t, p, Config{})
+
+	req, rec := completeLogin(t, s)
+
+	var idToken string
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == defaultTokenCookie {
+			idToken = c.Value
+		}
+	}
+	token, err := providers.verify(context.Background(), OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}, idToken)
+	if err != nil {
+		t.Fatalf("ID token cookie does not verify: %v", err)
+	}
+	if token.Subject != "alice" {
+		t.Errorf("subject = %q, want alice", token.Subject)
+	}
+
+	// The code is single use.
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("replayed callback = %d, want 502", rec.Code)
+	}
+}
+
+func TestCallbackRejectsBadState(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	p.LoginClaims = map[string]interface{}{"sub": "alice"}
+	s := loginServer(t, p, Config{})
+
+	tests := []struct {
+		name       string
+		tamper     func(q url.Values, state *http.Cookie) *http.Cookie
+		wantStatus int
+		wantReason string
+	}{
+		{
+			name:       "state cookie missing",
+			tamper:     func(url.Values, *http.Cookie) *http.Cookie { return nil },
+			wantStatus: http.StatusBadRequest,
+			wantReason: "state cookie missing",
+		},
+		{
+			name: "state cookie tampered",
+			tamper: func(_ url.Values, state *http.Cookie) *http.Cookie {
+				state.Value = "x" + state.Value
+				return state
+			},
+			wantStatus: http.StatusBadRequest,
+			wantReason: "state cookie signature mismatch",
+		},
+		{
+			name: "state parameter changed",
+			tamper: func(q url.Values, state *http.Cookie) *http.Cookie {
+				q.Set("state", "forged")
+				return state
+			},
+			wantStatus: http.StatusBadRequest,
+			wantReason: "state mismatch",
+		},
+		{
+			name: "provider reports an error",
+			tamper: func(q url.Values, state *http.Cookie) *http.Cookie {
+				q.Set("error", "access_denied")
+				return state
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantReason: "Login failed: access_denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, callback := startLogin(t, s)
+			q := callback.Query()
+			cookie := tt.tamper(q, state)
+			req := httptest.NewRequest(http.MethodGet, "/callback?"+q.Encode(), nil)
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantReason) {
+				t.Errorf("body %q does not contain %q", rec.Body, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestLoginClientSecretFile(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	p.ClientSecret = "from-file"
+	p.LoginClaims = map[string]interface{}{"sub": "alice"}
+	dir := t.TempDir()
+	t.Setenv("SECRET_PATH", writeFile(t, dir, "client-secret", "from-file\n"))
+	t.Setenv("ISSUER", p.Issuer())
+	t.Setenv("CLIENT_ID", p.ClientID)
+
+	tests := []struct {
+		name       string
+		secret     string
+		wantStatus int
+	}{
+		{name: "file over inline", secret: "{client_secret: stale, client_secret_file: ${SECRET_PATH}}", wantStatus: http.StatusFound},
+		{name: "inline only", secret: "{client_secret: stale}", wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, t.TempDir(), "config.yaml", `
+defaults:
+  oidc: `+tt.secret+`
+  login: {redirect_url: https://app.example.com/callback, landing_path: /home, state_secret: state-key}
+endpoints:
+  - {path: /login, method: GET, handler: login, oidc: {issuer: "${ISSUER}", client_id: "${CLIENT_ID}"}}
+  - {path: /callback, method: GET, handler: callback, oidc: {issuer: "${ISSUER}", client_id: "${CLIENT_ID}"}}
+`)
+			config, err := loadConfigs([]string{path}, nil, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+
+			state, callback := startLogin(t, s)
+			req := httptest.NewRequest(http.MethodGet, "/callback?"+callback.RawQuery, nil)
+			req.AddCookie(state)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("GET /callback = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
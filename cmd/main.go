@@ -2,130 +2,277 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
-
-	"github.com/coreos/go-oidc/v3/oidc"
-	"github.com/gorilla/mux"
-	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
-type Endpoint struct {
-	Path    string `yaml:"path"`
-	Method  string `yaml:"method"`
-	Handler string `yaml:"handler"`
-	OIDC    OIDC   `yaml:"oidc"`
-}
+const defaultConfigPath = "./config.yaml"
 
-type OIDC struct {
-	Issuer       string `yaml:"issuer"`
-	ClientID     string `yaml:"client_id"`
-	ClientSecret string `yaml:"client_secret"`
-}
+// stringList is a flag.Value that collects every occurrence of a flag.
+type stringList []string
 
-type Config struct {
-	Endpoints []Endpoint `yaml:"endpoints"`
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-type Server struct {
-	router *mux.Router
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
-func NewServer() *Server {
-	return &Server{
-		router: mux.NewRouter(),
+// resolveConfigPaths picks the config file paths from the flag, the
+// CONFIG_PATH environment variable or the default, in that order of
+// precedence.
+func resolveConfigPaths(flagValues []string) []string {
+	if len(flagValues) > 0 {
+		return flagValues
 	}
+	if env := os.Getenv("CONFIG_PATH"); env != "" {
+		return []string{env}
+	}
+	return []string{defaultConfigPath}
 }
 
-func (s *Server) RegisterEndpoint(endpoint Endpoint) error {
-	handlerFunc, err := getHandlerFunc(endpoint.Handler, endpoint.OIDC)
-	if err != nil {
-		return err
+// resolveListenAddr picks the listen address from the flag, the LISTEN_ADDR
+// environment variable or the config file, in that order of precedence.
+func resolveListenAddr(flagValue string, config Config) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if env := os.Getenv("LISTEN_ADDR"); env != "" {
+		return env
+	}
+	if config.Listen != "" {
+		return config.Listen
 	}
+	return defaultListenAddr
+}
 
-	s.router.HandleFunc(endpoint.Path, handlerFunc).Methods(endpoint.Method)
+// validateListenAddr accepts a TCP host:port or a "unix:<path>" socket.
+func validateListenAddr(addr string) error {
+	if strings.HasPrefix(addr, "unix:") {
+		if _, ok := unixSocketPath(addr); !ok {
+			return fmt.Errorf("invalid listen address %q: missing socket path", addr)
+		}
+		return nil
+	}
 
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
 	return nil
 }
 
-func (s *Server) Start() error {
-	fmt.Println("Listening on port 8080...")
-	err := http.ListenAndServe(":8080", s.router)
+// configSources is where the config comes from, as given on the command
+// line, so that a reload reads the same files.
+type configSources struct {
+	paths      []string
+	overlays   []string
+	allowEmpty bool
+	// lax accepts unknown config keys instead of rejecting them.
+	lax bool
+}
+
+func (c configSources) load() (Config, error) {
+	config, err := loadConfigs(c.paths, c.overlays, !c.lax)
 	if err != nil {
-		return err
+		return Config{}, err
 	}
-
-	return nil
+	if err := checkNotEmpty(config, c.allowEmpty); err != nil {
+		return Config{}, err
+	}
+	return config, nil
 }
 
 func main() {
-	// Load the YAML configuration file
-	configBytes, err := ioutil.ReadFile("./config.yaml")
-	if err != nil {
-		log.Fatal(err)
+	var configFlags, overlayFlags stringList
+	flag.Var(&configFlags, "config", "path to a config file or directory, or - for stdin; may be repeated (overrides CONFIG_PATH)")
+	flag.Var(&overlayFlags, "overlay", "path to a config file deep-merged over the config; may be repeated")
+	listenFlag := flag.String("listen", "", "address to listen on (overrides LISTEN_ADDR and the config file)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 0, "grace period for in-flight requests on shutdown (overrides server.shutdown_timeout; default 15s)")
+	validateOnly := flag.Bool("validate", false, "validate the config and exit without starting the server")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	allowEmpty := flag.Bool("allow-empty", false, "start even if the config defines nothing")
+	quiet := flag.Bool("quiet", false, "only log errors (overrides logging.level)")
+	lax := flag.Bool("lax", false, "ignore unknown config keys instead of failing")
+	flag.Parse()
+
+	if *showVersion || flag.Arg(0) == "version" {
+		fmt.Println(versionString())
+		return
+	}
+
+	sources := configSources{
+		paths:      resolveConfigPaths(configFlags),
+		overlays:   overlayFlags,
+		allowEmpty: *allowEmpty,
+		lax:        *lax,
+	}
+	if *validateOnly {
+		os.Exit(runValidate(sources, *listenFlag, os.Stdout, os.Stderr))
 	}
 
-	var config Config
-	err = yaml.Unmarshal(configBytes, &config)
+	// Load the YAML configuration files
+	config, err := sources.load()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	if *quiet {
+		config.Logging.Level = "error"
+	}
+
+	if err := config.Validate(); err != nil {
+		fatal(fmt.Errorf("invalid configuration:\n%w", err))
+	}
+
+	// Resolve and validate the listen address
+	addr := resolveListenAddr(*listenFlag, config)
+	if err := validateListenAddr(addr); err != nil {
+		fatal(err)
+	}
+
+	grace := mustParseDuration(config.Server.ShutdownTimeout, defaultShutdownTimeout)
+	if *shutdownTimeout > 0 {
+		grace = *shutdownTimeout
+	}
+
+	// Open the audit log before any request can be authenticated
+	if err := openAuditLog(config.Audit); err != nil {
+		fatal(err)
 	}
 
-	// Create a new server
-	server := NewServer()
+	// Create a new server; from here on slog.Default is its logger.
+	server := NewServer(addr, config)
+	logger := slog.Default()
 
 	// Register each endpoint with the server
 	for _, endpoint := range config.Endpoints {
 		err := server.RegisterEndpoint(endpoint)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
+	logEndpoints(logger, config.Endpoints)
+	server.WarmUp()
+	server.MarkReady()
 
-	// Start the server
-	err = server.Start()
-	if err != nil {
-		log.Fatal(err)
-	}
-}
+	// Start the server and wait for it to exit or for a shutdown signal
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.Start()
+	}()
 
-func getHandlerFunc(handlerName string, oidcConfig OIDC) (func(http.ResponseWriter, *http.Request), error) {
-	switch handlerName {
-	case "handleHello":
-		return func(w http.ResponseWriter, r *http.Request) {
-			// Create an OIDC verifier using the provided configuration
-			ctx := context.Background()
-			provider, err := oidc.NewProvider(ctx, oidcConfig.Issuer)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errCh:
 			if err != nil {
-				http.Error(w, "Failed to create OIDC provider", http.StatusInternalServerError)
-				return
+				fatal(err)
 			}
-
-			verifier := provider.Verifier(&oidc.Config{ClientID: oidcConfig.ClientID})
-
-			// Verify the ID token in the Authorization header
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Authorization header missing", http.StatusUnauthorized)
-				return
+			return
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				reload(server, sources)
+				continue
 			}
 
-			idTokenStr := authHeader[len("Bearer "):]
-			idToken, err := verifier.Verify(ctx, idTokenStr)
-			if err != nil {
-				http.Error(w, "Failed to verify ID token", http.StatusUnauthorized)
-				return
+			logger.Info("received signal", "signal", sig.String())
+			ctx, cancel := context.WithTimeout(context.Background(), grace)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				fatal(err)
 			}
+			if err := <-errCh; err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+}
+
+// runValidate loads and validates the config the same way startup does,
+// including resolving every handler, and reports the result on stdout or
+// stderr. It returns the process exit code.
+func runValidate(sources configSources, listenFlag string, stdout, stderr io.Writer) int {
+	config, err := sources.load()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	var errs []error
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateListenAddr(resolveListenAddr(listenFlag, config)); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(stderr, "invalid configuration:\n%v\n", errors.Join(errs...))
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "config OK (%d endpoints)\n", len(config.Endpoints))
+	return 0
+}
+
+// reload re-reads the config and swaps in its endpoints. An invalid config
+// is logged and ignored, leaving the current routes in place.
+func reload(server *Server, sources configSources) {
+	config, err := sources.load()
+	if err == nil {
+		if verr := config.Validate(); verr != nil {
+			err = fmt.Errorf("invalid configuration: %w", verr)
+		}
+	}
+	if err == nil {
+		err = server.Reload(config)
+	}
+	if err != nil {
+		slog.Error("reload failed, keeping current config", "error", err)
+		return
+	}
+	slog.Info("reloaded config", "endpoints", len(config.Endpoints))
+}
 
-			// Get the user's email address from the ID token
-			email := idToken.Claims("email")
+// fatal logs err and exits. Startup errors that come before the config's
+// logger exists go to the default logger on stderr.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
 
-			// Write a response with the user's email address
-			fmt.Fprintf(w, "Hello, %s!", email)
-		}, nil
-	default:
-		return nil, fmt.Errorf("handler function not found: %s", handlerName)
+// logEndpoints logs each registered endpoint followed by a count, so a
+// mistyped config that leaves an endpoint out is easy to spot.
+func logEndpoints(logger *slog.Logger, endpoints []Endpoint) {
+	for _, e := range endpoints {
+		attrs := []any{
+			"methods", strings.Join(e.methodList(), ","),
+			"path", e.Path,
+			"handler", e.Handler,
+			"oidc", e.requiresOIDC(),
+		}
+		if e.requiresOIDC() {
+			attrs = append(attrs, "issuers", strings.Join(e.OIDC.issuerList(), ","), "client_id", e.OIDC.ClientID)
+			if e.OIDC.ClientSecret != "" {
+				attrs = append(attrs, "client_secret", "REDACTED")
+			}
+		}
+		logger.Info("registered endpoint", attrs...)
 	}
+	logger.Info("registered endpoints", "count", len(endpoints))
 }
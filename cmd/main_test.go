@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRunValidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		listen     string
+		allowEmpty bool
+		wantCode   int
+		wantOutput string
+	}{
+		{
+			name: "valid",
+			config: `
+endpoints:
+  - path: /hello
+    method: GET
+    handler: handleHello
+    oidc: {issuer: https://idp.example.com, client_id: app}
+  - path: /status
+    method: GET
+    handler: static
+`,
+			wantOutput: "config OK (2 endpoints)",
+		},
+		{
+			name:       "unknown handler",
+			config:     "endpoints:\n  - {path: /x, method: GET, handler: handleNope}\n",
+			wantCode:   1,
+			wantOutput: `unknown handler "handleNope"`,
+		},
+		{
+			name:       "malformed duration",
+			config:     "endpoints:\n  - {path: /x, method: GET, handler: static, timeout: 5 seconds}\n",
+			wantCode:   1,
+			wantOutput: "timeout:",
+		},
+		{
+			name:       "malformed issuer URL",
+			config:     "endpoints:\n  - {path: /x, method: GET, handler: handleHello, oidc: {issuer: 'idp.example.com', client_id: app}}\n",
+			wantCode:   1,
+			wantOutput: "oidc.issuer:",
+		},
+		{
+			name:       "bad listen flag",
+			config:     "endpoints:\n  - {path: /x, method: GET, handler: static}\n",
+			listen:     "localhost:http-ish",
+			wantCode:   1,
+			wantOutput: "invalid listen address",
+		},
+		{
+			name:       "unparseable file",
+			config:     "endpoints: [",
+			wantCode:   1,
+			wantOutput: "failed to parse config file",
+		},
+		{
+			name:       "empty file",
+			config:     "\n",
+			wantCode:   1,
+			wantOutput: "config is empty; pass -allow-empty",
+		},
+		{
+			name:       "empty file allowed",
+			config:     "\n",
+			allowEmpty: true,
+			wantOutput: "config OK (0 endpoints)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, t.TempDir(), "config.yaml", tt.config)
+			var stdout, stderr bytes.Buffer
+			code := runValidate(configSources{paths: []string{path}, allowEmpty: tt.allowEmpty}, tt.listen, &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Fatalf("exit code = %d, want %d\nstdout: %s\nstderr: %s", code, tt.wantCode, &stdout, &stderr)
+			}
+			out := stdout.String()
+			if tt.wantCode != 0 {
+				out = stderr.String()
+				if stdout.Len() != 0 {
+					t.Errorf("stdout = %q for an invalid config", &stdout)
+				}
+			}
+			if !strings.Contains(out, tt.wantOutput) {
+				t.Errorf("output %q does not contain %q", out, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestLogEndpoints(t *testing.T) {
+	endpoints := []Endpoint{
+		{Path: "/hello", Methods: []string{"GET", "POST"}, Handler: HandlerHello, OIDC: OIDC{Issuer: "https://idp.example.com", ClientID: "app", ClientSecret: "hunter2"}},
+		{Path: "/status", Method: "GET", Handler: HandlerStatic},
+	}
+	var out bytes.Buffer
+	logEndpoints(newLogger(LoggingConfig{Format: "json"}, &out), endpoints)
+
+	if strings.Contains(out.String(), "hunter2") {
+		t.Fatalf("log output leaks the client secret: %s", &out)
+	}
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+
+	want := []map[string]interface{}{
+		{"msg": "registered endpoint", "methods": "GET,POST", "path": "/hello", "handler": "handleHello", "oidc": true, "issuers": "https://idp.example.com", "client_id": "app", "client_secret": "REDACTED"},
+		{"msg": "registered endpoint", "methods": "GET", "path": "/status", "handler": "static", "oidc": false},
+		{"msg": "registered endpoints", "count": float64(2)},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d log lines, want %d: %v", len(lines), len(want), lines)
+	}
+	for i, line := range lines {
+		for key, value := range want[i] {
+			if line[key] != value {
+				t.Errorf("line %d: %s = %v, want %v", i, key, line[key], value)
+			}
+		}
+	}
+	if _, ok := lines[1]["issuers"]; ok {
+		t.Error("unauthenticated endpoint logged issuers")
+	}
+}
+
+func TestLogEndpointsTextFormat(t *testing.T) {
+	var out bytes.Buffer
+	logEndpoints(newLogger(LoggingConfig{Format: "text"}, &out), []Endpoint{{Path: "/status", Method: "GET", Handler: HandlerStatic}})
+	for _, want := range []string{`msg="registered endpoint"`, "path=/status", "handler=static", "oidc=false", "count=1"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("text output %q lacks %q", &out, want)
+		}
+	}
+}
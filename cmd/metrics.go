@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultMetricsPath = "/metrics"
+
+// metrics holds the Prometheus collectors for the server. A nil *metrics is
+// valid and records nothing, so callers don't need to check whether metrics
+// are enabled.
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	verifications   *prometheus.CounterVec
+	verifyDuration  prometheus.Histogram
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total HTTP requests by path, method and status code.",
+		}, []string{"path", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by path and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"path", "method"}),
+		verifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "oidc_verifications_total",
+			Help: "OIDC token verifications by result.",
+		}, []string{"result"}),
+		verifyDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "oidc_verification_duration_seconds",
+			Help:    "OIDC token verification latency.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+	// The provider cache is shared by the whole process, so these read
+	// it directly rather than being updated by it.
+	cacheHits := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "oidc_provider_cache_hits_total",
+		Help: "OIDC provider lookups served from the cache.",
+	}, func() float64 { return float64(providers.hits.Load()) })
+	cacheMisses := prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "oidc_provider_cache_misses_total",
+		Help: "OIDC provider lookups that needed discovery.",
+	}, func() float64 { return float64(providers.misses.Load()) })
+	cachedProviders := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "oidc_provider_cache_size",
+		Help: "Number of OIDC providers currently cached.",
+	}, func() float64 { return float64(providers.size()) })
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.verifications,
+		m.verifyDuration,
+		cacheHits,
+		cacheMisses,
+		cachedProviders,
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// middleware records request counts and latency, labelled by the matched
+// route's path template to keep cardinality bounded.
+func (m *metrics) middleware(next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		path := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				path = tmpl
+			}
+		}
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		m.requests.WithLabelValues(path, r.Method, strconv.Itoa(rw.status)).Inc()
+		m.requestDuration.WithLabelValues(path, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+func (m *metrics) observeVerification(err error, d time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.verifications.WithLabelValues(result).Inc()
+	m.verifyDuration.Observe(d.Seconds())
+}
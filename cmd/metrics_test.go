@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// metricValue returns the current value of the unlabelled metric name in m.
+func metricValue(t *testing.T, m *metrics, name string) float64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		metric := f.GetMetric()[0]
+		if c := metric.GetCounter(); c != nil {
+			return c.GetValue()
+		}
+		return metric.GetGauge().GetValue()
+	}
+	t.Fatalf("metric %s not registered", name)
+	return 0
+}
+
+func TestProviderCacheMetrics(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	down := oidctest.NewProvider(t)
+	down.FailDiscovery(1 << 20)
+	config := Config{
+		Metrics: MetricsConfig{Enabled: true},
+		Endpoints: []Endpoint{
+			{Path: "/a", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}},
+			// Same provider, so it shares /a's cache entry.
+			{Path: "/b", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}},
+			{Path: "/down", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: down.Issuer(), ClientID: down.ClientID, DiscoveryAttempts: 1}},
+		},
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	token := p.SignToken(map[string]interface{}{"sub": "alice"})
+
+	// The cache is shared by the process, so steps check the change.
+	tests := []struct {
+		name       string
+		paths      []string
+		wantStatus int
+		hits       float64
+		misses     float64
+		size       float64
+	}{
+		{name: "first request", paths: []string{"/a"}, wantStatus: http.StatusOK, misses: 1, size: 1},
+		{name: "repeated", paths: []string{"/a", "/a", "/a"}, wantStatus: http.StatusOK, hits: 3},
+		{name: "shared provider", paths: []string{"/b", "/b"}, wantStatus: http.StatusOK, hits: 2},
+		{name: "failed discovery is not cached", paths: []string{"/down", "/down"}, wantStatus: http.StatusServiceUnavailable, misses: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := metricValue(t, s.metrics, "oidc_provider_cache_hits_total")
+			misses := metricValue(t, s.metrics, "oidc_provider_cache_misses_total")
+			size := metricValue(t, s.metrics, "oidc_provider_cache_size")
+			for _, path := range tt.paths {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("GET %s = %d, want %d: %s", path, rec.Code, tt.wantStatus, rec.Body)
+				}
+			}
+			if got := metricValue(t, s.metrics, "oidc_provider_cache_hits_total") - hits; got != tt.hits {
+				t.Errorf("hits += %v, want %v", got, tt.hits)
+			}
+			if got := metricValue(t, s.metrics, "oidc_provider_cache_misses_total") - misses; got != tt.misses {
+				t.Errorf("misses += %v, want %v", got, tt.misses)
+			}
+			if got := metricValue(t, s.metrics, "oidc_provider_cache_size") - size; got != tt.size {
+				t.Errorf("size += %v, want %v", got, tt.size)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+// responseWriter records the status code and number of bytes written so
+// they can be logged after the handler returns.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += n
+	return n, err
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// newLogger returns a logger writing to w in the configured format and at
+// the configured level. Config.Validate has already checked both.
+func newLogger(config LoggingConfig, w io.Writer) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: logLevels[config.Level]}
+	if config.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// namedMiddleware is one server-wide middleware, as configured by
+// middleware.disabled.
+type namedMiddleware struct {
+	name string
+	wrap func(http.Handler) http.Handler
+}
+
+// middlewareNames lists the server-wide middleware that can be disabled, in
+// the order they run, outermost first: recovery catches panics from
+// everything below it; logging times the whole request; security
+// headers are set early so even rejections carry them; the concurrency limit
+// sheds load before any real work; compression covers
+// every response written below it; CORS answers preflights. Per-endpoint
+// middleware (headers, body limit, timeout, OIDC, then rate limiting by
+// identity) runs inside these; see Server.addEndpoint. Between recovery and
+// the rest, requestInfoMiddleware always runs, so that rate limiting and
+// auditing see the real client address whatever is disabled.
+var middlewareNames = []string{"recovery", "logging", "security_headers", "concurrency_limit", "compression", "cors"}
+
+// buildMiddlewareChain returns the enabled server-wide middleware in
+// middlewareNames order, with requestInfoMiddleware inserted after recovery,
+// or first when recovery is disabled. Config.Validate has already checked
+// config.
+func buildMiddlewareChain(config Config, logger *slog.Logger) []namedMiddleware {
+	proxies, _ := parseTrustedProxies(config.TrustedProxies)
+	all := []namedMiddleware{
+		{"recovery", func(next http.Handler) http.Handler {
+			return recoveryMiddleware(logger, next)
+		}},
+		{"logging", func(next http.Handler) http.Handler {
+			return loggingMiddleware(logger, next)
+		}},
+		{"security_headers", func(next http.Handler) http.Handler {
+			if !config.SecurityHeaders.Enabled {
+				return next
+			}
+			return headersMiddleware(config.SecurityHeaders.headers(config.TLS.Enabled()), next)
+		}},
+		{"concurrency_limit", func(next http.Handler) http.Handler {
+			if config.Server.MaxConcurrent <= 0 {
+				return next
+			}
+			return concurrencyLimitMiddleware(config.Server.MaxConcurrent, next)
+		}},
+		{"compression", func(next http.Handler) http.Handler {
+			if !config.Compression.Enabled {
+				return next
+			}
+			return compressionMiddleware(config.Compression.minSize(), next)
+		}},
+		{"cors", func(next http.Handler) http.Handler {
+			return corsMiddleware(config.CORS, next)
+		}},
+	}
+
+	chain := make([]namedMiddleware, 0, len(all)+1)
+	for _, m := range all {
+		if !config.Middleware.disabled(m.name) {
+			chain = append(chain, m)
+		}
+	}
+	at := 0
+	if len(chain) > 0 && chain[0].name == "recovery" {
+		at = 1
+	}
+	return slices.Insert(chain, at, namedMiddleware{"request_info", func(next http.Handler) http.Handler {
+		return requestInfoMiddleware(proxies, next)
+	}})
+}
+
+// chainMiddleware wraps h in chain, so that chain[0] runs first.
+func chainMiddleware(h http.Handler, chain []namedMiddleware) http.Handler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		h = chain[i].wrap(h)
+	}
+	return h
+}
+
+// requestInfoMiddleware places a requestInfo in the context for the
+// middleware and handlers below it, resolving the client address and
+// trusting X-Forwarded-For only from proxies.
+func requestInfoMiddleware(proxies trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{clientIP: proxies.clientIP(r), requestID: r.Header.Get("X-Request-ID")}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoContextKey, info)))
+	})
+}
+
+// loggingMiddleware logs one line per request once the handler has finished.
+// The client address, request ID and identity come from the requestInfo
+// that requestInfoMiddleware placed in the context, when there is one.
+func loggingMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		info := requestInfoFromContext(r.Context())
+		if info == nil {
+			info = &requestInfo{}
+		}
+		logger.Debug("request started",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"proto", r.Proto,
+			"host", r.Host,
+			"user_agent", r.UserAgent(),
+			"client_ip", info.clientIP,
+		)
+		next.ServeHTTP(rw, r)
+
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rw.status,
+			"size", rw.size,
+			"remote_addr", r.RemoteAddr,
+			"client_ip", info.clientIP,
+			"duration", time.Since(start),
+		}
+		if info.requestID != "" {
+			attrs = append(attrs, "request_id", info.requestID)
+		}
+		if identity := info.getIdentity(); identity != "" {
+			attrs = append(attrs, "identity", identity)
+		}
+		logger.Info("request", attrs...)
+	})
+}
+
+// recoveryMiddleware turns a panic anywhere below it into a logged stack
+// trace and a generic 500, rather than a dropped connection.
+func recoveryMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// ErrAbortHandler is net/http's way of aborting a response on
+			// purpose; let the server handle it as usual.
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			logger.Error("panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", err,
+				"stack", string(debug.Stack()),
+			)
+			writeError(w, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headersMiddleware sets headers on the response before next runs, so next
+// can still change them.
+func headersMiddleware(headers map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyLimitMiddleware rejects request bodies larger than limit with a 413.
+// Bodies that declare their length are refused up front; others fail when
+// the handler reads past the limit.
+func bodyLimitMiddleware(limit int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyLimitMiddleware serves at most limit requests at a time and
+// turns the rest away with a 503 instead of queueing them. The slot is
+// released even if the handler panics.
+func concurrencyLimitMiddleware(limit int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "Server busy")
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
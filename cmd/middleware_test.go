@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("secret internal state")
+	})
+
+	tests := []struct {
+		name string
+		h    http.Handler
+	}{
+		{name: "handler", h: recoveryMiddleware(logger, panicking)},
+		// Recovery is outermost, so it also catches panics that escape
+		// the middleware below it.
+		{name: "through other middleware", h: recoveryMiddleware(logger, loggingMiddleware(logger, panicking))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			rec := httptest.NewRecorder()
+			tt.h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/boom", nil))
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want 500", rec.Code)
+			}
+			if strings.Contains(rec.Body.String(), "secret internal state") {
+				t.Errorf("response %q leaks the panic value", rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), "Internal server error") {
+				t.Errorf("response %q lacks the generic message", rec.Body)
+			}
+			out := logs.String()
+			if !strings.Contains(out, "panic serving request") || !strings.Contains(out, "secret internal state") {
+				t.Errorf("panic not logged: %s", out)
+			}
+			if !strings.Contains(out, "middleware_test.go") {
+				t.Errorf("logged stack does not include the panicking frame: %s", out)
+			}
+		})
+	}
+}
+
+func TestRecoveryRepanicsAbortHandler(t *testing.T) {
+	h := recoveryMiddleware(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler to propagate", err)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+// discardLogger returns a logger for tests that don't inspect the output.
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := recoveryMiddleware(discardLogger(), concurrencyLimitMiddleware(2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/block":
+			started <- struct{}{}
+			<-release
+		case "/panic":
+			panic("boom")
+		}
+	})))
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// Panicking requests give their slots back.
+	for i := 0; i < 3; i++ {
+		if rec := serve("/panic"); rec.Code != http.StatusInternalServerError {
+			t.Fatalf("panicking request %d = %d, want 500", i+1, rec.Code)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve("/block")
+		}()
+		<-started
+	}
+	for i := 0; i < 3; i++ {
+		rec := serve("/")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("request past the limit = %d, want 503", rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got == "" {
+			t.Error("503 without Retry-After")
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	if rec := serve("/"); rec.Code != http.StatusOK {
+		t.Errorf("request after the slots freed = %d, want 200", rec.Code)
+	}
+}
+
+func TestLoggingLevels(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+	good := p.SignToken(map[string]interface{}{"sub": "u1"})
+	expired := p.SignToken(map[string]interface{}{"sub": "u1", "exp": 1})
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	debugLines := []string{"request started", "token verified", "token verification failed"}
+	tests := []struct {
+		level     string
+		wantDebug bool
+		wantInfo  bool
+	}{
+		{level: "debug", wantDebug: true, wantInfo: true},
+		{level: "", wantInfo: true},
+		{level: "info", wantInfo: true},
+		{level: "warn"},
+		{level: "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := newLogger(LoggingConfig{Level: tt.level}, &logs)
+			// The verifier logs through the default logger, as NewServer
+			// sets it.
+			slog.SetDefault(logger)
+			h := loggingMiddleware(logger, OIDCMiddleware(oidcConfig)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			for _, token := range []string{good, expired} {
+				req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			out := logs.String()
+			for _, line := range debugLines {
+				if got := strings.Contains(out, "msg=\""+line+"\""); got != tt.wantDebug {
+					t.Errorf("logged %q = %v, want %v:\n%s", line, got, tt.wantDebug, out)
+				}
+			}
+			if got := strings.Contains(out, "msg=request "); got != tt.wantInfo {
+				t.Errorf("logged the request line = %v, want %v:\n%s", got, tt.wantInfo, out)
+			}
+		})
+	}
+
+	config := Config{Logging: LoggingConfig{Level: "verbose"}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), `unsupported level "verbose"`) {
+		t.Errorf("logging.level verbose: error = %v", err)
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	all := []string{"recovery", "request_info", "logging", "security_headers", "concurrency_limit", "compression", "cors"}
+	tests := []struct {
+		name     string
+		disabled []string
+		want     []string
+	}{
+		{name: "default", want: all},
+		{name: "logging disabled", disabled: []string{"logging"}, want: []string{"recovery", "request_info", "security_headers", "concurrency_limit", "compression", "cors"}},
+		{name: "all disabled", disabled: middlewareNames, want: []string{"request_info"}},
+		{name: "recovery disabled", disabled: []string{"recovery"}, want: []string{"request_info", "logging", "security_headers", "concurrency_limit", "compression", "cors"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			config := Config{TrustedProxies: []string{"10.0.0.1"}, Middleware: MiddlewareConfig{Disabled: tt.disabled}}
+			chain := buildMiddlewareChain(config, slog.New(slog.NewTextHandler(&logs, nil)))
+
+			// Each link records its name as it runs.
+			var ran []string
+			for i, m := range chain {
+				name, wrap := m.name, m.wrap
+				chain[i].wrap = func(next http.Handler) http.Handler {
+					inner := wrap(next)
+					return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						ran = append(ran, name)
+						inner.ServeHTTP(w, r)
+					})
+				}
+			}
+			var clientIP string
+			h := chainMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				clientIP = ClientIPFromContext(r.Context())
+			}), chain)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:1"
+			req.Header.Set("X-Forwarded-For", "203.0.113.1")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !reflect.DeepEqual(ran, tt.want) {
+				t.Errorf("ran %v, want %v", ran, tt.want)
+			}
+			// The client address is resolved whatever is disabled.
+			if clientIP != "203.0.113.1" {
+				t.Errorf("client IP = %q, want 203.0.113.1", clientIP)
+			}
+			logged := strings.Contains(logs.String(), "msg=request")
+			if want := !config.Middleware.disabled("logging"); logged != want {
+				t.Errorf("logged the request = %v, want %v", logged, want)
+			}
+		})
+	}
+
+	config := Config{Middleware: MiddlewareConfig{Disabled: []string{"request_info"}}}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), `unknown middleware "request_info"`) {
+		t.Errorf("disabling request_info: error = %v", err)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var logs bytes.Buffer
+	chain := buildMiddlewareChain(Config{}, slog.New(slog.NewTextHandler(&logs, nil)))
+	// A panic while resolving the request info is recovered like one in
+	// the handler.
+	for i, m := range chain {
+		if m.name == "request_info" {
+			chain[i].wrap = func(http.Handler) http.Handler {
+				return http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("client IP") })
+			}
+		}
+	}
+	h := chainMiddleware(http.NotFoundHandler(), chain)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	if !strings.Contains(logs.String(), "client IP") {
+		t.Errorf("panic not logged: %s", logs.String())
+	}
+}
+
+func TestEndpointHeaders(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	endpoint := staticEndpoint("/account", `{"plan":"pro"}`)
+	endpoint.Response.ContentType = "application/json"
+	endpoint.OIDC = OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+	endpoint.Headers = map[string]string{
+		"Cache-Control":          "no-store",
+		"X-Content-Type-Options": "nosniff",
+		// The handler sets its own content type over this one.
+		"Content-Type": "text/plain",
+	}
+	config := Config{Endpoints: []Endpoint{endpoint, staticEndpoint("/public", "hi")}}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		token       string
+		wantStatus  int
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "authenticated",
+			path:        "/account",
+			token:       p.SignToken(map[string]interface{}{"sub": "alice"}),
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Cache-Control": "no-store", "X-Content-Type-Options": "nosniff", "Content-Type": "application/json"},
+		},
+		{
+			name:        "rejected",
+			path:        "/account",
+			wantStatus:  http.StatusUnauthorized,
+			wantHeaders: map[string]string{"Cache-Control": "no-store", "X-Content-Type-Options": "nosniff"},
+		},
+		{
+			name:        "other endpoint",
+			path:        "/public",
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Cache-Control": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+
+	for name, value := range map[string]string{"Bad Name": "x", "X-Ok": "line\nbreak"} {
+		e := staticEndpoint("/bad", "")
+		e.Headers = map[string]string{name: value}
+		var rejected bool
+		for _, err := range e.validate() {
+			rejected = rejected || strings.HasPrefix(err.Error(), "headers: invalid")
+		}
+		if !rejected {
+			t.Errorf("headers {%q: %q} accepted", name, value)
+		}
+	}
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v3"
+)
+
+// providerCache memoizes OIDC providers by issuer URL so discovery only
+// happens once per issuer, along with the verifiers derived from them.
+// Failed discoveries are not cached, so the next request tries again.
+//
+// Caching verifiers doesn't pin signing keys: each one shares its
+// provider's oidc.RemoteKeySet, which refetches the JWKS whenever a token
+// names a key ID it hasn't seen, so keys rotated by the provider are picked
+// up without a restart. Failed fetches are retried; see retryKeySet.
+type providerCache struct {
+	mu        sync.RWMutex
+	providers map[providerKey]*providerInfo
+	verifiers map[verifierKey]*oidc.IDTokenVerifier
+	inflight  map[providerKey]*discoveryCall
+
+	// hits and misses count provider lookups, for the cache metrics.
+	hits, misses atomic.Int64
+}
+
+// providerKey identifies a provider by issuer and, when the discovery
+// document isn't at the standard well-known location, where to fetch it.
+type providerKey struct {
+	issuer       string
+	discoveryURL string
+	tls          clientKey
+	jwksFile     string
+}
+
+// providerInfo is a discovered provider along with the key set shared by
+// all of its verifiers.
+type providerInfo struct {
+	// provider is nil for keys loaded from a JWKS file.
+	provider *oidc.Provider
+	keys     oidc.KeySet
+	// algs are the advertised signing algorithms go-oidc supports.
+	algs []string
+}
+
+// discoveryCall is a discovery in progress that concurrent callers for the
+// same issuer wait on instead of starting their own.
+type discoveryCall struct {
+	done chan struct{}
+	info *providerInfo
+	err  error
+}
+
+// verifierKey identifies a verifier by issuer and every setting that affects
+// its oidc.Config, so endpoints with identical settings share one.
+type verifierKey struct {
+	providerKey
+	audience          string
+	skipClientIDCheck bool
+	// signingAlgs is the comma-separated list of accepted algorithms, kept
+	// as a string so the key stays comparable.
+	signingAlgs string
+	// jwksAttempts is how many times a failed JWKS fetch is tried.
+	jwksAttempts int
+}
+
+func (k verifierKey) config() *oidc.Config {
+	config := &oidc.Config{
+		ClientID:          k.audience,
+		SkipClientIDCheck: k.skipClientIDCheck,
+		// go-oidc has no clock skew tolerance, so verify checks exp, nbf
+		// and iat itself with checkTokenTimes.
+		SkipExpiryCheck: true,
+	}
+	if k.signingAlgs != "" {
+		config.SupportedSigningAlgs = strings.Split(k.signingAlgs, ",")
+	}
+	return config
+}
+
+var providers = newProviderCache()
+
+func newProviderCache() *providerCache {
+	return &providerCache{
+		providers: make(map[providerKey]*providerInfo),
+		verifiers: make(map[verifierKey]*oidc.IDTokenVerifier),
+		inflight:  make(map[providerKey]*discoveryCall),
+	}
+}
+
+const (
+	defaultDiscoveryAttempts = 3
+	discoveryBackoff         = 200 * time.Millisecond
+	// discoveryAttemptTimeout bounds a single discovery request.
+	discoveryAttemptTimeout = 10 * time.Second
+)
+
+// provider returns the cached provider for key, running discovery if this
+// is the first request for it. Concurrent first-time callers for the same
+// key share a single discovery. It runs detached from every caller's
+// context, bounded only by the retry budget, so each caller stops waiting
+// when its own ctx is done without cancelling it for the others.
+func (c *providerCache) provider(ctx context.Context, key providerKey, attempts int) (*providerInfo, error) {
+	c.mu.RLock()
+	info, ok := c.providers[key]
+	c.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+		return info, nil
+	}
+
+	c.mu.Lock()
+	if info, ok := c.providers[key]; ok {
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return info, nil
+	}
+	c.misses.Add(1)
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &discoveryCall{done: make(chan struct{})}
+		c.inflight[key] = call
+		dctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), discoveryBudget(attempts))
+		go func() {
+			defer cancel()
+			c.runDiscovery(dctx, key, attempts, call)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.info, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runDiscovery completes call, caching the provider if discovery succeeds.
+func (c *providerCache) runDiscovery(ctx context.Context, key providerKey, attempts int, call *discoveryCall) {
+	call.info, call.err = discover(ctx, key, attempts)
+
+	c.mu.Lock()
+	if call.err == nil {
+		c.providers[key] = call.info
+	}
+	delete(c.inflight, key)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// discoveryBudget is the longest a discovery of attempts tries can take:
+// each try's timeout plus the backoff between them.
+func discoveryBudget(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	budget := time.Duration(attempts) * discoveryAttemptTimeout
+	backoff := discoveryBackoff
+	for i := 1; i < attempts; i++ {
+		budget += backoff
+		backoff *= 2
+	}
+	return budget
+}
+
+// size returns the number of cached providers.
+func (c *providerCache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.providers)
+}
+
+// reset drops every cached provider and verifier, so the next request for
+// each issuer runs discovery again and fetches fresh keys. It returns the
+// evicted issuers, sorted. Discoveries already in flight are unaffected.
+func (c *providerCache) reset() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[string]bool)
+	issuers := []string{}
+	for key := range c.providers {
+		if !seen[key.issuer] {
+			seen[key.issuer] = true
+			issuers = append(issuers, key.issuer)
+		}
+	}
+	c.providers = make(map[providerKey]*providerInfo)
+	c.verifiers = make(map[verifierKey]*oidc.IDTokenVerifier)
+	sort.Strings(issuers)
+	return issuers
+}
+
+// discover runs OIDC discovery for key, retrying failures with
+// exponential backoff up to attempts times in total.
+func discover(ctx context.Context, key providerKey, attempts int) (*providerInfo, error) {
+	if key.jwksFile != "" {
+		return loadJWKSFile(key.jwksFile)
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	client, err := key.tls.client()
+	if err != nil {
+		return nil, err
+	}
+	ctx = oidc.ClientContext(ctx, client)
+
+	backoff := discoveryBackoff
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+			}
+		}
+
+		var p *oidc.Provider
+		var doc discoveryDocument
+		attemptCtx, cancel := context.WithTimeout(ctx, discoveryAttemptTimeout)
+		if key.discoveryURL != "" {
+			p, doc, err = discoverFromURL(attemptCtx, client, key.issuer, key.discoveryURL)
+		} else if p, err = oidc.NewProvider(attemptCtx, key.issuer); err == nil {
+			err = p.Claims(&doc)
+		}
+		cancel()
+		if err == nil {
+			return newProviderInfo(p, doc, client), nil
+		}
+		if mismatch := issuerMismatch(key.issuer, err); mismatch != nil {
+			// Retrying won't change the provider's answer.
+			return nil, mismatch
+		}
+	}
+	return nil, err
+}
+
+// issuerMismatchPattern matches go-oidc's error for a discovery document
+// that names a different issuer, which discoverFromURL copies.
+var issuerMismatchPattern = regexp.MustCompile(`issuer did not match the issuer returned by provider, expected ("(?:[^"\\]|\\.)*") got ("(?:[^"\\]|\\.)*")`)
+
+// issuerMismatch explains a discovery failure caused by the provider naming
+// a different issuer than the configured one, pointing out a stray trailing
+// slash, or returns nil if err is something else.
+func issuerMismatch(issuer string, err error) error {
+	m := issuerMismatchPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return nil
+	}
+	got, uerr := strconv.Unquote(m[2])
+	if uerr != nil {
+		return nil
+	}
+	if strings.TrimSuffix(got, "/") == strings.TrimSuffix(issuer, "/") {
+		hint := "set issuer to exactly that"
+		if !strings.HasSuffix(got, "/") {
+			hint += " or set normalize_issuer"
+		}
+		return fmt.Errorf("configured issuer %q differs from the provider's issuer %q only by a trailing slash; %s", issuer, got, hint)
+	}
+	return fmt.Errorf("configured issuer %q does not match the provider's issuer %q", issuer, got)
+}
+
+// loadJWKSFile reads a JWKS document into a static key set. Only signing
+// keys are used; the algorithms they name become the accepted defaults.
+func loadJWKSFile(path string) (*providerInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	info := &providerInfo{}
+	keys := &oidc.StaticKeySet{}
+	seen := make(map[string]bool)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		keys.PublicKeys = append(keys.PublicKeys, k.Public().Key)
+		if signingAlgorithms[k.Algorithm] && !seen[k.Algorithm] {
+			seen[k.Algorithm] = true
+			info.algs = append(info.algs, k.Algorithm)
+		}
+	}
+	if len(keys.PublicKeys) == 0 {
+		return nil, fmt.Errorf("%s contains no signing keys", path)
+	}
+	info.keys = keys
+	return info, nil
+}
+
+// newProviderInfo creates the long-lived key set for a discovered provider.
+// It must not use a request context, since it outlives the request that
+// triggered discovery.
+func newProviderInfo(p *oidc.Provider, doc discoveryDocument, client *http.Client) *providerInfo {
+	var algs []string
+	for _, alg := range doc.Algorithms {
+		if signingAlgorithms[alg] {
+			algs = append(algs, alg)
+		}
+	}
+	keysCtx := oidc.ClientContext(context.Background(), client)
+	return &providerInfo{
+		provider: p,
+		keys:     oidc.NewRemoteKeySet(keysCtx, doc.JWKSURL),
+		algs:     algs,
+	}
+}
+
+// discoveryDocument holds the provider metadata fields we use.
+type discoveryDocument struct {
+	Issuer      string   `json:"issuer"`
+	AuthURL     string   `json:"authorization_endpoint"`
+	TokenURL    string   `json:"token_endpoint"`
+	UserInfoURL string   `json:"userinfo_endpoint"`
+	JWKSURL     string   `json:"jwks_uri"`
+	Algorithms  []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// signingAlgorithms are the algorithms go-oidc can verify.
+var signingAlgorithms = map[string]bool{
+	oidc.RS256: true, oidc.RS384: true, oidc.RS512: true,
+	oidc.ES256: true, oidc.ES384: true, oidc.ES512: true,
+	oidc.PS256: true, oidc.PS384: true, oidc.PS512: true,
+	oidc.EdDSA: true,
+}
+
+// discoverFromURL fetches the discovery document from discoveryURL rather
+// than issuer's well-known path, which oidc.NewProvider always uses, and
+// builds the provider from it. As with standard discovery, the document
+// must name issuer exactly.
+func discoverFromURL(ctx context.Context, client *http.Client, issuer, discoveryURL string) (*oidc.Provider, discoveryDocument, error) {
+	var doc discoveryDocument
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, doc, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, doc, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, doc, fmt.Errorf("fetching discovery document: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, doc, fmt.Errorf("decoding discovery document: %w", err)
+	}
+	if doc.Issuer != issuer {
+		return nil, doc, fmt.Errorf("issuer did not match the issuer returned by provider, expected %q got %q", issuer, doc.Issuer)
+	}
+
+	config := oidc.ProviderConfig{
+		IssuerURL:   doc.Issuer,
+		AuthURL:     doc.AuthURL,
+		TokenURL:    doc.TokenURL,
+		UserInfoURL: doc.UserInfoURL,
+		JWKSURL:     doc.JWKSURL,
+	}
+	return config.NewProvider(ctx), doc, nil
+}
+
+// verifier returns the cached verifier for tokens from issuer checked
+// according to oidcConfig.
+func (c *providerCache) verifier(ctx context.Context, issuer string, oidcConfig OIDC) (*oidc.IDTokenVerifier, error) {
+	key := oidcConfig.verifierKey(issuer)
+
+	c.mu.RLock()
+	v, ok := c.verifiers[key]
+	c.mu.RUnlock()
+	if ok {
+		// A cached verifier means its provider is cached too.
+		c.hits.Add(1)
+		return v, nil
+	}
+
+	info, err := c.provider(ctx, key.providerKey, oidcConfig.discoveryAttempts())
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.verifiers[key]; ok {
+		return v, nil
+	}
+	config := key.config()
+	if len(config.SupportedSigningAlgs) == 0 {
+		config.SupportedSigningAlgs = info.algs
+	}
+	keys := &retryKeySet{keys: info.keys, attempts: key.jwksAttempts}
+	v = oidc.NewVerifier(key.issuer, keys, config)
+	c.verifiers[key] = v
+	return v, nil
+}
+
+const (
+	defaultJWKSFetchAttempts = 3
+	jwksBackoff              = 100 * time.Millisecond
+)
+
+// retryKeySet retries signature checks that failed because the JWKS could
+// not be fetched, with jittered exponential backoff. Other failures, such
+// as a bad signature, are returned at once.
+type retryKeySet struct {
+	keys     oidc.KeySet
+	attempts int
+}
+
+func (k *retryKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	backoff := jwksBackoff
+	var err error
+	for i := 0; i < k.attempts; i++ {
+		if i > 0 {
+			// Sleep between half and all of backoff so that concurrent
+			// requests don't retry in lockstep.
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			select {
+			case <-time.After(delay):
+				backoff *= 2
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		var payload []byte
+		payload, err = k.keys.VerifySignature(ctx, jwt)
+		// RemoteKeySet reports fetch failures only through the message.
+		if err == nil || !strings.HasPrefix(err.Error(), "fetching keys") {
+			return payload, err
+		}
+	}
+	// IDTokenVerifier flattens this error into a string, so flag it on the
+	// context for verify to find.
+	if status, ok := ctx.Value(keySetStatusContextKey).(*keySetStatus); ok {
+		status.unreachable.Store(true)
+	}
+	return nil, err
+}
+
+type keySetStatusKey struct{}
+
+var keySetStatusContextKey keySetStatusKey
+
+// keySetStatus records whether a key set could not be reached while
+// verifying a token.
+type keySetStatus struct {
+	unreachable atomic.Bool
+}
+
+// keySetError reports that a token could not be checked because its
+// issuer's JWKS was unreachable, rather than that it was invalid.
+type keySetError struct {
+	err error
+}
+
+func (e *keySetError) Error() string {
+	return "oidc key set unreachable: " + e.err.Error()
+}
+
+func (e *keySetError) Unwrap() error {
+	return e.err
+}
+
+// discoveryError reports that no issuer could be discovered, as opposed to a
+// token that failed verification.
+type discoveryError struct {
+	err error
+}
+
+func (e *discoveryError) Error() string {
+	return "oidc discovery failed: " + e.err.Error()
+}
+
+func (e *discoveryError) Unwrap() error {
+	return e.err
+}
+
+// verify checks rawToken against each configured issuer in turn and returns
+// the first successful result. If none verify, the per-issuer errors are
+// joined together.
+func (c *providerCache) verify(ctx context.Context, oidcConfig OIDC, rawToken string) (*oidc.IDToken, error) {
+	var errs []error
+	discovered := false
+	status := &keySetStatus{}
+	ctx = context.WithValue(ctx, keySetStatusContextKey, status)
+	for _, issuer := range oidcConfig.issuerList() {
+		verifier, err := c.verifier(ctx, issuer, oidcConfig)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", issuer, err))
+			continue
+		}
+		discovered = true
+
+		idToken, err := verifier.Verify(ctx, rawToken)
+		if err == nil && !oidcConfig.skipExpiryCheck() {
+			err = checkTokenTimes(idToken, oidcConfig.clockSkew(), time.Now())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", issuer, err))
+			continue
+		}
+		return idToken, nil
+	}
+
+	err := errors.Join(errs...)
+	if !discovered {
+		return nil, &discoveryError{err: err}
+	}
+	if status.unreachable.Load() {
+		return nil, &keySetError{err: err}
+	}
+	return nil, err
+}
+
+// checkTokenTimes checks the token's expiry, not-before and issued-at times
+// against now, allowing for skew between our clock and the provider's.
+func checkTokenTimes(idToken *oidc.IDToken, skew time.Duration, now time.Time) error {
+	if now.After(idToken.Expiry.Add(skew)) {
+		return &oidc.TokenExpiredError{Expiry: idToken.Expiry}
+	}
+	var claims struct {
+		NotBefore *float64 `json:"nbf"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return err
+	}
+	if claims.NotBefore != nil {
+		nbf := time.Unix(int64(*claims.NotBefore), 0)
+		if now.Add(skew).Before(nbf) {
+			return fmt.Errorf("oidc: token not valid before %v", nbf)
+		}
+	}
+	if !idToken.IssuedAt.IsZero() && now.Add(skew).Before(idToken.IssuedAt) {
+		return fmt.Errorf("oidc: token used before issued (iat %v)", idToken.IssuedAt)
+	}
+	return nil
+}
+
+const (
+	defaultVerifyTimeout = 5 * time.Second
+	defaultClockSkew     = 60 * time.Second
+)
+
+// verifyTimeout bounds provider discovery and token verification for a
+// single request. VerifyTimeout has already been checked by Config.Validate.
+func (o OIDC) verifyTimeout() time.Duration {
+	return mustParseDuration(o.VerifyTimeout, defaultVerifyTimeout)
+}
+
+func (o OIDC) clockSkew() time.Duration {
+	return mustParseDuration(o.ClockSkew, defaultClockSkew)
+}
+
+// skipExpiryCheck reports whether insecure_skip_expiry_check is in effect;
+// see insecureOIDCAllowed.
+func (o OIDC) skipExpiryCheck() bool {
+	return o.InsecureSkipExpiryCheck && insecureOIDCAllowed()
+}
+
+func (o OIDC) jwksFetchAttempts() int {
+	if o.JWKSFetchAttempts > 0 {
+		return o.JWKSFetchAttempts
+	}
+	return defaultJWKSFetchAttempts
+}
+
+func (o OIDC) discoveryAttempts() int {
+	if o.DiscoveryAttempts > 0 {
+		return o.DiscoveryAttempts
+	}
+	return defaultDiscoveryAttempts
+}
+
+func (o OIDC) clientKey() clientKey {
+	return clientKey{caFile: o.TLSCAFile, insecureSkipVerify: o.InsecureSkipVerify}
+}
+
+// configured reports whether any OIDC settings were provided.
+func (o OIDC) configured() bool {
+	return !reflect.ValueOf(o).IsZero()
+}
+
+const (
+	tokenTypeID     = "id"
+	tokenTypeAccess = "access"
+)
+
+// verifierKey returns the verifier settings for tokens from issuer. ID
+// tokens must carry the expected audience. JWT access tokens are checked
+// against Audience when one is configured; otherwise the audience check is
+// skipped, since access tokens are not issued to our client ID.
+func (o OIDC) verifierKey(issuer string) verifierKey {
+	key := verifierKey{
+		providerKey:  providerKey{issuer: issuer, discoveryURL: o.DiscoveryURL, tls: o.clientKey(), jwksFile: o.JWKSFile},
+		audience:     o.expectedAudience(),
+		jwksAttempts: o.jwksFetchAttempts(),
+		signingAlgs:  strings.Join(o.SupportedSigningAlgs, ","),
+	}
+	if o.TokenType == tokenTypeAccess {
+		key.audience = o.Audience
+		key.skipClientIDCheck = o.Audience == ""
+	}
+	if len(o.Audiences) > 0 {
+		// go-oidc only checks a single audience; checkAudience handles
+		// the list once the token has been verified.
+		key.audience = ""
+		key.skipClientIDCheck = true
+	}
+	return key
+}
+
+// issuerList returns Issuer followed by Issuers, without duplicates and,
+// with normalize_issuer, without trailing slashes.
+func (o OIDC) issuerList() []string {
+	var issuers []string
+	seen := make(map[string]bool)
+	for _, issuer := range append([]string{o.Issuer}, o.Issuers...) {
+		if o.NormalizeIssuer {
+			issuer = strings.TrimSuffix(issuer, "/")
+		}
+		if issuer == "" || seen[issuer] {
+			continue
+		}
+		seen[issuer] = true
+		issuers = append(issuers, issuer)
+	}
+	return issuers
+}
+
+// expectedAudience is the value the verifier checks against the "aud" claim.
+func (o OIDC) expectedAudience() string {
+	if o.Audience != "" {
+		return o.Audience
+	}
+	return o.ClientID
+}
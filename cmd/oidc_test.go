@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestAudienceCheck(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	tests := []struct {
+		name     string
+		audience string
+		aud      interface{}
+		ok       bool
+	}{
+		{name: "client id by default", aud: p.ClientID, ok: true},
+		{name: "other audience by default", aud: "https://api.example.com", ok: false},
+		{name: "configured audience", audience: "https://api.example.com", aud: "https://api.example.com", ok: true},
+		{name: "configured audience in list", audience: "https://api.example.com", aud: []string{"other", "https://api.example.com"}, ok: true},
+		{name: "client id when audience is configured", audience: "https://api.example.com", aud: p.ClientID, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, Audience: tt.audience}
+			token := p.SignToken(map[string]interface{}{"sub": "alice", "aud": tt.aud})
+			_, err := newProviderCache().verify(context.Background(), cfg, token)
+			if tt.ok && err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("verify accepted a token for the wrong audience")
+			}
+		})
+	}
+}
+
+func TestMultipleIssuers(t *testing.T) {
+	staging, prod, other := oidctest.NewProvider(t), oidctest.NewProvider(t), oidctest.NewProvider(t)
+	cfg := OIDC{Issuer: staging.Issuer(), Issuers: []string{prod.Issuer()}, ClientID: oidctest.DefaultClientID}
+	cache := newProviderCache()
+
+	for _, p := range []*oidctest.Provider{staging, prod} {
+		if _, err := cache.verify(context.Background(), cfg, p.SignToken(map[string]interface{}{"sub": "alice"})); err != nil {
+			t.Errorf("token from %s rejected: %v", p.Issuer(), err)
+		}
+	}
+
+	// A token from an issuer that isn't configured fails against each
+	// configured one, and the error names them both.
+	_, err := cache.verify(context.Background(), cfg, other.SignToken(map[string]interface{}{"sub": "mallory"}))
+	if err == nil {
+		t.Fatal("token from an unconfigured issuer accepted")
+	}
+	for _, issuer := range []string{staging.Issuer(), prod.Issuer()} {
+		if !strings.Contains(err.Error(), issuer) {
+			t.Errorf("error %q does not mention %s", err, issuer)
+		}
+	}
+
+	// Even a token naming a configured issuer is rejected if another
+	// provider signed it.
+	forged := other.SignToken(map[string]interface{}{"sub": "mallory", "iss": prod.Issuer()})
+	if _, err := cache.verify(context.Background(), cfg, forged); err == nil {
+		t.Fatal("token signed by the wrong provider accepted")
+	}
+
+	if got := cache.size(); got != 2 {
+		t.Errorf("cached %d providers, want 2", got)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	cfg := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+	cache := newProviderCache()
+	ctx := context.Background()
+
+	oldToken := p.SignToken(map[string]interface{}{"sub": "alice"})
+	if _, err := cache.verify(ctx, cfg, oldToken); err != nil {
+		t.Fatalf("token signed before rotation: %v", err)
+	}
+
+	// The cached provider has only seen the old key; the new key ID makes
+	// the key set refetch the JWKS rather than fail until a restart.
+	p.RotateKey()
+	if _, err := cache.verify(ctx, cfg, p.SignToken(map[string]interface{}{"sub": "alice"})); err != nil {
+		t.Fatalf("token signed after rotation: %v", err)
+	}
+	if got := cache.size(); got != 1 {
+		t.Errorf("cached %d providers, want the original 1", got)
+	}
+
+	// The refetched set no longer holds the retired key.
+	if _, err := cache.verify(ctx, cfg, oldToken); err == nil {
+		t.Error("token signed with the retired key still accepted")
+	}
+}
+
+func TestDiscoveryOutlivesCancelledCaller(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	var requests atomic.Int64
+	gate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		resp, err := http.Get(p.Issuer() + "/.well-known/openid-configuration")
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(w, resp.Body)
+	}))
+	defer gate.Close()
+
+	cache := newProviderCache()
+	key := providerKey{issuer: p.Issuer(), discoveryURL: gate.URL}
+
+	// The first caller starts discovery, then gives up.
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := cache.provider(ctx, key, 1)
+		firstErr <- err
+	}()
+	<-started
+
+	// A second caller joins the discovery in flight.
+	secondErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := cache.provider(ctx, key, 1)
+		secondErr <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-firstErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled caller got %v, want context.Canceled", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("cancelled caller still waiting on discovery")
+	}
+
+	close(release)
+	if err := <-secondErr; err != nil {
+		t.Fatalf("waiting caller failed after the first caller cancelled: %v", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("discovery fetched %d times, want 1", got)
+	}
+	if got := cache.size(); got != 1 {
+		t.Errorf("cached %d providers, want 1", got)
+	}
+}
+
+func TestDiscoveryBudget(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: discoveryAttemptTimeout},
+		{attempts: 1, want: discoveryAttemptTimeout},
+		{attempts: 3, want: 3*discoveryAttemptTimeout + discoveryBackoff + 2*discoveryBackoff},
+	}
+	for _, tt := range tests {
+		if got := discoveryBudget(tt.attempts); got != tt.want {
+			t.Errorf("discoveryBudget(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestFlakyDiscovery(t *testing.T) {
+	tests := []struct {
+		name      string
+		attempts  int
+		wantCodes []int
+		wantCalls int
+	}{
+		// Retries within the request ride out the outage.
+		{name: "retried", attempts: 3, wantCodes: []int{http.StatusOK}, wantCalls: 3},
+		// Without retries the first request fails, but the failure isn't
+		// cached, so the next two discover afresh.
+		{name: "not cached", attempts: 1, wantCodes: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK, http.StatusOK}, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := oidctest.NewProvider(t)
+			p.FailDiscovery(2)
+			endpoint := Endpoint{Path: "/hello", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, DiscoveryAttempts: tt.attempts}}
+			config := Config{Endpoints: []Endpoint{endpoint}}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			token := p.SignToken(map[string]interface{}{"sub": "alice"})
+			for i, want := range tt.wantCodes {
+				req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, req)
+				if rec.Code != want {
+					t.Fatalf("request %d = %d, want %d: %s", i+1, rec.Code, want, rec.Body)
+				}
+			}
+			if got := p.DiscoveryCalls(); got != tt.wantCalls {
+				t.Errorf("discovery ran %d times, want %d", got, tt.wantCalls)
+			}
+
+			// Once discovered, a bad token is the token's fault: 401, not 503.
+			forged := oidctest.NewProvider(t).SignToken(map[string]interface{}{"sub": "mallory", "iss": p.Issuer(), "aud": p.ClientID})
+			req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+			req.Header.Set("Authorization", "Bearer "+forged)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("bad signature = %d, want 401: %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestInsecureSkipExpiryCheck(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	expired := p.SignToken(map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()})
+	cfg := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, InsecureSkipExpiryCheck: true}
+
+	tests := []struct {
+		name        string
+		env         string
+		wantRefused bool
+	}{
+		{name: "allowed", env: "1"},
+		{name: "guard unset", env: "", wantRefused: true},
+		{name: "guard not 1", env: "true", wantRefused: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOW_INSECURE_OIDC", tt.env)
+
+			var refused bool
+			for _, err := range cfg.validate() {
+				if strings.Contains(err.Error(), "insecure_skip_expiry_check is set but ALLOW_INSECURE_OIDC=1 is not") {
+					refused = true
+				}
+			}
+			if refused != tt.wantRefused {
+				t.Errorf("validation refused = %v, want %v", refused, tt.wantRefused)
+			}
+
+			// Even if validation were bypassed, the guard is checked again
+			// at verification time.
+			_, err := newProviderCache().verify(context.Background(), cfg, expired)
+			if tt.wantRefused && err == nil {
+				t.Error("expired token accepted without the environment guard")
+			}
+			if !tt.wantRefused && err != nil {
+				t.Errorf("expired token rejected with the check disabled: %v", err)
+			}
+		})
+	}
+}
+
+func TestDiscoveryURL(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	// serveDiscovery serves p's discovery document at a non-standard path,
+	// optionally claiming a different issuer.
+	serveDiscovery := func(issuer string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/custom/discovery.json" {
+				http.NotFound(w, r)
+				return
+			}
+			resp, err := http.Get(p.Issuer() + "/.well-known/openid-configuration")
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			var doc map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&doc)
+			if issuer != "" {
+				doc["issuer"] = issuer
+			}
+			json.NewEncoder(w).Encode(doc)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	token := p.SignToken(map[string]interface{}{"sub": "alice"})
+
+	tests := []struct {
+		name      string
+		discovery string
+		wantErr   string
+	}{
+		{name: "custom path", discovery: serveDiscovery("").URL + "/custom/discovery.json"},
+		{name: "document names another issuer", discovery: serveDiscovery("https://elsewhere.example.com").URL + "/custom/discovery.json", wantErr: "does not match the provider's issuer"},
+		{name: "nothing at the URL", discovery: serveDiscovery("").URL + "/.well-known/openid-configuration", wantErr: "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, DiscoveryURL: tt.discovery, DiscoveryAttempts: 1}
+			_, err := newProviderCache().verify(context.Background(), cfg, token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSupportedSigningAlgs(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	claims := map[string]interface{}{"sub": "alice"}
+	tests := []struct {
+		name       string
+		algs       []string
+		token      string
+		wantStatus int
+	}{
+		{name: "advertised algorithm by default", token: p.SignToken(claims), wantStatus: http.StatusOK},
+		// The provider advertises only RS256.
+		{name: "unadvertised algorithm by default", token: p.SignES256Token(claims), wantStatus: http.StatusUnauthorized},
+		{name: "pinned algorithm", algs: []string{"ES256"}, token: p.SignES256Token(claims), wantStatus: http.StatusOK},
+		{name: "algorithm excluded by the pin", algs: []string{"ES256"}, token: p.SignToken(claims), wantStatus: http.StatusUnauthorized},
+		{name: "one of several pinned", algs: []string{"RS256", "ES256"}, token: p.SignToken(claims), wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, SupportedSigningAlgs: tt.algs})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && !strings.Contains(rec.Body.String(), "signed with unsupported algorithm") {
+				t.Errorf("body %q does not give the algorithm as the reason", rec.Body)
+			}
+		})
+	}
+
+	if errs := (OIDC{SupportedSigningAlgs: []string{"none"}}).validate(); len(errs) == 0 {
+		t.Error(`supported_signing_algs [none] accepted`)
+	}
+}
+
+func TestJWKSRetry(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int
+		attempts      int
+		forged        bool
+		wantStatus    int
+		wantKeysCalls int
+	}{
+		{name: "recovers within the attempts", failures: 2, attempts: 3, wantStatus: http.StatusOK, wantKeysCalls: 3},
+		{name: "single attempt", failures: 1, attempts: 1, wantStatus: http.StatusServiceUnavailable, wantKeysCalls: 1},
+		{name: "unreachable throughout", failures: 10, attempts: 2, wantStatus: http.StatusServiceUnavailable, wantKeysCalls: 2},
+		// A bad signature is the token's fault; fetching again won't help.
+		{name: "bad signature is not retried", forged: true, attempts: 3, wantStatus: http.StatusUnauthorized, wantKeysCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := oidctest.NewProvider(t)
+			h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, JWKSFetchAttempts: tt.attempts})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			token := p.SignToken(map[string]interface{}{"sub": "alice"})
+			if tt.forged {
+				token = oidctest.NewProvider(t).SignToken(map[string]interface{}{"sub": "alice", "iss": p.Issuer()})
+			}
+			p.FailKeys(tt.failures)
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable && !strings.Contains(rec.Body.String(), "signing keys unavailable") {
+				t.Errorf("body %q does not say the keys were unavailable", rec.Body)
+			}
+			if got := p.KeysCalls(); got != tt.wantKeysCalls {
+				t.Errorf("JWKS fetched %d times, want %d", got, tt.wantKeysCalls)
+			}
+		})
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	now := time.Now()
+	tests := []struct {
+		name      string
+		clockSkew string
+		claims    map[string]interface{}
+		wantErr   string
+	}{
+		{name: "expired within default skew", claims: map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}},
+		{name: "expired past default skew", claims: map[string]interface{}{"exp": now.Add(-120 * time.Second).Unix()}, wantErr: "token is expired"},
+		{name: "expired within configured skew", clockSkew: "5m", claims: map[string]interface{}{"exp": now.Add(-120 * time.Second).Unix()}},
+		{name: "no skew", clockSkew: "0s", claims: map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}, wantErr: "token is expired"},
+		{name: "nbf within skew", claims: map[string]interface{}{"nbf": now.Add(30 * time.Second).Unix()}},
+		{name: "nbf past skew", claims: map[string]interface{}{"nbf": now.Add(120 * time.Second).Unix()}, wantErr: "not valid before"},
+		{name: "iat within skew", claims: map[string]interface{}{"iat": now.Add(30 * time.Second).Unix()}},
+		{name: "iat past skew", claims: map[string]interface{}{"iat": now.Add(120 * time.Second).Unix()}, wantErr: "used before issued"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, ClockSkew: tt.clockSkew}
+			tt.claims["sub"] = "alice"
+			_, err := newProviderCache().verify(context.Background(), cfg, p.SignToken(tt.claims))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if errs := (OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, ClockSkew: "a minute"}).validate(); len(errs) == 0 {
+		t.Error("clock_skew \"a minute\" accepted")
+	}
+}
+
+func TestJWKSFile(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	resp, err := http.Get(p.Issuer() + "/keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	jwksFile := writeFile(t, dir, "jwks.json", string(jwks))
+
+	// The issuer is never contacted, so it needn't exist.
+	const issuer = "https://idp.internal.example"
+	cfg := OIDC{Issuer: issuer, ClientID: p.ClientID, JWKSFile: jwksFile}
+	signed := map[string]string{
+		"RS256":     p.SignToken(map[string]interface{}{"sub": "alice", "iss": issuer}),
+		"ES256":     p.SignES256Token(map[string]interface{}{"sub": "alice", "iss": issuer}),
+		"wrong iss": p.SignToken(map[string]interface{}{"sub": "alice"}),
+		"expired":   p.SignToken(map[string]interface{}{"sub": "alice", "iss": issuer, "exp": time.Now().Add(-time.Hour).Unix()}),
+	}
+	p.RotateKey()
+	signed["unknown key"] = p.SignToken(map[string]interface{}{"sub": "alice", "iss": issuer})
+	discoveries := p.DiscoveryCalls()
+
+	tests := []struct {
+		token   string
+		wantErr string
+	}{
+		{token: "RS256"},
+		{token: "ES256"},
+		{token: "wrong iss", wantErr: "id token issued by a different provider"},
+		{token: "expired", wantErr: "token is expired"},
+		{token: "unknown key", wantErr: "failed to verify signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			token, err := newProviderCache().verify(context.Background(), cfg, signed[tt.token])
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				if token.Subject != "alice" {
+					t.Errorf("subject = %q, want alice", token.Subject)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+	if got := p.DiscoveryCalls(); got != discoveries {
+		t.Errorf("verification ran discovery %d times", got-discoveries)
+	}
+
+	for name, content := range map[string]string{
+		"not JSON":        "{",
+		"no signing keys": `{"keys":[]}`,
+		"only encryption": strings.ReplaceAll(string(jwks), `"use":"sig"`, `"use":"enc"`),
+		"missing":         "",
+	} {
+		path := filepath.Join(dir, "missing.json")
+		if content != "" {
+			path = writeFile(t, dir, "bad.json", content)
+		}
+		errs := OIDC{Issuer: issuer, ClientID: p.ClientID, JWKSFile: path}.validate()
+		if len(errs) == 0 || !strings.Contains(errors.Join(errs...).Error(), "jwks_file:") {
+			t.Errorf("%s: jwks_file accepted (%v)", name, errs)
+		}
+	}
+}
+
+func TestNormalizeIssuer(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	token := p.SignToken(map[string]interface{}{"sub": "alice"})
+	tests := []struct {
+		name      string
+		issuer    string
+		normalize bool
+		wantErr   string
+	}{
+		{name: "exact", issuer: p.Issuer()},
+		{name: "stray slash", issuer: p.Issuer() + "/", wantErr: `configured issuer "` + p.Issuer() + `/" differs from the provider's issuer "` + p.Issuer() + `" only by a trailing slash; set issuer to exactly that or set normalize_issuer`},
+		{name: "stray slash normalized", issuer: p.Issuer() + "/", normalize: true},
+		{name: "normalizing an exact issuer", issuer: p.Issuer(), normalize: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := OIDC{Issuer: tt.issuer, ClientID: p.ClientID, NormalizeIssuer: tt.normalize, DiscoveryAttempts: 3}
+			start := p.DiscoveryCalls()
+			_, err := newProviderCache().verify(context.Background(), cfg, token)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verify error = %v, want %q", err, tt.wantErr)
+				}
+				// The provider's answer won't change, so it isn't retried.
+				if got := p.DiscoveryCalls() - start; got != 1 {
+					t.Errorf("discovery ran %d times, want 1", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+		})
+	}
+
+	// Without the flag the configured value is compared as written.
+	if got := (OIDC{Issuer: p.Issuer() + "/"}).issuerList(); len(got) != 1 || got[0] != p.Issuer()+"/" {
+		t.Errorf("issuerList() = %q, want the slash kept", got)
+	}
+	if got := (OIDC{Issuer: p.Issuer() + "/", Issuers: []string{p.Issuer()}, NormalizeIssuer: true}).issuerList(); len(got) != 1 || got[0] != p.Issuer() {
+		t.Errorf("normalized issuerList() = %q, want %q once", got, p.Issuer())
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+const defaultForwardedUserHeader = "X-Forwarded-User"
+
+func init() {
+	RegisterHandler(HandlerProxy, newProxyHandler)
+}
+
+// newProxyHandler forwards requests to the endpoint's upstream. The incoming
+// Authorization header is removed and the authenticated identity is passed
+// upstream in the forwarded-user header instead.
+func newProxyHandler(endpoint Endpoint) (http.HandlerFunc, error) {
+	if endpoint.Upstream == "" {
+		return nil, fmt.Errorf("proxy handler requires an upstream")
+	}
+	if err := validateURL(endpoint.Upstream); err != nil {
+		return nil, fmt.Errorf("invalid upstream: %w", err)
+	}
+	target, _ := url.Parse(endpoint.Upstream)
+
+	userHeader := endpoint.ForwardedUserHeader
+	if userHeader == "" {
+		userHeader = defaultForwardedUserHeader
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		slog.Error("proxy: upstream request failed", "path", endpoint.Path, "upstream", endpoint.Upstream, "error", err)
+		writeError(w, http.StatusBadGateway, "Upstream request failed")
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = r.Clone(r.Context())
+		r.Header.Del("Authorization")
+		// Never pass through a client-supplied identity.
+		r.Header.Del(userHeader)
+		if identity := IdentityFromContext(r.Context()); identity != "" {
+			r.Header.Set(userHeader, identity)
+		}
+		proxy.ServeHTTP(w, r)
+	}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestProxyHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"user":          r.Header.Get("X-Forwarded-User"),
+			"custom":        r.Header.Get("X-Remote-User"),
+			"authorization": r.Header.Get("Authorization"),
+			"path":          r.URL.Path,
+		})
+	}))
+	defer upstream.Close()
+
+	p := oidctest.NewProvider(t)
+	token := p.SignToken(map[string]interface{}{"sub": "user-1", "email": "alice@example.com"})
+
+	tests := []struct {
+		name       string
+		header     string
+		spoof      string
+		wantHeader string
+	}{
+		{name: "default header", wantHeader: "user"},
+		{name: "custom header", header: "X-Remote-User", wantHeader: "custom"},
+		{name: "spoofed identity replaced", spoof: "mallory@example.com", wantHeader: "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, err := newProxyHandler(Endpoint{Path: "/api", Upstream: upstream.URL, ForwardedUserHeader: tt.header})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID})(handler)
+
+			req := httptest.NewRequest(http.MethodGet, "/api", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			if tt.spoof != "" {
+				req.Header.Set("X-Forwarded-User", tt.spoof)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+
+			var got map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got[tt.wantHeader] != "alice@example.com" {
+				t.Errorf("upstream saw identity %q, want alice@example.com", got[tt.wantHeader])
+			}
+			if got["authorization"] != "" {
+				t.Errorf("upstream received Authorization %q", got["authorization"])
+			}
+			if got["path"] != "/api" {
+				t.Errorf("upstream path = %q, want /api", got["path"])
+			}
+		})
+	}
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	url := upstream.URL
+	upstream.Close()
+
+	handler, err := newProxyHandler(Endpoint{Path: "/api", Upstream: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+}
+
+func TestProxyRequiresUpstream(t *testing.T) {
+	for _, upstream := range []string{"", "not a url", "ftp://example.com"} {
+		if _, err := newProxyHandler(Endpoint{Path: "/api", Upstream: upstream}); err == nil {
+			t.Errorf("upstream %q accepted", upstream)
+		}
+	}
+}
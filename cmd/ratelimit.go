@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfig limits each client of an endpoint to RequestsPerSecond,
+// allowing bursts of up to Burst requests (default: RequestsPerSecond
+// rounded up, at least 1).
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second" json:"requests_per_second"`
+	Burst             int     `yaml:"burst" json:"burst"`
+}
+
+const (
+	rateLimitIdleTTL       = 10 * time.Minute
+	rateLimitSweepInterval = time.Minute
+	rateLimitMaxClients    = 10000
+)
+
+// rateLimiter keeps one token bucket per client key. Idle buckets are swept
+// lazily, and when the table is full the least recently used is evicted, so
+// the map can't grow without bound.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*rateLimitEntry
+	lastSweep time.Time
+}
+
+type rateLimitEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(cfg.RequestsPerSecond)))
+	}
+	return &rateLimiter{
+		limit:     rate.Limit(cfg.RequestsPerSecond),
+		burst:     burst,
+		clients:   make(map[string]*rateLimitEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// reserve takes a token for key, returning how long the caller would have to
+// wait if none is available.
+func (l *rateLimiter) reserve(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	entry, ok := l.clients[key]
+	if !ok {
+		if len(l.clients) >= rateLimitMaxClients {
+			l.evictOldest()
+		}
+		entry = &rateLimitEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = entry
+	}
+	entry.lastSeen = now
+
+	r := entry.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return rateLimitIdleTTL
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, entry := range l.clients {
+		if now.Sub(entry.lastSeen) > rateLimitIdleTTL {
+			delete(l.clients, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *rateLimiter) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range l.clients {
+		if oldestKey == "" || entry.lastSeen.Before(oldest) {
+			oldestKey, oldest = key, entry.lastSeen
+		}
+	}
+	delete(l.clients, oldestKey)
+}
+
+// middleware rejects requests over the limit with 429 and a Retry-After
+// header. Clients are keyed by authenticated identity when the OIDC
+// middleware has run, and by remote IP otherwise.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := IdentityFromContext(r.Context())
+		if key == "" {
+			key = "ip:" + clientIP(r)
+		}
+
+		if delay := l.reserve(key, time.Now()); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+func TestRateLimitPastBurst(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 3})
+	h := l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i := 1; i <= 4; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		want := http.StatusOK
+		if i > 3 {
+			want = http.StatusTooManyRequests
+		}
+		if rec.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, want)
+		}
+		if want == http.StatusTooManyRequests {
+			retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+			if err != nil || retry < 1 {
+				t.Errorf("Retry-After = %q, want a positive number of seconds", rec.Header().Get("Retry-After"))
+			}
+		}
+	}
+
+	// Another address has its own bucket.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("other client status = %d, want 200", rec.Code)
+	}
+}
+
+func TestRateLimitKeyedByIdentity(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	l := newRateLimiter(RateLimitConfig{RequestsPerSecond: 1, Burst: 1})
+	h := OIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, IdentityClaim: "sub"})(
+		l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		sub        string
+		wantStatus int
+	}{
+		{sub: "alice", wantStatus: http.StatusOK},
+		{sub: "bob", wantStatus: http.StatusOK},
+		{sub: "alice", wantStatus: http.StatusTooManyRequests},
+	}
+	for i, tt := range tests {
+		// All requests come from one address; only the identity differs.
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+p.SignToken(map[string]interface{}{"sub": tt.sub}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("request %d (%s): status = %d, want %d", i+1, tt.sub, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestRateLimitRefills(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{RequestsPerSecond: 2, Burst: 1})
+	now := time.Now()
+	if d := l.reserve("k", now); d != 0 {
+		t.Fatalf("first request delayed %v", d)
+	}
+	if d := l.reserve("k", now); d <= 0 {
+		t.Fatal("second request in the same instant allowed")
+	}
+	if d := l.reserve("k", now.Add(time.Second)); d != 0 {
+		t.Errorf("request after refill delayed %v", d)
+	}
+}
+
+func TestRateLimitBounded(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{RequestsPerSecond: 1})
+	now := time.Now()
+	for i := 0; i < rateLimitMaxClients+10; i++ {
+		l.reserve(fmt.Sprintf("client-%d", i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	if got := len(l.clients); got > rateLimitMaxClients {
+		t.Errorf("%d clients tracked, want at most %d", got, rateLimitMaxClients)
+	}
+	if _, ok := l.clients["client-0"]; ok {
+		t.Error("least recently used client not evicted")
+	}
+
+	// Idle entries are swept once the sweep interval has passed.
+	l.reserve("late", now.Add(rateLimitIdleTTL+rateLimitSweepInterval+time.Minute))
+	if got := len(l.clients); got != 1 {
+		t.Errorf("%d clients after sweep, want 1", got)
+	}
+}
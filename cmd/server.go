@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const defaultListenAddr = ":8080"
+
+type Server struct {
+	tls         *TLSConfig
+	srv         *http.Server
+	ready       atomic.Bool
+	metrics     *metrics
+	metricsPath string
+	admin       AdminConfig
+	index       IndexConfig
+	debug       DebugConfig
+	socketMode  os.FileMode
+
+	// basePath prefixes every endpoint; prefixBuiltins also moves the
+	// health, metrics and admin routes under it.
+	basePath       string
+	prefixBuiltins bool
+	// strictSlash redirects paths that differ only by a trailing slash.
+	strictSlash bool
+
+	// maxBodyBytes is the default request body limit for endpoints.
+	maxBodyBytes int64
+	// http2 is set when server.http2 is enabled.
+	http2 *http2.Server
+	// warmupTimeout bounds the startup discovery run by WarmUp.
+	warmupTimeout time.Duration
+	warmup        warmupState
+
+	logger *slog.Logger
+	// conns counts open client connections, for the shutdown log.
+	conns atomic.Int64
+
+	// mu guards routes, which Reload replaces wholesale since a mux.Router
+	// can't have routes removed once registered.
+	mu     sync.RWMutex
+	routes *routes
+}
+
+// routes is one generation of the route table.
+type routes struct {
+	router *mux.Router
+	// sub serves the configured endpoints under base; it is nil when no
+	// base path is set.
+	sub       *mux.Router
+	base      string
+	paths     map[string]bool
+	endpoints []Endpoint
+}
+
+// handle registers h for path. Prefixed routes go under the base path when
+// one is configured; others are registered on the root router. paths records
+// the full path either way.
+func (rt *routes) handle(prefixed bool, path string, h http.Handler, methods ...string) {
+	router, full := rt.router, path
+	if prefixed && rt.sub != nil {
+		router, full = rt.sub, rt.base+path
+	}
+	router.Handle(path, h).Methods(methods...)
+	rt.paths[full] = true
+}
+
+// has reports whether path is already registered.
+func (rt *routes) has(prefixed bool, path string) bool {
+	if prefixed && rt.sub != nil {
+		path = rt.base + path
+	}
+	return rt.paths[path]
+}
+
+func NewServer(addr string, config Config) *Server {
+	logger := newLogger(config.Logging, os.Stdout)
+	slog.SetDefault(logger)
+	setResponseState(config)
+	socketMode, _ := parseSocketMode(config.SocketMode)
+	s := &Server{
+		tls:            config.TLS,
+		admin:          config.Admin,
+		index:          config.Index,
+		debug:          config.Debug,
+		socketMode:     socketMode,
+		basePath:       normalizeBasePath(config.BasePath),
+		prefixBuiltins: config.PrefixBuiltinRoutes,
+		strictSlash:    config.Router.StrictSlash,
+		maxBodyBytes:   config.Server.MaxBodyBytes,
+		warmupTimeout:  mustParseDuration(config.Server.WarmupTimeout, defaultWarmupTimeout),
+		logger:         logger,
+		srv: &http.Server{
+			Addr: addr,
+			// Config.Validate has already checked these durations.
+			ReadTimeout:       mustParseDuration(config.Server.ReadTimeout, defaultReadTimeout),
+			ReadHeaderTimeout: mustParseDuration(config.Server.ReadHeaderTimeout, defaultReadHeaderTimeout),
+			WriteTimeout:      mustParseDuration(config.Server.WriteTimeout, defaultWriteTimeout),
+			IdleTimeout:       mustParseDuration(config.Server.IdleTimeout, defaultIdleTimeout),
+			MaxHeaderBytes:    config.Server.maxHeaderBytes(),
+		},
+	}
+	s.srv.ConnState = s.trackConn
+	s.srv.ErrorLog = slog.NewLogLogger(logger.Handler(), slog.LevelError)
+
+	s.srv.Handler = chainMiddleware(s, buildMiddlewareChain(config, logger))
+	if config.Server.HTTP2 {
+		s.http2 = &http2.Server{IdleTimeout: s.srv.IdleTimeout}
+		if !config.TLS.Enabled() {
+			s.srv.Handler = h2c.NewHandler(s.srv.Handler, s.http2)
+		}
+	}
+
+	if config.Metrics.Enabled {
+		s.metrics = newMetrics()
+		s.metricsPath = config.Metrics.Path
+		if s.metricsPath == "" {
+			s.metricsPath = defaultMetricsPath
+		}
+	}
+	s.routes = s.newRoutes()
+
+	return s
+}
+
+// newRoutes returns an empty route table with the server's built-in routes
+// and router middleware installed.
+func (s *Server) newRoutes() *routes {
+	rt := &routes{
+		router: mux.NewRouter(),
+		base:   s.basePath,
+		paths:  make(map[string]bool),
+	}
+	// Set before any routes are added, which copy it; the subrouter
+	// inherits it too.
+	rt.router.StrictSlash(s.strictSlash)
+	rt.router.NotFoundHandler = http.HandlerFunc(handleNotFound)
+	rt.router.MethodNotAllowedHandler = methodNotAllowedHandler(rt.router)
+	if s.basePath != "" {
+		rt.sub = rt.router.PathPrefix(s.basePath).Subrouter()
+	}
+	if s.metrics != nil {
+		rt.handle(s.prefixBuiltins, s.metricsPath, s.metrics.handler(), http.MethodGet)
+		rt.router.Use(s.metrics.middleware)
+	}
+	s.registerAdminRoutes(rt)
+	s.registerDebugRoutes(rt)
+	return rt
+}
+
+// normalizeBasePath returns p with a leading slash and no trailing slash, so
+// "/api/v1", "api/v1" and "/api/v1/" are equivalent. "/" and "" mean no
+// prefix.
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// ServeHTTP dispatches to the current route table.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	rt := s.routes
+	s.mu.RUnlock()
+	rt.router.ServeHTTP(w, r)
+}
+
+// mustParseDuration is parseDuration for values that have already been
+// validated; invalid input falls back to def.
+func mustParseDuration(value string, def time.Duration) time.Duration {
+	d, err := parseDuration(value, def)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+func (s *Server) RegisterEndpoint(endpoint Endpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addEndpoint(s.routes, endpoint)
+}
+
+// Reload replaces the registered endpoints with those in config. The new
+// routes are built in full before being swapped in, so if any endpoint fails
+// to register the current routes stay live. Once WarmUp has run, it runs
+// again for the new routes. Server-level settings such as the listen
+// address and TLS are not reloaded.
+func (s *Server) Reload(config Config) error {
+	rt := s.newRoutes()
+	for _, endpoint := range config.Endpoints {
+		if err := s.addEndpoint(rt, endpoint); err != nil {
+			return err
+		}
+	}
+	s.registerHealthChecks(rt)
+	s.registerIndex(rt)
+
+	s.mu.Lock()
+	s.routes = rt
+	s.mu.Unlock()
+	setResponseState(config)
+	if s.warmup.running() {
+		s.WarmUp()
+	}
+	return nil
+}
+
+// setResponseState sets the package state that handlers read from config:
+// the error format and the session store. It runs on every NewServer and
+// Reload, so a setting the config leaves out returns to its default rather
+// than keeping an earlier config's value.
+func setResponseState(config Config) {
+	jsonErrors.Store(config.ErrorFormat == "json")
+	sessions.Store(newSessionStore(config.Session))
+}
+
+// addEndpoint registers endpoint in rt. Its handler is wrapped so that, from
+// the outside in, the configured headers are set first, then the body limit
+// applies, then the timeout, then OIDC authentication, then the rate
+// limiter, which can key on the identity authentication established.
+func (s *Server) addEndpoint(rt *routes, endpoint Endpoint) error {
+	handlerFunc, err := getHandlerFunc(endpoint)
+	if err != nil {
+		return err
+	}
+
+	var handler http.Handler = handlerFunc
+	var limiter *rateLimiter
+	if endpoint.RateLimit != nil {
+		limiter = newRateLimiter(*endpoint.RateLimit)
+		handler = limiter.middleware(handler)
+	}
+	if endpoint.requiresOIDC() {
+		auth := newOIDCMiddleware(endpoint.OIDC, s.metrics)
+		auth.authHeaders = s.debug.AuthHeaders
+		if endpoint.AnonymousHandler != "" {
+			anonymous, err := getHandlerFunc(endpoint.anonymousEndpoint())
+			if err != nil {
+				return fmt.Errorf("%s: anonymous_handler: %w", endpoint.Path, err)
+			}
+			// Anonymous clients share the endpoint's limiter, keyed by IP.
+			auth.anonymous = anonymous
+			if limiter != nil {
+				auth.anonymous = limiter.middleware(anonymous)
+			}
+		}
+		handler = auth.wrap(handler)
+	}
+
+	timeout, err := parseDuration(endpoint.Timeout, 0)
+	if err != nil {
+		return fmt.Errorf("%s: timeout: %w", endpoint.Path, err)
+	}
+	if timeout > 0 {
+		handler = http.TimeoutHandler(handler, timeout, "Request timed out")
+	}
+	if limit := endpoint.bodyLimit(s.maxBodyBytes); limit > 0 {
+		handler = bodyLimitMiddleware(limit, handler)
+	}
+	if len(endpoint.Headers) > 0 {
+		handler = headersMiddleware(endpoint.Headers, handler)
+	}
+
+	rt.handle(true, endpoint.Path, handler, endpoint.methodList()...)
+	rt.endpoints = append(rt.endpoints, endpoint)
+
+	return nil
+}
+
+// MarkReady makes the readiness check report success. It should be called
+// once every endpoint has been registered.
+func (s *Server) MarkReady() {
+	s.ready.Store(true)
+}
+
+// Start serves until the server is shut down. It returns nil after a call to
+// Shutdown rather than http.ErrServerClosed.
+func (s *Server) Start() error {
+	s.mu.Lock()
+	s.registerHealthChecks(s.routes)
+	s.registerIndex(s.routes)
+	s.mu.Unlock()
+
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	if s.tls.Enabled() {
+		s.srv.TLSConfig, err = s.tls.Build()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		if s.http2 != nil {
+			// Adds h2 to the ALPN protocols ahead of http/1.1.
+			if err := http2.ConfigureServer(s.srv, s.http2); err != nil {
+				ln.Close()
+				return err
+			}
+		} else {
+			// net/http negotiates h2 over TLS on its own unless
+			// TLSNextProto is non-nil.
+			s.srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+		s.logger.Info("listening", "addr", s.srv.Addr, "tls", true, "version", version)
+		err = s.srv.ServeTLS(ln, s.tls.CertFile, s.tls.KeyFile)
+	} else {
+		s.logger.Info("listening", "addr", s.srv.Addr, "tls", false, "version", version)
+		err = s.srv.Serve(ln)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// listen opens the TCP or Unix socket listener for the server's address.
+// For Unix sockets a stale socket file left by a previous run is removed
+// first, and the socket's permissions are set from the config.
+func (s *Server) listen() (net.Listener, error) {
+	path, ok := unixSocketPath(s.srv.Addr)
+	if !ok {
+		return net.Listen("tcp", s.srv.Addr)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if s.socketMode != 0 {
+		if err := os.Chmod(path, s.socketMode); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to set permissions on socket %s: %w", path, err)
+		}
+	}
+	return ln, nil
+}
+
+// Shutdown stops accepting new connections and waits for in-flight requests
+// to finish or for ctx to expire. A Unix socket file is removed afterwards.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.warmup.stop()
+	s.logger.Info("shutting down", "active_connections", s.conns.Load())
+	err := s.srv.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.logger.Warn("shutdown deadline reached before connections drained", "active_connections", s.conns.Load())
+	} else if err == nil {
+		s.logger.Info("all connections drained")
+	}
+	if path, ok := unixSocketPath(s.srv.Addr); ok {
+		if rmErr := os.Remove(path); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+			err = errors.Join(err, rmErr)
+		}
+	}
+	return err
+}
+
+// trackConn keeps conns up to date as connections open and close.
+func (s *Server) trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		s.conns.Add(1)
+	case http.StateClosed, http.StateHijacked:
+		s.conns.Add(-1)
+	}
+}
+
+// unixSocketPath returns the socket path from a "unix:<path>" address.
+func unixSocketPath(addr string) (string, bool) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	return path, ok && path != ""
+}
@@ -0,0 +1,702 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// newTestServer calls NewServer, undoing the package state it sets once the
+// test ends. Logging defaults to errors only to keep test output readable.
+func newTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	logger, store, json := slog.Default(), sessions.Load(), jsonErrors.Load()
+	t.Cleanup(func() {
+		slog.SetDefault(logger)
+		sessions.Store(store)
+		jsonErrors.Store(json)
+	})
+	if config.Logging.Level == "" {
+		config.Logging.Level = "error"
+	}
+	return NewServer(":0", config)
+}
+
+// get serves a GET for path and returns the recorded response.
+func get(h http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func staticEndpoint(path, body string) Endpoint {
+	return Endpoint{Path: path, Method: http.MethodGet, Handler: HandlerStatic, Response: StaticResponse{Body: body}}
+}
+
+func TestReload(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.Reload(Config{Endpoints: []Endpoint{staticEndpoint("/old", "old")}}); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(s, "/old"); rec.Code != http.StatusOK || rec.Body.String() != "old" {
+		t.Fatalf("GET /old = %d %q before reload", rec.Code, rec.Body)
+	}
+
+	if err := s.Reload(Config{Endpoints: []Endpoint{staticEndpoint("/new", "new")}}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{path: "/new", wantStatus: http.StatusOK, wantBody: "new"},
+		{path: "/old", wantStatus: http.StatusNotFound},
+		{path: "/healthz", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := get(s, tt.path)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.wantStatus)
+		}
+		if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+			t.Errorf("GET %s body = %q, want %q", tt.path, rec.Body, tt.wantBody)
+		}
+	}
+}
+
+func TestReloadFailureKeepsRoutes(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.Reload(Config{Endpoints: []Endpoint{staticEndpoint("/current", "current")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := Config{Endpoints: []Endpoint{
+		staticEndpoint("/replacement", "replacement"),
+		{Path: "/broken", Method: http.MethodGet, Handler: "noSuchHandler"},
+	}}
+	if err := s.Reload(bad); err == nil {
+		t.Fatal("Reload accepted an endpoint with an unknown handler")
+	}
+	if rec := get(s, "/current"); rec.Code != http.StatusOK {
+		t.Errorf("GET /current = %d after a failed reload, want 200", rec.Code)
+	}
+	if rec := get(s, "/replacement"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET /replacement = %d, want 404: a failed reload must not be partly applied", rec.Code)
+	}
+}
+
+func TestReloadDuringRequests(t *testing.T) {
+	s := newTestServer(t, Config{})
+	if err := s.Reload(Config{Endpoints: []Endpoint{staticEndpoint("/a", "a")}}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			resp, err := http.Get(srv.URL + "/a")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("GET /a = %d during reloads", resp.StatusCode)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := s.Reload(Config{Endpoints: []Endpoint{staticEndpoint("/a", "a")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+
+	// Leave a stale socket file behind, as a crashed process would.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	config := Config{SocketMode: "0600", Endpoints: []Endpoint{staticEndpoint("/hello", "over a socket")}}
+	s := newTestServer(t, config)
+	s.srv.Addr = "unix:" + path
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Start() }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	var resp *http.Response
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		resp, err = client.Get("http://unix/hello")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "over a socket" {
+		t.Errorf("GET /hello = %d %q", resp.StatusCode, body)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("socket permissions = %o, want 600", mode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file still present after shutdown: %v", err)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	tests := []struct {
+		name           string
+		basePath       string
+		prefixBuiltins bool
+		want           map[string]int
+	}{
+		{
+			name:     "endpoints under the prefix",
+			basePath: "/api/v1",
+			want: map[string]int{
+				"/api/v1/hello": http.StatusOK,
+				"/hello":        http.StatusNotFound,
+				"/api/hello":    http.StatusNotFound,
+				healthPath:      http.StatusOK,
+			},
+		},
+		{
+			name:     "slashes normalized",
+			basePath: "api/v1/",
+			want: map[string]int{
+				"/api/v1/hello": http.StatusOK,
+				"/hello":        http.StatusNotFound,
+			},
+		},
+		{
+			name:           "builtins under the prefix",
+			basePath:       "/api/v1/",
+			prefixBuiltins: true,
+			want: map[string]int{
+				"/api/v1/hello":        http.StatusOK,
+				"/api/v1" + healthPath: http.StatusOK,
+				healthPath:             http.StatusNotFound,
+			},
+		},
+		{
+			name:     "root means no prefix",
+			basePath: "/",
+			want: map[string]int{
+				"/hello": http.StatusOK,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{
+				BasePath:            tt.basePath,
+				PrefixBuiltinRoutes: tt.prefixBuiltins,
+				Endpoints:           []Endpoint{staticEndpoint("/hello", "hi")},
+			}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			for path, want := range tt.want {
+				if got := get(s, path).Code; got != want {
+					t.Errorf("GET %s = %d, want %d", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStrictSlash(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	token := p.SignToken(map[string]interface{}{"sub": "alice"})
+	tests := []struct {
+		name         string
+		strictSlash  bool
+		basePath     string
+		path         string
+		token        string
+		wantLocation string
+		wantStatus   int
+		wantBody     string
+	}{
+		{name: "exact path", path: "/foo", token: token, wantStatus: http.StatusOK, wantBody: "Hello, alice!"},
+		{name: "extra slash by default", path: "/foo/", token: token, wantStatus: http.StatusNotFound},
+		{name: "missing slash by default", path: "/bar", wantStatus: http.StatusNotFound},
+		{name: "extra slash redirected", strictSlash: true, path: "/foo/", token: token, wantLocation: "/foo", wantStatus: http.StatusOK, wantBody: "Hello, alice!"},
+		{name: "missing slash redirected", strictSlash: true, path: "/bar", wantLocation: "/bar/", wantStatus: http.StatusOK, wantBody: "bar"},
+		{name: "redirect still needs a token", strictSlash: true, path: "/foo/", wantLocation: "/foo", wantStatus: http.StatusUnauthorized},
+		{name: "under a base path", strictSlash: true, basePath: "/api", path: "/api/foo/", token: token, wantLocation: "/api/foo", wantStatus: http.StatusOK, wantBody: "Hello, alice!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			foo := Endpoint{Path: "/foo", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}}
+			config := Config{
+				BasePath:  tt.basePath,
+				Router:    RouterConfig{StrictSlash: tt.strictSlash},
+				Endpoints: []Endpoint{foo, staticEndpoint("/bar/", "bar")},
+			}
+			s := newTestServer(t, config)
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewServer(s.srv.Handler)
+			t.Cleanup(srv.Close)
+
+			var redirects []string
+			client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > 1 {
+					return errors.New("redirected twice")
+				}
+				redirects = append(redirects, req.URL.Path)
+				return nil
+			}}
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if tt.wantLocation == "" && len(redirects) > 0 {
+				t.Errorf("redirected to %v", redirects)
+			}
+			if tt.wantLocation != "" && (len(redirects) != 1 || redirects[0] != tt.wantLocation) {
+				t.Errorf("redirects = %v, want %s", redirects, tt.wantLocation)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+
+	// The redirect itself is a 301.
+	config := Config{Router: RouterConfig{StrictSlash: true}, Endpoints: []Endpoint{staticEndpoint("/bar/", "bar")}}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(s, "/bar"); rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "/bar/" {
+		t.Errorf("GET /bar = %d, Location %q, want 301 to /bar/", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	// timeouts are read, read header, write and idle.
+	tests := []struct {
+		name           string
+		server         ServerConfig
+		timeouts       [4]time.Duration
+		maxHeaderBytes int
+	}{
+		{
+			name:           "defaults",
+			timeouts:       [4]time.Duration{defaultReadTimeout, defaultReadHeaderTimeout, defaultWriteTimeout, defaultIdleTimeout},
+			maxHeaderBytes: defaultMaxHeaderBytes,
+		},
+		{
+			name:           "configured",
+			server:         ServerConfig{ReadTimeout: "1s", ReadHeaderTimeout: "2s", WriteTimeout: "3s", IdleTimeout: "4s", MaxHeaderBytes: 4096},
+			timeouts:       [4]time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second},
+			maxHeaderBytes: 4096,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, Config{Server: tt.server}).srv
+			got := [4]time.Duration{srv.ReadTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout, srv.IdleTimeout}
+			if got != tt.timeouts {
+				t.Errorf("timeouts = %v, want %v", got, tt.timeouts)
+			}
+			if srv.MaxHeaderBytes != tt.maxHeaderBytes {
+				t.Errorf("MaxHeaderBytes = %d, want %d", srv.MaxHeaderBytes, tt.maxHeaderBytes)
+			}
+		})
+	}
+
+	if err := (Config{Server: ServerConfig{ReadHeaderTimeout: "soon"}}).Validate(); err == nil || !strings.Contains(err.Error(), "server.read_header_timeout") {
+		t.Errorf("Validate() = %v, want a server.read_header_timeout error", err)
+	}
+}
+
+func TestReadHeaderTimeoutDropsSlowClient(t *testing.T) {
+	config := Config{Server: ServerConfig{ReadHeaderTimeout: "100ms"}}
+	s := newTestServer(t, config)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.srv.Serve(ln)
+	defer s.srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Send the request line but never finish the headers.
+	if _, err := io.WriteString(conn, "GET /healthz HTTP/1.1\r\nHost: x\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	n, err := conn.Read(make([]byte, 1))
+	if n != 0 || !errors.Is(err, io.EOF) {
+		t.Fatalf("read = %d, %v; want the server to close the connection", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+
+	small, big := staticEndpoint("/small", "ok"), staticEndpoint("/big", "ok")
+	small.Method, big.Method = http.MethodPost, http.MethodPost
+	big.MaxBodyBytes = 100
+	config := Config{
+		Server: ServerConfig{MaxBodyBytes: 10},
+		Endpoints: []Endpoint{
+			small,
+			big,
+			{Path: "/proxy", Method: http.MethodPost, Handler: HandlerProxy, Upstream: upstream.URL},
+		},
+	}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		size       int
+		chunked    bool
+		wantStatus int
+	}{
+		{name: "at the default limit", path: "/small", size: 10, wantStatus: http.StatusOK},
+		{name: "over the default limit", path: "/small", size: 11, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "endpoint override allows more", path: "/big", size: 50, wantStatus: http.StatusOK},
+		{name: "over the endpoint override", path: "/big", size: 101, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "undeclared length read past the limit", path: "/proxy", size: 20, chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "undeclared length within the limit", path: "/proxy", size: 5, chunked: true, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(strings.Repeat("x", tt.size)))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+
+	if err := (Config{Endpoints: []Endpoint{{Path: "/x", Method: "GET", Handler: HandlerStatic, MaxBodyBytes: -1}}}).Validate(); err == nil || !strings.Contains(err.Error(), "max_body_bytes must not be negative") {
+		t.Errorf("Validate() = %v, want a max_body_bytes error", err)
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		grace    time.Duration
+		wantErr  error
+		wantLogs []string
+	}{
+		{
+			name:     "request finishes within the grace period",
+			delay:    200 * time.Millisecond,
+			grace:    2 * time.Second,
+			wantLogs: []string{"active_connections=1", "all connections drained"},
+		},
+		{
+			name:     "deadline hit with the request still running",
+			delay:    time.Second,
+			grace:    100 * time.Millisecond,
+			wantErr:  context.DeadlineExceeded,
+			wantLogs: []string{"shutdown deadline reached before connections drained", "active_connections=1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			RegisterHandler("testSlow", func(Endpoint) (http.HandlerFunc, error) {
+				return func(w http.ResponseWriter, r *http.Request) {
+					close(started)
+					time.Sleep(tt.delay)
+					io.WriteString(w, "done")
+				}, nil
+			})
+			t.Cleanup(func() {
+				handlersMu.Lock()
+				delete(handlers, "testSlow")
+				handlersMu.Unlock()
+			})
+
+			config := Config{Endpoints: []Endpoint{{Path: "/slow", Method: http.MethodGet, Handler: "testSlow"}}}
+			s := newTestServer(t, config)
+			var logs bytes.Buffer
+			s.logger = slog.New(slog.NewTextHandler(&logs, nil))
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.srv.Serve(ln)
+			defer s.srv.Close()
+
+			type result struct {
+				body string
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+				if err != nil {
+					done <- result{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				done <- result{string(body), err}
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.grace)
+			defer cancel()
+			start := time.Now()
+			if err := s.Shutdown(ctx); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Shutdown = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil {
+				if elapsed := time.Since(start); elapsed > tt.grace {
+					t.Errorf("Shutdown took %v, longer than the %v grace period", elapsed, tt.grace)
+				}
+				if res := <-done; res.err != nil || res.body != "done" {
+					t.Errorf("request = %q, %v; want it to complete", res.body, res.err)
+				}
+			}
+			for _, want := range tt.wantLogs {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("logs lack %q:\n%s", want, logs.String())
+				}
+			}
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate for localhost and its key to
+// dir, returning their paths and a pool that trusts the certificate.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string, roots *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	certFile = writeFile(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeFile(t, dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile, roots
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	tests := []struct {
+		name      string
+		http2     bool
+		wantProto string
+	}{
+		{name: "enabled", http2: true, wantProto: "HTTP/2.0"},
+		{name: "disabled", wantProto: "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile, roots := writeTestCert(t, dir)
+			path := filepath.Join(dir, "app.sock")
+			config := Config{
+				TLS:       &TLSConfig{CertFile: certFile, KeyFile: keyFile},
+				Server:    ServerConfig{HTTP2: tt.http2},
+				Endpoints: []Endpoint{staticEndpoint("/hello", "hi")},
+			}
+			s := newTestServer(t, config)
+			s.srv.Addr = "unix:" + path
+			if err := s.Reload(config); err != nil {
+				t.Fatal(err)
+			}
+			errCh := make(chan error, 1)
+			go func() { errCh <- s.Start() }()
+			defer func() {
+				s.srv.Close()
+				if err := <-errCh; err != nil {
+					t.Error(err)
+				}
+			}()
+
+			// The client offers h2 either way; the server decides.
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+				TLSClientConfig:   &tls.Config{RootCAs: roots},
+				ForceAttemptHTTP2: true,
+			}}
+			var resp *http.Response
+			var err error
+			for deadline := time.Now().Add(2 * time.Second); ; {
+				resp, err = client.Get("https://localhost/hello")
+				if err == nil || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.Proto != tt.wantProto {
+				t.Errorf("negotiated %s, want %s", resp.Proto, tt.wantProto)
+			}
+			if got := resp.TLS.NegotiatedProtocol; (got == "h2") != tt.http2 {
+				t.Errorf("ALPN protocol = %q with http2 %v", got, tt.http2)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	config := Config{Server: ServerConfig{HTTP2: true}, Endpoints: []Endpoint{staticEndpoint("/hello", "hi")}}
+	s := newTestServer(t, config)
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.srv.Handler)
+	defer srv.Close()
+
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	for _, tc := range []struct {
+		client    *http.Client
+		wantProto string
+	}{
+		{client: h2cClient, wantProto: "HTTP/2.0"},
+		{client: http.DefaultClient, wantProto: "HTTP/1.1"},
+	} {
+		resp, err := tc.client.Get(srv.URL + "/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Proto != tc.wantProto || string(body) != "hi" {
+			t.Errorf("GET /hello = %s %q, want %s", resp.Proto, body, tc.wantProto)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// SessionConfig enables cookie sessions for the login flow. The session
+// cookie is encrypted and authenticated with a key derived from Secret, so
+// it can be neither read nor modified by the client.
+type SessionConfig struct {
+	Secret string `yaml:"secret" json:"secret"`
+	// SecretFile reads Secret from a file when the config is loaded, taking
+	// precedence over an inline secret.
+	SecretFile string `yaml:"secret_file" json:"secret_file"`
+	// CookieName defaults to "session".
+	CookieName string `yaml:"cookie_name" json:"cookie_name"`
+	// MaxAge is how long a session lasts (default 8h), e.g. "12h".
+	MaxAge string `yaml:"max_age" json:"max_age"`
+	// Secure defaults to true for requests received over TLS.
+	Secure *bool `yaml:"secure" json:"secure"`
+	// HTTPOnly defaults to true.
+	HTTPOnly *bool `yaml:"http_only" json:"http_only"`
+	// SameSite is "lax" (the default), "strict" or "none".
+	SameSite string `yaml:"same_site" json:"same_site"`
+}
+
+const (
+	defaultSessionCookie = "session"
+	defaultSessionMaxAge = 8 * time.Hour
+)
+
+var sameSiteModes = map[string]http.SameSite{
+	"":       http.SameSiteLaxMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// Validate checks the session settings when sessions are enabled.
+func (c SessionConfig) Validate() error {
+	if c.Secret == "" {
+		if c != (SessionConfig{}) {
+			return errors.New("session.secret is required")
+		}
+		return nil
+	}
+	var errs []error
+	if len(c.Secret) < 32 {
+		errs = append(errs, errors.New("session.secret must be at least 32 characters"))
+	}
+	if _, err := parseDuration(c.MaxAge, defaultSessionMaxAge); err != nil {
+		errs = append(errs, fmt.Errorf("session.max_age: %w", err))
+	}
+	if _, ok := sameSiteModes[c.SameSite]; !ok {
+		errs = append(errs, fmt.Errorf("session.same_site: unsupported mode %q (expected lax, strict or none)", c.SameSite))
+	}
+	return errors.Join(errs...)
+}
+
+// sessions holds the session store, or nil when sessions are disabled.
+// setResponseState sets it.
+var sessions atomic.Pointer[sessionStore]
+
+type sessionStore struct {
+	config SessionConfig
+	aead   cipher.AEAD
+	maxAge time.Duration
+}
+
+// session is the content of the session cookie.
+type session struct {
+	Claims map[string]interface{} `json:"claims"`
+	// ClientID is the client the login flow authenticated as.
+	ClientID string `json:"client_id"`
+	Expires  int64  `json:"exp"`
+}
+
+// newSessionStore returns the store for config, or nil if sessions are not
+// enabled. Config.Validate has already checked config.
+func newSessionStore(config SessionConfig) *sessionStore {
+	if config.Secret == "" {
+		return nil
+	}
+	key := sha256.Sum256([]byte(config.Secret))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &sessionStore{
+		config: config,
+		aead:   aead,
+		maxAge: mustParseDuration(config.MaxAge, defaultSessionMaxAge),
+	}
+}
+
+func (s *sessionStore) cookieName() string {
+	if s.config.CookieName != "" {
+		return s.config.CookieName
+	}
+	return defaultSessionCookie
+}
+
+func (s *sessionStore) cookie(r *http.Request, value string, expires time.Time) *http.Cookie {
+	secure := r.TLS != nil
+	if s.config.Secure != nil {
+		secure = *s.config.Secure
+	}
+	httpOnly := true
+	if s.config.HTTPOnly != nil {
+		httpOnly = *s.config.HTTPOnly
+	}
+	return &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   secure,
+		HttpOnly: httpOnly,
+		SameSite: sameSiteModes[s.config.SameSite],
+	}
+}
+
+// save starts a session carrying claims for a login as clientID. It never
+// outlives notAfter, the expiry of the ID token it was created from, when
+// that is set.
+func (s *sessionStore) save(w http.ResponseWriter, r *http.Request, claims map[string]interface{}, clientID string, notAfter time.Time) error {
+	expires := time.Now().Add(s.maxAge)
+	if !notAfter.IsZero() && notAfter.Before(expires) {
+		expires = notAfter
+	}
+	plaintext, err := json.Marshal(session{Claims: claims, ClientID: clientID, Expires: expires.Unix()})
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plaintext, []byte(s.cookieName()))
+	http.SetCookie(w, s.cookie(r, base64.RawURLEncoding.EncodeToString(sealed), expires))
+	return nil
+}
+
+// load returns the session in r's cookie. A missing, tampered-with or
+// expired cookie is reported as an error.
+func (s *sessionStore) load(r *http.Request) (*session, error) {
+	cookie, err := r.Cookie(s.cookieName())
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("malformed session cookie")
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, []byte(s.cookieName()))
+	if err != nil {
+		return nil, errors.New("session cookie failed authentication")
+	}
+
+	var sess session
+	if err := json.Unmarshal(plaintext, &sess); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= sess.Expires {
+		return nil, errors.New("session expired")
+	}
+	return &sess, nil
+}
+
+// clear ends the session.
+func (s *sessionStore) clear(w http.ResponseWriter, r *http.Request) {
+	c := s.cookie(r, "", time.Unix(0, 0))
+	c.MaxAge = -1
+	http.SetCookie(w, c)
+}
+
+// claims returns the claims of a valid session that oidcConfig accepts; see
+// session.check. It is safe to call on a nil store.
+func (s *sessionStore) claims(r *http.Request, oidcConfig OIDC) (map[string]interface{}, bool) {
+	if s == nil {
+		return nil, false
+	}
+	sess, err := s.load(r)
+	if err != nil {
+		return nil, false
+	}
+	if err := sess.check(r, oidcConfig); err != nil {
+		slog.Debug("session not accepted", "path", r.URL.Path, "error", err)
+		return nil, false
+	}
+	return sess.Claims, true
+}
+
+// check applies to the session the checks its ID token would face as a
+// bearer token at an endpoint configured with oidcConfig: the issuer, the
+// client, the audience under the token_type rules, audiences and nonce. A
+// session from one client's login is not accepted by endpoints of another.
+func (sess *session) check(r *http.Request, oidcConfig OIDC) error {
+	iss, _ := sess.Claims["iss"].(string)
+	if !slices.Contains(oidcConfig.issuerList(), iss) {
+		return fmt.Errorf("session issuer %q is not accepted", iss)
+	}
+	if sess.ClientID != oidcConfig.ClientID {
+		return fmt.Errorf("session belongs to client %q", sess.ClientID)
+	}
+	if key := oidcConfig.verifierKey(iss); !key.skipClientIDCheck {
+		auds, err := parseAudiences(sess.Claims)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(auds, key.audience) {
+			return fmt.Errorf("session audience %q does not include %q", auds, key.audience)
+		}
+	}
+	if err := checkAudience(oidcConfig, sess.Claims); err != nil {
+		return err
+	}
+	return checkNonce(r, oidcConfig, sess.Claims)
+}
+
+func init() {
+	RegisterHandler(HandlerLogout, newLogoutHandler)
+}
+
+// newLogoutHandler clears the session and the login token cookie, then
+// redirects to login.landing_path.
+func newLogoutHandler(endpoint Endpoint) (http.HandlerFunc, error) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store := sessions.Load(); store != nil {
+			store.clear(w, r)
+		}
+		http.SetCookie(w, &http.Cookie{Name: endpoint.Login.tokenCookie(), Path: "/", MaxAge: -1})
+		http.Redirect(w, r, endpoint.Login.landingPath(), http.StatusFound)
+	}, nil
+}
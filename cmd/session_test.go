@@ -0,0 +1,180 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+const testSessionSecret = "0123456789abcdef0123456789abcdef"
+
+func TestSessionLoginAndLogout(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	p.LoginClaims = map[string]interface{}{"sub": "alice", "email": "alice@example.com"}
+	oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}
+	s := loginServer(t, p, Config{
+		Session: SessionConfig{Secret: testSessionSecret},
+		Endpoints: []Endpoint{
+			{Path: "/me", Method: http.MethodGet, Handler: HandlerHello, OIDC: oidcConfig},
+			{Path: "/logout", Method: http.MethodGet, Handler: HandlerLogout, Login: LoginConfig{LandingPath: "/bye"}},
+		},
+	})
+
+	// The callback starts a session instead of handing out the ID token.
+	_, rec := completeLogin(t, s)
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		switch c.Name {
+		case defaultSessionCookie:
+			cookie = c
+		case defaultTokenCookie:
+			t.Errorf("ID token cookie set alongside the session")
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("session cookie = %+v, want HttpOnly and SameSite=Lax", cookie)
+	}
+
+	// The session authenticates without a bearer token.
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "Hello, alice@example.com!" {
+		t.Fatalf("GET /me with session = %d %q", rec.Code, rec.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/logout", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/bye" {
+		t.Fatalf("GET /logout = %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == defaultSessionCookie && c.MaxAge < 0 && c.Value == "" {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Errorf("logout did not clear the session cookie: %v", rec.Result().Cookies())
+	}
+	if rec := get(s, "/me"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me after logout = %d, want 401", rec.Code)
+	}
+}
+
+func TestSessionReload(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	me := Endpoint{Path: "/me", Method: http.MethodGet, Handler: HandlerHello, OIDC: OIDC{Issuer: p.Issuer(), ClientID: p.ClientID}}
+	s := loginServer(t, p, Config{Session: SessionConfig{Secret: testSessionSecret}, Endpoints: []Endpoint{me}})
+	_, rec := completeLogin(t, s)
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == defaultSessionCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatalf("no session cookie in %v", rec.Result().Cookies())
+	}
+
+	// Reloading without sessions stops the cookie from authenticating.
+	config := Config{Endpoints: []Endpoint{me}}
+	if err := s.Reload(config); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET /me with session after reload = %d, want 401", rec.Code)
+	}
+}
+
+func TestSessionClaimsChecks(t *testing.T) {
+	const issuer, client = "https://idp.example.com", "web-app"
+	claims := map[string]interface{}{"iss": issuer, "aud": client, "sub": "alice"}
+	tests := []struct {
+		name     string
+		clientID string
+		cfg      OIDC
+		want     bool
+	}{
+		{name: "login endpoint's own config", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: client}, want: true},
+		{name: "one of several issuers", clientID: client, cfg: OIDC{Issuer: "https://other.example.com", Issuers: []string{issuer}, ClientID: client}, want: true},
+		{name: "other issuer", clientID: client, cfg: OIDC{Issuer: "https://other.example.com", ClientID: client}},
+		{name: "other client", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: "admin-app"}},
+		{name: "login as another client", clientID: "admin-app", cfg: OIDC{Issuer: issuer, ClientID: client}},
+		{name: "audience not carried", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: client, Audience: "https://api.example.com"}},
+		{name: "audiences listing the client", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: client, Audiences: []string{"mobile-app", client}}, want: true},
+		{name: "audiences without the client", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: client, Audiences: []string{"mobile-app"}}},
+		{name: "access tokens without audience", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: client, TokenType: tokenTypeAccess}, want: true},
+		{name: "access tokens for an api", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: client, TokenType: tokenTypeAccess, Audience: "https://api.example.com"}},
+		{name: "nonce required", clientID: client, cfg: OIDC{Issuer: issuer, ClientID: client, Nonce: "n-0S6"}},
+	}
+	store := newSessionStore(SessionConfig{Secret: testSessionSecret})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if err := store.save(rec, httptest.NewRequest(http.MethodGet, "/callback", nil), claims, tt.clientID, time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(rec.Result().Cookies()[0])
+			if _, ok := store.claims(req, tt.cfg); ok != tt.want {
+				t.Errorf("session accepted = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionTamperDetection(t *testing.T) {
+	store := newSessionStore(SessionConfig{Secret: testSessionSecret})
+	rec := httptest.NewRecorder()
+	if err := store.save(rec, httptest.NewRequest(http.MethodGet, "/", nil), map[string]interface{}{"sub": "alice"}, "web-app", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	valid := rec.Result().Cookies()[0]
+
+	flip := []byte(valid.Value)
+	i := len(flip) / 2
+	if flip[i] == 'A' {
+		flip[i] = 'B'
+	} else {
+		flip[i] = 'A'
+	}
+	tests := []struct {
+		name    string
+		store   *sessionStore
+		cookie  *http.Cookie
+		wantErr string
+	}{
+		{name: "modified byte", store: store, cookie: &http.Cookie{Name: valid.Name, Value: string(flip)}, wantErr: "failed authentication"},
+		{name: "truncated", store: store, cookie: &http.Cookie{Name: valid.Name, Value: valid.Value[:10]}, wantErr: "malformed"},
+		{name: "not base64", store: store, cookie: &http.Cookie{Name: valid.Name, Value: "!!!"}, wantErr: "malformed"},
+		{name: "other secret", store: newSessionStore(SessionConfig{Secret: strings.Repeat("x", 32)}), cookie: valid, wantErr: "failed authentication"},
+		{name: "moved to another cookie name", store: newSessionStore(SessionConfig{Secret: testSessionSecret, CookieName: "sid"}), cookie: &http.Cookie{Name: "sid", Value: valid.Value}, wantErr: "failed authentication"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(tt.cookie)
+			if _, err := tt.store.load(req); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("load error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(valid)
+	if _, err := store.load(req); err != nil {
+		t.Errorf("untouched cookie rejected: %v", err)
+	}
+}
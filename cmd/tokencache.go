@@ -0,0 +1,82 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// tokenCache is a bounded LRU of successfully verified tokens, keyed by the
+// SHA-256 of the full raw token. Entries expire at the token's exp. Failed
+// verifications are never cached.
+type tokenCache struct {
+	size int
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type tokenCacheEntry struct {
+	key     [sha256.Size]byte
+	idToken *oidc.IDToken
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+func newTokenCache(size int) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		ll:      list.New(),
+		entries: make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+func (c *tokenCache) get(rawToken string, now time.Time) (*oidc.IDToken, map[string]interface{}, bool) {
+	key := sha256.Sum256([]byte(rawToken))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	entry := elem.Value.(*tokenCacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(elem)
+		return nil, nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return entry.idToken, entry.claims, true
+}
+
+func (c *tokenCache) add(rawToken string, idToken *oidc.IDToken, claims map[string]interface{}) {
+	if idToken.Expiry.IsZero() {
+		return
+	}
+	key := sha256.Sum256([]byte(rawToken))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.ll.PushFront(&tokenCacheEntry{
+		key:     key,
+		idToken: idToken,
+		claims:  claims,
+		expires: idToken.Expiry,
+	})
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *tokenCache) remove(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.entries, elem.Value.(*tokenCacheEntry).key)
+}
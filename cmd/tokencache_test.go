@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+func TestTokenCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := newTokenCache(10)
+	c.add("short", &oidc.IDToken{Expiry: now.Add(time.Minute)}, map[string]interface{}{"sub": "alice"})
+	c.add("no-exp", &oidc.IDToken{}, nil)
+
+	tests := []struct {
+		name  string
+		token string
+		at    time.Time
+		hit   bool
+	}{
+		{name: "before exp", token: "short", at: now, hit: true},
+		{name: "at exp", token: "short", at: now.Add(time.Minute), hit: false},
+		{name: "evicted once expired", token: "short", at: now, hit: false},
+		{name: "tokens without exp are not cached", token: "no-exp", at: now, hit: false},
+	}
+	for _, tt := range tests {
+		if _, _, hit := c.get(tt.token, tt.at); hit != tt.hit {
+			t.Errorf("%s: hit = %v, want %v", tt.name, hit, tt.hit)
+		}
+	}
+	if n := c.ll.Len(); n != 0 {
+		t.Errorf("%d entries left, want 0", n)
+	}
+}
+
+func TestTokenCacheLRU(t *testing.T) {
+	now := time.Now()
+	exp := &oidc.IDToken{Expiry: now.Add(time.Hour)}
+	c := newTokenCache(2)
+	c.add("a", exp, nil)
+	c.add("b", exp, nil)
+	c.get("a", now) // a is now the most recently used
+	c.add("c", exp, nil)
+
+	for token, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, hit := c.get(token, now); hit != want {
+			t.Errorf("%s cached = %v, want %v", token, hit, want)
+		}
+	}
+}
+
+func TestTokenCacheOnlyCachesSuccess(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	other := oidctest.NewProvider(t)
+	mw := newOIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, TokenCacheSize: 10}, nil)
+	h := mw.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+		wantSize   int
+	}{
+		{name: "forged", token: other.SignToken(map[string]interface{}{"sub": "mallory", "iss": p.Issuer()}), wantStatus: http.StatusUnauthorized, wantSize: 0},
+		{name: "expired", token: p.SignToken(map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Minute).Unix()}), wantStatus: http.StatusUnauthorized, wantSize: 0},
+		{name: "valid", token: p.SignToken(map[string]interface{}{"sub": "alice"}), wantStatus: http.StatusOK, wantSize: 1},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("%s, attempt %d: status = %d, want %d", tt.name, i+1, rec.Code, tt.wantStatus)
+			}
+		}
+		if n := mw.tokens.ll.Len(); n != tt.wantSize {
+			t.Errorf("after %s: %d cached tokens, want %d", tt.name, n, tt.wantSize)
+		}
+	}
+}
+
+// benchmarkAuthenticate measures authenticating the same token repeatedly,
+// with the given token cache size (0 disables the cache).
+func benchmarkAuthenticate(b *testing.B, cacheSize int) {
+	p := oidctest.NewProvider(b)
+	mw := newOIDCMiddleware(OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, TokenCacheSize: cacheSize}, nil)
+	token := p.SignToken(map[string]interface{}{"sub": "alice"})
+	ctx := context.Background()
+	if _, _, err := mw.authenticate(ctx, token); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := mw.authenticate(ctx, token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAuthenticateCacheHit(b *testing.B) { benchmarkAuthenticate(b, 100) }
+
+func BenchmarkAuthenticateUncached(b *testing.B) { benchmarkAuthenticate(b, 0) }
+
+func BenchmarkTokenCacheMiss(b *testing.B) {
+	c := newTokenCache(100)
+	now := time.Now()
+	for i := 0; i < b.N; i++ {
+		c.get("not-cached", now)
+	}
+}
+
+func BenchmarkTokenCacheEviction(b *testing.B) {
+	c := newTokenCache(100)
+	exp := &oidc.IDToken{Expiry: time.Now().Add(time.Hour)}
+	tokens := make([]string, 1000)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("token-%d", i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// With 10x more tokens than slots, nearly every add evicts.
+		c.add(tokens[i%len(tokens)], exp, nil)
+	}
+}
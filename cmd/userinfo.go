@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultUserInfoCacheTTL = time.Minute
+	defaultUserInfoAttempts = 2
+	userInfoBackoff         = 200 * time.Millisecond
+)
+
+// userInfoCache remembers UserInfo responses by issuer and subject, so a
+// caller's requests share one lookup until the entry expires. Failed
+// lookups are not cached.
+type userInfoCache struct {
+	mu      sync.Mutex
+	entries map[userInfoKey]userInfoEntry
+}
+
+type userInfoKey struct {
+	issuer  string
+	subject string
+}
+
+type userInfoEntry struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+var userInfos = newUserInfoCache()
+
+func newUserInfoCache() *userInfoCache {
+	return &userInfoCache{entries: make(map[userInfoKey]userInfoEntry)}
+}
+
+// merge returns claims with the caller's UserInfo claims added. Claims in
+// the token take precedence, so UserInfo can add attributes but never
+// change the issuer, subject or audience that were verified.
+func (c *userInfoCache) merge(ctx context.Context, oidcConfig OIDC, rawToken string, claims map[string]interface{}) (map[string]interface{}, error) {
+	key := userInfoKey{issuer: claimString(claims["iss"]), subject: claimString(claims["sub"])}
+	if key.issuer == "" || key.subject == "" {
+		return nil, errors.New("token has no iss or sub claim to look up user info for")
+	}
+
+	info, err := c.lookup(ctx, oidcConfig, key, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]interface{}, len(claims)+len(info))
+	for name, value := range info {
+		merged[name] = value
+	}
+	for name, value := range claims {
+		merged[name] = value
+	}
+	return merged, nil
+}
+
+// lookup returns the UserInfo claims for key, consulting the cache before
+// calling the provider.
+func (c *userInfoCache) lookup(ctx context.Context, oidcConfig OIDC, key userInfoKey, rawToken string) (map[string]interface{}, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.claims, nil
+	}
+
+	claims, err := fetchUserInfo(ctx, oidcConfig, key, rawToken)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = userInfoEntry{claims: claims, expires: now.Add(oidcConfig.userInfoCacheTTL())}
+	return claims, nil
+}
+
+// fetchUserInfo calls the issuer's UserInfo endpoint with rawToken, retrying
+// with exponential backoff unless the provider rejected the token.
+func fetchUserInfo(ctx context.Context, oidcConfig OIDC, key userInfoKey, rawToken string) (map[string]interface{}, error) {
+	pkey := oidcConfig.verifierKey(key.issuer).providerKey
+	info, err := providers.provider(ctx, pkey, oidcConfig.discoveryAttempts())
+	if err != nil {
+		return nil, &discoveryError{err: err}
+	}
+	if info.provider == nil {
+		return nil, errors.New("userinfo needs a discovered provider")
+	}
+	client, err := pkey.tls.client()
+	if err != nil {
+		return nil, err
+	}
+	ctx = oidc.ClientContext(ctx, client)
+	tokens := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: rawToken, TokenType: "Bearer"})
+
+	backoff := userInfoBackoff
+	for i := 1; ; i++ {
+		userInfo, err := info.provider.UserInfo(ctx, tokens)
+		if err == nil {
+			if userInfo.Subject != key.subject {
+				return nil, errors.New("userinfo: sub does not match the token")
+			}
+			var claims map[string]interface{}
+			if err := userInfo.Claims(&claims); err != nil {
+				return nil, fmt.Errorf("userinfo: %w", err)
+			}
+			return claims, nil
+		}
+		if i >= oidcConfig.userInfoAttempts() || !retryableUserInfoError(err) {
+			return nil, fmt.Errorf("userinfo: %w", err)
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryableUserInfoError reports whether err might succeed on retry. go-oidc
+// reports error responses as "<status>: <body>", so client errors such as a
+// rejected token are recognised by their leading 4xx status.
+func retryableUserInfoError(err error) bool {
+	msg := err.Error()
+	if len(msg) < 3 {
+		return true
+	}
+	status, convErr := strconv.Atoi(msg[:3])
+	return convErr != nil || status < 400 || status >= 500
+}
+
+func (o OIDC) userInfoCacheTTL() time.Duration {
+	return mustParseDuration(o.UserInfoCacheTTL, defaultUserInfoCacheTTL)
+}
+
+func (o OIDC) userInfoAttempts() int {
+	if o.UserInfoAttempts > 0 {
+		return o.UserInfoAttempts
+	}
+	return defaultUserInfoAttempts
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// claimsHandler responds with the claims the OIDC middleware put in the
+// request context.
+var claimsHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(ClaimsFromContext(r.Context()))
+})
+
+// serveClaims sends token through the OIDC middleware for oidcConfig and
+// returns the status and the claims the handler saw.
+func serveClaims(t *testing.T, oidcConfig OIDC, token string) (int, map[string]interface{}) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	OIDCMiddleware(oidcConfig)(claimsHandler).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &claims); err != nil {
+		t.Fatalf("claims %q: %v", rec.Body, err)
+	}
+	return rec.Code, claims
+}
+
+func TestFetchUserInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		disabled   bool
+		attempts   int
+		failures   int
+		userInfo   map[string]interface{}
+		token      map[string]interface{}
+		wantStatus int
+		wantClaims map[string]interface{}
+		wantCalls  int
+	}{
+		{
+			name:       "merged",
+			userInfo:   map[string]interface{}{"sub": "alice", "email": "alice@example.com", "department": "sales"},
+			token:      map[string]interface{}{"sub": "alice"},
+			wantStatus: http.StatusOK,
+			wantClaims: map[string]interface{}{"sub": "alice", "email": "alice@example.com", "department": "sales"},
+			wantCalls:  1,
+		},
+		{
+			name:       "token claims win",
+			userInfo:   map[string]interface{}{"sub": "alice", "email": "old@example.com", "aud": "other"},
+			token:      map[string]interface{}{"sub": "alice", "email": "alice@example.com"},
+			wantStatus: http.StatusOK,
+			wantClaims: map[string]interface{}{"email": "alice@example.com", "aud": oidctest.DefaultClientID},
+			wantCalls:  1,
+		},
+		{
+			name:       "disabled",
+			disabled:   true,
+			userInfo:   map[string]interface{}{"sub": "alice", "department": "sales"},
+			token:      map[string]interface{}{"sub": "alice"},
+			wantStatus: http.StatusOK,
+			wantClaims: map[string]interface{}{"department": nil},
+		},
+		{
+			name:       "other subject",
+			userInfo:   map[string]interface{}{"sub": "bob"},
+			token:      map[string]interface{}{"sub": "alice"},
+			wantStatus: http.StatusBadGateway,
+			wantCalls:  1,
+		},
+		{
+			name:       "token rejected is not retried",
+			token:      map[string]interface{}{"sub": "alice"},
+			wantStatus: http.StatusBadGateway,
+			wantCalls:  1,
+		},
+		{
+			name:       "retried",
+			failures:   1,
+			userInfo:   map[string]interface{}{"sub": "alice", "department": "sales"},
+			token:      map[string]interface{}{"sub": "alice"},
+			wantStatus: http.StatusOK,
+			wantClaims: map[string]interface{}{"department": "sales"},
+			wantCalls:  2,
+		},
+		{
+			name:       "retries exhausted",
+			attempts:   3,
+			failures:   3,
+			userInfo:   map[string]interface{}{"sub": "alice"},
+			token:      map[string]interface{}{"sub": "alice"},
+			wantStatus: http.StatusBadGateway,
+			wantCalls:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := oidctest.NewProvider(t)
+			p.UserInfo = tt.userInfo
+			p.FailUserInfo(tt.failures)
+			oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, FetchUserInfo: !tt.disabled, UserInfoAttempts: tt.attempts}
+
+			status, claims := serveClaims(t, oidcConfig, p.SignToken(tt.token))
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			for name, want := range tt.wantClaims {
+				if got := claims[name]; got != want {
+					t.Errorf("claim %s = %v, want %v", name, got, want)
+				}
+			}
+			if got := p.UserInfoCalls(); got != tt.wantCalls {
+				t.Errorf("UserInfo called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestUserInfoCache(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	oidcConfig := OIDC{Issuer: p.Issuer(), ClientID: p.ClientID, FetchUserInfo: true, UserInfoCacheTTL: "200ms"}
+	alice := p.SignToken(map[string]interface{}{"sub": "alice"})
+	bob := p.SignToken(map[string]interface{}{"sub": "bob"})
+
+	steps := []struct {
+		name      string
+		userInfo  map[string]interface{}
+		token     string
+		wait      time.Duration
+		wantPlan  string
+		wantCalls int
+	}{
+		{name: "first lookup", userInfo: map[string]interface{}{"sub": "alice", "plan": "free"}, token: alice, wantPlan: "free", wantCalls: 1},
+		{name: "cached", userInfo: map[string]interface{}{"sub": "alice", "plan": "pro"}, token: alice, wantPlan: "free", wantCalls: 1},
+		{name: "cached per subject", userInfo: map[string]interface{}{"sub": "bob", "plan": "team"}, token: bob, wantPlan: "team", wantCalls: 2},
+		{name: "expired", userInfo: map[string]interface{}{"sub": "alice", "plan": "pro"}, token: alice, wait: 250 * time.Millisecond, wantPlan: "pro", wantCalls: 3},
+	}
+	for _, step := range steps {
+		p.UserInfo = step.userInfo
+		time.Sleep(step.wait)
+		status, claims := serveClaims(t, oidcConfig, step.token)
+		if status != http.StatusOK {
+			t.Fatalf("%s: status = %d", step.name, status)
+		}
+		if got := claims["plan"]; got != step.wantPlan {
+			t.Errorf("%s: plan = %v, want %s", step.name, got, step.wantPlan)
+		}
+		if got := p.UserInfoCalls(); got != step.wantCalls {
+			t.Errorf("%s: UserInfo called %d times, want %d", step.name, got, step.wantCalls)
+		}
+	}
+
+	// A failed lookup is not cached.
+	carol := p.SignToken(map[string]interface{}{"sub": "carol"})
+	p.UserInfo = map[string]interface{}{"sub": "carol", "plan": "free"}
+	p.FailUserInfo(2)
+	if status, _ := serveClaims(t, oidcConfig, carol); status != http.StatusBadGateway {
+		t.Fatalf("with UserInfo down: status = %d, want 502", status)
+	}
+	if status, claims := serveClaims(t, oidcConfig, carol); status != http.StatusOK || claims["plan"] != "free" {
+		t.Errorf("after UserInfo recovered: status = %d, claims = %v", status, claims)
+	}
+}
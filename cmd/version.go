@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build information, set at link time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.date=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "unknown"
+	date    = "unknown"
+)
+
+// versionString describes the build for -version and the startup log.
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", version, commit, date, runtime.Version())
+}
@@ -0,0 +1,399 @@
+// Package oidctest runs a fake OIDC provider on an httptest server, over
+// HTTP or TLS. It serves discovery, JWKS, UserInfo and a PKCE login flow
+// (/authorize and /token), and mints RS256 or ES256 ID tokens with real
+// signatures, so auth code is tested without a mocked verifier. Tests can
+// rotate the signing key and make discovery, JWKS or UserInfo calls fail.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// DefaultClientID is the audience SignToken uses when the claims don't set
+// one.
+const DefaultClientID = "oidctest-client"
+
+// Provider is a running fake OIDC provider.
+type Provider struct {
+	// ClientID is the default "aud" of minted tokens.
+	ClientID string
+	// ClientSecret, when set, is required of clients exchanging a code at
+	// the /token endpoint.
+	ClientSecret string
+	// UserInfo is what the /userinfo endpoint returns to any bearer token.
+	// When nil the endpoint responds 401.
+	UserInfo map[string]interface{}
+	// LoginClaims are the claims of the ID token the /token endpoint issues
+	// for an authorization code. The /authorize endpoint approves every
+	// request at once, redirecting back with a code.
+	LoginClaims map[string]interface{}
+
+	t      testing.TB
+	server *httptest.Server
+
+	mu       sync.Mutex
+	key      *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+	keyID    string
+	rotation int
+	failKeys int
+	failDisc int
+	failInfo int
+	codes    map[string]authCode
+
+	userInfoCalls  atomic.Int64
+	keysCalls      atomic.Int64
+	discoveryCalls atomic.Int64
+}
+
+// NewProvider starts a provider that is shut down when the test ends.
+func NewProvider(t testing.TB) *Provider {
+	t.Helper()
+	return newProvider(t, httptest.NewServer)
+}
+
+// NewTLSProvider is like NewProvider but serves HTTPS with a self-signed
+// certificate; see CertificatePEM.
+func NewTLSProvider(t testing.TB) *Provider {
+	t.Helper()
+	return newProvider(t, httptest.NewTLSServer)
+}
+
+func newProvider(t testing.TB, start func(http.Handler) *httptest.Server) *Provider {
+	t.Helper()
+	p := &Provider{ClientID: DefaultClientID, t: t, codes: make(map[string]authCode)}
+	p.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/keys", p.handleKeys)
+	mux.HandleFunc("/userinfo", p.handleUserInfo)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+	p.server = start(mux)
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+// CertificatePEM returns the PEM-encoded certificate of a provider started
+// with NewTLSProvider, for use as a CA bundle. It is nil for plain HTTP
+// providers.
+func (p *Provider) CertificatePEM() []byte {
+	cert := p.server.Certificate()
+	if cert == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// RotateKey replaces the signing keys with fresh ones under new key IDs.
+// Tokens signed afterwards use the new keys, and the JWKS endpoint serves
+// only the new keys, as after an IdP rotation.
+func (p *Provider) RotateKey() {
+	p.t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		p.t.Fatalf("oidctest: generating key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatalf("oidctest: generating key: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.key, p.ecKey = key, ecKey
+	p.keyID = "oidctest-" + strconv.Itoa(p.rotation)
+	p.rotation++
+}
+
+// Issuer returns the provider's issuer URL.
+func (p *Provider) Issuer() string {
+	return p.server.URL
+}
+
+// UserInfoCalls returns how many times the /userinfo endpoint was called.
+func (p *Provider) UserInfoCalls() int {
+	return int(p.userInfoCalls.Load())
+}
+
+// DiscoveryCalls returns how many times the discovery document was fetched.
+func (p *Provider) DiscoveryCalls() int {
+	return int(p.discoveryCalls.Load())
+}
+
+// KeysCalls returns how many times the JWKS endpoint was called.
+func (p *Provider) KeysCalls() int {
+	return int(p.keysCalls.Load())
+}
+
+// FailKeys makes the next n requests to the JWKS endpoint fail with 503, as
+// during a network blip.
+func (p *Provider) FailKeys(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failKeys = n
+}
+
+// FailDiscovery makes the next n requests to the discovery document fail
+// with 503, as while the provider is down.
+func (p *Provider) FailDiscovery(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failDisc = n
+}
+
+// FailUserInfo makes the next n requests to the UserInfo endpoint fail with
+// 503.
+func (p *Provider) FailUserInfo(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failInfo = n
+}
+
+// SignToken returns a signed ID token carrying claims. The iss, aud, iat and
+// exp claims default to the provider's issuer, ClientID, now and an hour
+// from now; set them to test other values, e.g. an expired token.
+func (p *Provider) SignToken(claims map[string]interface{}) string {
+	p.t.Helper()
+	token, err := p.signToken("RS256", claims)
+	if err != nil {
+		p.t.Fatalf("oidctest: %v", err)
+	}
+	return token
+}
+
+// SignES256Token is like SignToken but signs with the provider's P-256 key.
+// The discovery document advertises only RS256, so verifiers accept these
+// tokens only when configured to.
+func (p *Provider) SignES256Token(claims map[string]interface{}) string {
+	p.t.Helper()
+	token, err := p.signToken("ES256", claims)
+	if err != nil {
+		p.t.Fatalf("oidctest: %v", err)
+	}
+	return token
+}
+
+func (p *Provider) signToken(alg string, claims map[string]interface{}) (string, error) {
+	now := time.Now()
+	full := map[string]interface{}{
+		"iss": p.Issuer(),
+		"aud": p.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for name, v := range claims {
+		full[name] = v
+	}
+
+	p.mu.Lock()
+	key, ecKey, keyID := p.key, p.ecKey, p.keyID
+	p.mu.Unlock()
+	if alg == "ES256" {
+		keyID += "-ec"
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": keyID, "typ": "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("encoding header: %w", err)
+	}
+	payload, err := json.Marshal(full)
+	if err != nil {
+		return "", fmt.Errorf("encoding claims: %w", err)
+	}
+	enc := base64.RawURLEncoding
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var sig []byte
+	if alg == "ES256" {
+		// JWS encodes the signature as r and s, each padded to 32 bytes.
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("signing token: %w", err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("signing token: %w", err)
+		}
+	}
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	p.discoveryCalls.Add(1)
+	p.mu.Lock()
+	fail := p.failDisc > 0
+	if fail {
+		p.failDisc--
+	}
+	p.mu.Unlock()
+	if fail {
+		http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                p.Issuer(),
+		"authorization_endpoint":                p.Issuer() + "/authorize",
+		"token_endpoint":                        p.Issuer() + "/token",
+		"jwks_uri":                              p.Issuer() + "/keys",
+		"userinfo_endpoint":                     p.Issuer() + "/userinfo",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *Provider) handleKeys(w http.ResponseWriter, r *http.Request) {
+	p.keysCalls.Add(1)
+	p.mu.Lock()
+	fail := p.failKeys > 0
+	if fail {
+		p.failKeys--
+	}
+	pub, ecPub, keyID := p.key.PublicKey, p.ecKey.PublicKey, p.keyID
+	p.mu.Unlock()
+	if fail {
+		http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	enc := base64.RawURLEncoding
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   enc.EncodeToString(pub.N.Bytes()),
+			"e":   enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, {
+			"kty": "EC",
+			"alg": "ES256",
+			"use": "sig",
+			"kid": keyID + "-ec",
+			"crv": "P-256",
+			"x":   enc.EncodeToString(ecPub.X.FillBytes(make([]byte, 32))),
+			"y":   enc.EncodeToString(ecPub.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+}
+
+func (p *Provider) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	p.userInfoCalls.Add(1)
+	p.mu.Lock()
+	fail := p.failInfo > 0
+	if fail {
+		p.failInfo--
+	}
+	p.mu.Unlock()
+	if fail {
+		http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if p.UserInfo == nil || !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, p.UserInfo)
+}
+
+// authCode is what the provider remembers about an issued code.
+type authCode struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+}
+
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("client_id") != p.ClientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "unsupported authorization request", http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := base64.RawURLEncoding.EncodeToString(b)
+	p.mu.Lock()
+	p.codes[code] = authCode{clientID: p.ClientID, redirectURI: redirect.String(), challenge: q.Get("code_challenge")}
+	p.mu.Unlock()
+
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if p.ClientSecret != "" && clientSecret != p.ClientSecret {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	p.mu.Lock()
+	code, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || code.clientID != clientID || code.redirectURI != r.PostForm.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	idToken, err := p.signToken("RS256", p.LoginClaims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": "oidctest-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
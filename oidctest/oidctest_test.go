@@ -0,0 +1,288 @@
+package oidctest_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/bgordon-vivante/clients-yaml-oidc.git/oidctest"
+)
+
+// verifier discovers p afresh, so each call sees the current JWKS.
+func verifier(t *testing.T, p *oidctest.Provider, config *oidc.Config) *oidc.IDTokenVerifier {
+	t.Helper()
+	provider, err := oidc.NewProvider(context.Background(), p.Issuer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.Verifier(config)
+}
+
+func TestSignToken(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	tests := []struct {
+		name    string
+		sign    func(map[string]interface{}) string
+		claims  map[string]interface{}
+		config  oidc.Config
+		wantErr string
+	}{
+		{name: "defaults", sign: p.SignToken, claims: map[string]interface{}{"sub": "alice"}, config: oidc.Config{ClientID: p.ClientID}},
+		{name: "custom audience", sign: p.SignToken, claims: map[string]interface{}{"sub": "alice", "aud": "other"}, config: oidc.Config{ClientID: p.ClientID}, wantErr: "expected audience"},
+		{name: "expired", sign: p.SignToken, claims: map[string]interface{}{"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()}, config: oidc.Config{ClientID: p.ClientID}, wantErr: "token is expired"},
+		{name: "other issuer", sign: p.SignToken, claims: map[string]interface{}{"sub": "alice", "iss": "https://idp.example.com"}, config: oidc.Config{ClientID: p.ClientID}, wantErr: "id token issued by a different provider"},
+		{name: "ES256 not advertised", sign: p.SignES256Token, claims: map[string]interface{}{"sub": "alice"}, config: oidc.Config{ClientID: p.ClientID}, wantErr: "unsupported algorithm"},
+		{name: "ES256 when allowed", sign: p.SignES256Token, claims: map[string]interface{}{"sub": "alice"}, config: oidc.Config{ClientID: p.ClientID, SupportedSigningAlgs: []string{oidc.ES256}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := verifier(t, p, &tt.config).Verify(context.Background(), tt.sign(tt.claims))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Verify error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if token.Issuer != p.Issuer() || token.Subject != "alice" || len(token.Audience) != 1 || token.Audience[0] != p.ClientID {
+				t.Errorf("token = iss %s, sub %s, aud %v", token.Issuer, token.Subject, token.Audience)
+			}
+			if d := time.Until(token.Expiry); d < 59*time.Minute || d > time.Hour {
+				t.Errorf("expiry in %v, want an hour", d)
+			}
+		})
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	config := &oidc.Config{ClientID: p.ClientID}
+	before := p.SignToken(map[string]interface{}{"sub": "alice"})
+
+	p.RotateKey()
+	v := verifier(t, p, config)
+	if _, err := v.Verify(context.Background(), before); err == nil {
+		t.Error("token signed with the retired key still verifies")
+	}
+	if _, err := v.Verify(context.Background(), p.SignToken(map[string]interface{}{"sub": "alice"})); err != nil {
+		t.Errorf("token signed with the new key: %v", err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	p.UserInfo = map[string]interface{}{"sub": "alice"}
+	tests := []struct {
+		name  string
+		fail  func(n int)
+		path  string
+		calls func() int
+	}{
+		{name: "discovery", fail: p.FailDiscovery, path: "/.well-known/openid-configuration", calls: p.DiscoveryCalls},
+		{name: "keys", fail: p.FailKeys, path: "/keys", calls: p.KeysCalls},
+		{name: "userinfo", fail: p.FailUserInfo, path: "/userinfo", calls: p.UserInfoCalls},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := tt.calls()
+			tt.fail(2)
+			for i, want := range []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK} {
+				req, _ := http.NewRequest(http.MethodGet, p.Issuer()+tt.path, nil)
+				req.Header.Set("Authorization", "Bearer anything")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != want {
+					t.Errorf("request %d = %d, want %d", i+1, resp.StatusCode, want)
+				}
+			}
+			if got := tt.calls() - start; got != 3 {
+				t.Errorf("counted %d calls, want 3", got)
+			}
+		})
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	provider, err := oidc.NewProvider(context.Background(), p.Issuer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "anything"})
+
+	if _, err := provider.UserInfo(context.Background(), source); err == nil {
+		t.Error("UserInfo succeeded with no UserInfo set")
+	}
+	p.UserInfo = map[string]interface{}{"sub": "alice", "email": "alice@example.com"}
+	info, err := provider.UserInfo(context.Background(), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Subject != "alice" || info.Email != "alice@example.com" {
+		t.Errorf("userinfo = %+v", info)
+	}
+	if got := p.UserInfoCalls(); got != 2 {
+		t.Errorf("UserInfoCalls = %d, want 2", got)
+	}
+}
+
+func TestLoginFlow(t *testing.T) {
+	const redirectURL = "https://app.example.com/callback"
+	tests := []struct {
+		name         string
+		secret       string
+		clientSecret string
+		verifier     string
+		redirectURL  string
+		replay       bool
+		wantErr      string
+	}{
+		{name: "exchange"},
+		{name: "client secret", secret: "s3cret", clientSecret: "s3cret"},
+		{name: "wrong client secret", secret: "s3cret", clientSecret: "guess", wantErr: "invalid_client"},
+		{name: "wrong verifier", verifier: oauth2.GenerateVerifier(), wantErr: "invalid_grant"},
+		{name: "wrong redirect", redirectURL: "https://evil.example.com/callback", wantErr: "invalid_grant"},
+		{name: "code replayed", replay: true, wantErr: "invalid_grant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := oidctest.NewProvider(t)
+			p.ClientSecret = tt.secret
+			p.LoginClaims = map[string]interface{}{"sub": "alice"}
+			provider, err := oidc.NewProvider(context.Background(), p.Issuer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &oauth2.Config{ClientID: p.ClientID, ClientSecret: tt.clientSecret, Endpoint: provider.Endpoint(), RedirectURL: redirectURL, Scopes: []string{oidc.ScopeOpenID}}
+
+			pkce := oauth2.GenerateVerifier()
+			noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+			resp, err := noFollow.Get(config.AuthCodeURL("xyz", oauth2.S256ChallengeOption(pkce)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			callback, err := resp.Location()
+			if err != nil {
+				t.Fatalf("authorize did not redirect (status %d): %v", resp.StatusCode, err)
+			}
+			if got := callback.Query().Get("state"); got != "xyz" {
+				t.Errorf("state = %q, want xyz", got)
+			}
+			if !strings.HasPrefix(callback.String(), redirectURL+"?") {
+				t.Errorf("redirected to %s, want %s", callback, redirectURL)
+			}
+
+			code := callback.Query().Get("code")
+			if tt.verifier != "" {
+				pkce = tt.verifier
+			}
+			if tt.redirectURL != "" {
+				config.RedirectURL = tt.redirectURL
+			}
+			if tt.replay {
+				if _, err := config.Exchange(context.Background(), code, oauth2.VerifierOption(pkce)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			token, err := config.Exchange(context.Background(), code, oauth2.VerifierOption(pkce))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Exchange error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rawIDToken, _ := token.Extra("id_token").(string)
+			idToken, err := provider.Verifier(&oidc.Config{ClientID: p.ClientID}).Verify(context.Background(), rawIDToken)
+			if err != nil {
+				t.Fatalf("ID token: %v", err)
+			}
+			if idToken.Subject != "alice" {
+				t.Errorf("subject = %q, want alice", idToken.Subject)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRejects(t *testing.T) {
+	p := oidctest.NewProvider(t)
+	valid := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {"https://app.example.com/callback"},
+		"code_challenge":        {"challenge"},
+		"code_challenge_method": {"S256"},
+	}
+	tests := []struct {
+		name  string
+		param string
+		value string
+	}{
+		{name: "relative redirect", param: "redirect_uri", value: "/callback"},
+		{name: "other client", param: "client_id", value: "other"},
+		{name: "no PKCE", param: "code_challenge_method", value: ""},
+		{name: "plain PKCE", param: "code_challenge_method", value: "plain"},
+		{name: "implicit flow", param: "response_type", value: "token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{}
+			for k, v := range valid {
+				q[k] = v
+			}
+			q.Set(tt.param, tt.value)
+			resp, err := http.Get(p.Issuer() + "/authorize?" + q.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestTLSProvider(t *testing.T) {
+	if oidctest.NewProvider(t).CertificatePEM() != nil {
+		t.Error("plain HTTP provider has a certificate")
+	}
+
+	p := oidctest.NewTLSProvider(t)
+	if !strings.HasPrefix(p.Issuer(), "https://") {
+		t.Fatalf("issuer %s is not HTTPS", p.Issuer())
+	}
+	if _, err := oidc.NewProvider(context.Background(), p.Issuer()); err == nil {
+		t.Error("discovery trusted the self-signed certificate without its CA")
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(p.CertificatePEM()) {
+		t.Fatal("CertificatePEM is not a PEM certificate")
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	ctx := oidc.ClientContext(context.Background(), client)
+	provider, err := oidc.NewProvider(ctx, p.Issuer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Verifier(&oidc.Config{ClientID: p.ClientID}).Verify(ctx, p.SignToken(map[string]interface{}{"sub": "alice"})); err != nil {
+		t.Errorf("Verify over TLS: %v", err)
+	}
+}